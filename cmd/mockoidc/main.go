@@ -0,0 +1,225 @@
+// mockoidc is a minimal openid connect issuer for local tests of the s3image login and bearer authentication.
+// it accepts every login without asking and issues tokens for the configured user and groups
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"github.com/je4/s3image/v2/pkg/oidc"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const kid = "mock"
+
+type issuer struct {
+	sync.Mutex
+	url      string
+	key      *rsa.PrivateKey
+	clientID string
+	secret   string
+	user     string
+	groups   []string
+	ttl      time.Duration
+	codes    map[string]oidc.Claims
+}
+
+// loadKey reads the rsa key from filename or creates it, so tokens stay valid between runs
+func loadKey(filename string) (*rsa.PrivateKey, error) {
+	if filename != "" {
+		if data, err := os.ReadFile(filename); err == nil {
+			block, _ := pem.Decode(data)
+			if block == nil {
+				return nil, fmt.Errorf("no pem data in %s", filename)
+			}
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		}
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	if filename != "" {
+		data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		if err := os.WriteFile(filename, data, 0600); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func (is *issuer) claims(sub, aud string, groups []string) oidc.Claims {
+	now := time.Now()
+	return oidc.Claims{
+		"iss":                is.url,
+		"sub":                sub,
+		"aud":                aud,
+		"iat":                now.Unix(),
+		"exp":                now.Add(is.ttl).Unix(),
+		"preferred_username": sub,
+		"groups":             groups,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+func (is *issuer) discovery(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, oidc.Provider{
+		Issuer:                is.url,
+		AuthorizationEndpoint: is.url + "/authorize",
+		TokenEndpoint:         is.url + "/token",
+		JWKSURI:               is.url + "/jwks",
+	})
+}
+
+func (is *issuer) jwks(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, oidc.JWKS{Keys: []oidc.JWK{oidc.NewRSAJWK(kid, &is.key.PublicKey)}})
+}
+
+// authorize logs in the configured user (or login_hint) and returns to the client at once
+func (is *issuer) authorize(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	if q.Get("client_id") != is.clientID {
+		http.Error(w, "unknown client", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirect.Scheme == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	sub := is.user
+	if hint := q.Get("login_hint"); hint != "" {
+		sub = hint
+	}
+	claims := is.claims(sub, is.clientID, is.groups)
+	if nonce := q.Get("nonce"); nonce != "" {
+		claims["nonce"] = nonce
+	}
+	code := fmt.Sprintf("%x", time.Now().UnixNano())
+	is.Lock()
+	is.codes[code] = claims
+	is.Unlock()
+	rq := redirect.Query()
+	rq.Set("code", code)
+	rq.Set("state", q.Get("state"))
+	redirect.RawQuery = rq.Encode()
+	log.Printf("login of %s", sub)
+	http.Redirect(w, req, redirect.String(), http.StatusFound)
+}
+
+func (is *issuer) token(w http.ResponseWriter, req *http.Request) {
+	client, secret, ok := req.BasicAuth()
+	if !ok {
+		client, secret = req.FormValue("client_id"), req.FormValue("client_secret")
+	}
+	if client != is.clientID || (is.secret != "" && secret != is.secret) {
+		w.WriteHeader(http.StatusUnauthorized)
+		writeJSON(w, map[string]string{"error": "invalid_client"})
+		return
+	}
+	code := req.FormValue("code")
+	is.Lock()
+	claims, ok := is.codes[code]
+	delete(is.codes, code)
+	is.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	idToken, err := oidc.SignRS256(claims, kid, is.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"access_token": idToken,
+		"id_token":     idToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(is.ttl.Seconds()),
+	})
+}
+
+// mint returns a bearer token for sub, groups and aud from the query
+func (is *issuer) mint(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	sub := q.Get("sub")
+	if sub == "" {
+		sub = is.user
+	}
+	aud := q.Get("aud")
+	if aud == "" {
+		aud = is.clientID
+	}
+	groups := is.groups
+	if g := q.Get("groups"); g != "" {
+		groups = strings.Split(g, ",")
+	}
+	token, err := oidc.SignRS256(is.claims(sub, aud, groups), kid, is.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-type", "text/plain")
+	fmt.Fprintln(w, token)
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:8089", "listen address")
+	issuerURL := flag.String("issuer", "", "issuer url (default http://<addr>)")
+	keyFile := flag.String("key", "", "pem file of the signing key, created if missing")
+	jwksFile := flag.String("jwks", "", "write the key set to this file for offline token validation")
+	clientID := flag.String("client", "s3image", "client id")
+	secret := flag.String("secret", "", "client secret (empty: any)")
+	user := flag.String("user", "tester", "subject of the issued tokens")
+	groups := flag.String("groups", "staff", "comma separated groups claim of the issued tokens")
+	ttl := flag.Duration("ttl", time.Hour, "token lifetime")
+	flag.Parse()
+
+	key, err := loadKey(*keyFile)
+	if err != nil {
+		log.Fatalf("cannot load key: %v", err)
+	}
+	is := &issuer{
+		url:      strings.TrimRight(*issuerURL, "/"),
+		key:      key,
+		clientID: *clientID,
+		secret:   *secret,
+		user:     *user,
+		groups:   strings.Split(*groups, ","),
+		ttl:      *ttl,
+		codes:    map[string]oidc.Claims{},
+	}
+	if is.url == "" {
+		is.url = "http://" + *addr
+	}
+	if *jwksFile != "" {
+		data, _ := json.Marshal(oidc.JWKS{Keys: []oidc.JWK{oidc.NewRSAJWK(kid, &key.PublicKey)}})
+		if err := os.WriteFile(*jwksFile, data, 0644); err != nil {
+			log.Fatalf("cannot write %s: %v", *jwksFile, err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", is.discovery)
+	mux.HandleFunc("/jwks", is.jwks)
+	mux.HandleFunc("/authorize", is.authorize)
+	mux.HandleFunc("/token", is.token)
+	mux.HandleFunc("/mint", is.mint)
+	log.Printf("mock issuer %s listening on %s", is.url, *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
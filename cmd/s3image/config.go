@@ -3,19 +3,162 @@ package main
 import (
 	"github.com/BurntSushi/toml"
 	"github.com/je4/zsearch/v2/configdata"
+	"github.com/pkg/errors"
 	"log"
 	"os"
+	"time"
 )
 
 type LocalFS struct {
 	Path string `toml:"path"`
 }
 
+type S3 struct {
+	Endpoint           string              `toml:"endpoint"`
+	AccessKeyId        string              `toml:"accessKeyId"`
+	SecretAccessKey    string              `toml:"secretAccessKey"`
+	SessionToken       string              `toml:"sessionToken"`
+	UseSSL             bool                `toml:"useSSL"`
+	Credentials        []string            `toml:"credentials"`
+	AWSCredentialsFile string              `toml:"awscredentialsfile"`
+	AWSProfile         string              `toml:"awsprofile"`
+	MinioConfigFile    string              `toml:"minioconfigfile"`
+	MinioAlias         string              `toml:"minioalias"`
+	IAMEndpoint        string              `toml:"iamendpoint"`
+	STSEndpoint        string              `toml:"stsendpoint"`
+	STSRoleARN         string              `toml:"stsrolearn"`
+	STSRoleSessionName string              `toml:"stsrolesessionname"`
+	STSDuration        configdata.Duration `toml:"stsduration"`
+	Region             string              `toml:"region"`
+	BucketLookup       string              `toml:"bucketlookup"`
+	CACert             string              `toml:"cacert"`
+	SkipVerify         bool                `toml:"skipverify"`
+}
+
+type Upload struct {
+	Enabled bool  `toml:"enabled"`
+	Verify  bool  `toml:"verify"`
+	MaxSize int64 `toml:"maxsize"`
+}
+
+type Manage struct {
+	Enabled bool `toml:"enabled"`
+}
+
+type Zip struct {
+	MaxSize  int64 `toml:"maxsize"`
+	MaxFiles int   `toml:"maxfiles"`
+}
+
+type PDF struct {
+	Profile  string  `toml:"profile"`
+	DPI      float64 `toml:"dpi"`
+	Metadata bool    `toml:"metadata"`
+}
+
+type CBZ struct {
+	Profile string `toml:"profile"`
+}
+
+type Sort struct {
+	Default string            `toml:"default"`
+	Folders map[string]string `toml:"folders"`
+}
+
+type ClaimMapping struct {
+	Claim  string `toml:"claim"`
+	Value  string `toml:"value"`
+	Bucket string `toml:"bucket"`
+	Prefix string `toml:"prefix"`
+	Role   string `toml:"role"`
+}
+
+type OIDC struct {
+	Enabled       bool                `toml:"enabled"`
+	Issuer        string              `toml:"issuer"`
+	JWKS          string              `toml:"jwks"`
+	Audience      string              `toml:"audience"`
+	ClientID      string              `toml:"clientid"`
+	ClientSecret  string              `toml:"clientsecret"`
+	Scopes        []string            `toml:"scopes"`
+	UsernameClaim string              `toml:"usernameclaim"`
+	Mapping       []ClaimMapping      `toml:"mapping"`
+	SessionTTL    configdata.Duration `toml:"sessionttl"`
+	Leeway        configdata.Duration `toml:"leeway"`
+}
+
+type ACLRule struct {
+	Bucket  string    `toml:"bucket"`
+	Prefix  string    `toml:"prefix"`
+	Effect  string    `toml:"effect"`
+	Actions []string  `toml:"actions"`
+	Users   []string  `toml:"users"`
+	Roles   []string  `toml:"roles"`
+	IPs     []string  `toml:"ips"`
+	From    time.Time `toml:"from"`
+	Until   time.Time `toml:"until"`
+}
+
+type ACL struct {
+	Sidecar    bool                `toml:"sidecar"`
+	SidecarTTL configdata.Duration `toml:"sidecarttl"`
+	Rule       []ACLRule           `toml:"rule"`
+	// TrustedProxies may set the client address with X-Forwarded-For
+	TrustedProxies []string `toml:"trustedproxies"`
+}
+
+type Share struct {
+	Enabled       bool                `toml:"enabled"`
+	DefaultExpiry configdata.Duration `toml:"defaultexpiry"`
+	MaxExpiry     configdata.Duration `toml:"maxexpiry"`
+}
+
+type Transform struct {
+	Workers       int                 `toml:"workers"`
+	QueueLength   int                 `toml:"queuelength"`
+	MagickThreads int                 `toml:"magickthreads"`
+	RetryAfter    configdata.Duration `toml:"retryafter"`
+}
+
+type Worker struct {
+	Enabled     bool                `toml:"enabled"`
+	Processes   int                 `toml:"processes"`
+	Timeout     configdata.Duration `toml:"timeout"`
+	MemoryLimit int64               `toml:"memorylimit"`
+}
+
+type Metrics struct {
+	Enabled bool   `toml:"enabled"`
+	Role    string `toml:"role"`
+}
+
+type Tracing struct {
+	Enabled     bool    `toml:"enabled"`
+	Exporter    string  `toml:"exporter"`
+	Endpoint    string  `toml:"endpoint"`
+	Insecure    bool    `toml:"insecure"`
+	SampleRatio float64 `toml:"sampleratio"`
+}
+
+type Limits struct {
+	MaxInputSize int64               `toml:"maxinputsize"`
+	Formats      []string            `toml:"formats"`
+	Width        int64               `toml:"width"`
+	Height       int64               `toml:"height"`
+	Pixels       int64               `toml:"pixels"`
+	Area         int64               `toml:"area"`
+	Memory       int64               `toml:"memory"`
+	Map          int64               `toml:"map"`
+	Disk         int64               `toml:"disk"`
+	Time         configdata.Duration `toml:"time"`
+}
+
 type Config struct {
 	ServiceName         string              `toml:"servicename"`
 	Logfile             string              `toml:"logfile"`
 	Loglevel            string              `toml:"loglevel"`
 	Logformat           string              `toml:"logformat"`
+	LogJSON             bool                `toml:"logjson"`
 	AccessLog           string              `toml:"accesslog"`
 	Addr                string              `toml:"addr"`
 	AddrExt             string              `toml:"addrext"`
@@ -24,22 +167,90 @@ type Config struct {
 	Buckets             map[string]string   `toml:"buckets"`
 	UserName            string              `toml:"username"`
 	Password            string              `toml:"password"`
-	S3                  configdata.CfgS3    `toml:"s3"`
+	UserFile            string              `toml:"userfile"`
+	S3                  S3                  `toml:"s3"`
 	S3CacheExp          configdata.Duration `toml:"s3cacheexp"`
 	CacheDir            string              `toml:"cachedir"`
+	StoreDir            string              `toml:"storedir"`
 	Templates           map[string]string   `toml:"template"`
 	ClearCacheOnStartup bool                `toml:"clearcacheonstartup"`
 	Filesystem          string              `toml:"filesystem"`
 	Local               LocalFS             `toml:"local"`
+	Upload              Upload              `toml:"upload"`
+	Manage              Manage              `toml:"manage"`
+	Zip                 Zip                 `toml:"zip"`
+	PDF                 PDF                 `toml:"pdf"`
+	CBZ                 CBZ                 `toml:"cbz"`
+	Sort                Sort                `toml:"sort"`
+	OIDC                OIDC                `toml:"oidc"`
+	ACL                 ACL                 `toml:"acl"`
+	Share               Share               `toml:"share"`
+	Transform           Transform           `toml:"transform"`
+	Limits              Limits              `toml:"limits"`
+	Worker              Worker              `toml:"worker"`
+	Metrics             Metrics             `toml:"metrics"`
+	Tracing             Tracing             `toml:"tracing"`
+
+	// s3 settings of single buckets in [s3bucket.<name>], the [s3] section is the default
+	S3Buckets map[string]toml.Primitive `toml:"s3bucket"`
+	// BucketS3 are the resolved settings of S3Buckets, changes need a restart
+	BucketS3 map[string]S3 `toml:"-"`
 }
 
 func LoadConfig(filepath string) Config {
+	conf, err := ReadConfig(filepath)
+	if err != nil {
+		log.Fatalln("Error on loading config: ", err)
+	}
+	return conf
+}
+
+// ReadConfig reads the config file without exiting on errors, e.g. for a reload
+func ReadConfig(filepath string) (Config, error) {
 	var conf Config
 	conf.Logformat = "%{time:2006-01-02T15:04:05.000} %{module}::%{shortfunc} [%{shortfile}] > %{level:.5s} - %{message}"
 	conf.Filesystem = "s3"
-	_, err := toml.DecodeFile(filepath, &conf)
+	conf.Upload.Verify = true
+	conf.PDF.Profile = "page"
+	conf.PDF.DPI = 72
+	conf.PDF.Metadata = true
+	conf.CBZ.Profile = "page"
+	conf.Sort.Default = "natural"
+	conf.OIDC.UsernameClaim = "preferred_username"
+	conf.OIDC.Scopes = []string{"profile", "email"}
+	conf.OIDC.SessionTTL.Duration = 8 * time.Hour
+	conf.OIDC.Leeway.Duration = time.Minute
+	conf.ACL.SidecarTTL.Duration = time.Minute
+	conf.Share.DefaultExpiry.Duration = 7 * 24 * time.Hour
+	conf.Share.MaxExpiry.Duration = 90 * 24 * time.Hour
+	conf.Transform.QueueLength = 100
+	conf.Transform.MagickThreads = 1
+	conf.Transform.RetryAfter.Duration = 5 * time.Second
+	conf.Limits.MaxInputSize = 256 << 20
+	conf.Limits.Width = 30000
+	conf.Limits.Height = 30000
+	conf.Limits.Pixels = 250000000
+	conf.Limits.Area = 1 << 30
+	conf.Limits.Memory = 2 << 30
+	conf.Limits.Map = 4 << 30
+	conf.Limits.Disk = 8 << 30
+	conf.Limits.Time.Duration = 2 * time.Minute
+	conf.Worker.Timeout.Duration = 3 * time.Minute
+	conf.Worker.MemoryLimit = 8 << 30
+	conf.Tracing.Exporter = "otlp"
+	conf.Tracing.SampleRatio = 1
+	md, err := toml.DecodeFile(filepath, &conf)
 	if err != nil {
-		log.Fatalln("Error on loading config: ", err)
+		return Config{}, errors.Wrapf(err, "cannot decode %s", filepath)
+	}
+	// settings of a bucket override the global s3 settings
+	conf.BucketS3 = map[string]S3{}
+	for bucket, prim := range conf.S3Buckets {
+		s3 := conf.S3
+		if err := md.PrimitiveDecode(prim, &s3); err != nil {
+			return Config{}, errors.Wrapf(err, "cannot decode s3bucket.%s in %s", bucket, filepath)
+		}
+		conf.BucketS3[bucket] = s3
 	}
 
 	clearcache := os.Getenv("S3IMAGE_CLEARCACHE")
@@ -50,5 +261,5 @@ func LoadConfig(filepath string) Config {
 		conf.ClearCacheOnStartup = false
 	}
 
-	return conf
+	return conf, nil
 }
@@ -1,40 +1,203 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"flag"
+	"fmt"
 	badger "github.com/dgraph-io/badger/v3"
 	"github.com/je4/s3image/v2/pkg/filesystem"
+	"github.com/je4/s3image/v2/pkg/media"
 	"github.com/je4/s3image/v2/pkg/server"
+	"github.com/je4/s3image/v2/pkg/structlog"
+	"github.com/je4/s3image/v2/pkg/tracing"
+	"github.com/je4/s3image/v2/pkg/worker"
 	lm "github.com/je4/utils/v2/pkg/logger"
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
 	"io"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
+// magickLimits returns the imagemagick limits of the server and the worker processes
+func magickLimits(config Config) media.MagickLimits {
+	// parallelism comes from the transform workers
+	return media.MagickLimits{
+		Width:   config.Limits.Width,
+		Height:  config.Limits.Height,
+		Pixels:  config.Limits.Pixels,
+		Area:    config.Limits.Area,
+		Memory:  config.Limits.Memory,
+		Map:     config.Limits.Map,
+		Disk:    config.Limits.Disk,
+		Time:    config.Limits.Time.Duration,
+		Threads: config.Transform.MagickThreads,
+	}
+}
+
+// workerArgs passes the validated configuration of the server to the worker processes,
+// they do not read the config file again
+func workerArgs(config Config) []string {
+	limits := magickLimits(config)
+	return []string{
+		"worker",
+		"-memorylimit", strconv.FormatInt(config.Worker.MemoryLimit, 10),
+		"-width", strconv.FormatInt(limits.Width, 10),
+		"-height", strconv.FormatInt(limits.Height, 10),
+		"-pixels", strconv.FormatInt(limits.Pixels, 10),
+		"-area", strconv.FormatInt(limits.Area, 10),
+		"-memory", strconv.FormatInt(limits.Memory, 10),
+		"-map", strconv.FormatInt(limits.Map, 10),
+		"-disk", strconv.FormatInt(limits.Disk, 10),
+		"-time", limits.Time.String(),
+		"-threads", strconv.Itoa(limits.Threads),
+		"-service", config.ServiceName,
+		"-tracing=" + strconv.FormatBool(config.Tracing.Enabled),
+		"-tracing-exporter", config.Tracing.Exporter,
+		"-tracing-endpoint", config.Tracing.Endpoint,
+		"-tracing-insecure=" + strconv.FormatBool(config.Tracing.Insecure),
+		"-tracing-sampleratio", strconv.FormatFloat(config.Tracing.SampleRatio, 'g', -1, 64),
+	}
+}
+
+// runWorker serves the image transformations of the server process (see worker.Pool)
+func runWorker(args []string) {
+	var limits media.MagickLimits
+	var tracingConf tracing.Config
+	flags := flag.NewFlagSet("worker", flag.ExitOnError)
+	memoryLimit := flags.Int64("memorylimit", 0, "address space limit of the process in bytes")
+	flags.Int64Var(&limits.Width, "width", 0, "maximum image width")
+	flags.Int64Var(&limits.Height, "height", 0, "maximum image height")
+	flags.Int64Var(&limits.Pixels, "pixels", 0, "maximum number of pixels")
+	flags.Int64Var(&limits.Area, "area", 0, "maximum pixel cache in memory")
+	flags.Int64Var(&limits.Memory, "memory", 0, "imagemagick memory limit in bytes")
+	flags.Int64Var(&limits.Map, "map", 0, "imagemagick map limit in bytes")
+	flags.Int64Var(&limits.Disk, "disk", 0, "imagemagick disk limit in bytes")
+	flags.DurationVar(&limits.Time, "time", 0, "maximum time of one operation")
+	flags.IntVar(&limits.Threads, "threads", 0, "imagemagick threads")
+	service := flags.String("service", "s3image", "service name for tracing")
+	flags.BoolVar(&tracingConf.Enabled, "tracing", false, "enable tracing")
+	flags.StringVar(&tracingConf.Exporter, "tracing-exporter", "", "otlp or stdout")
+	flags.StringVar(&tracingConf.Endpoint, "tracing-endpoint", "", "host:port of the otlp collector")
+	flags.BoolVar(&tracingConf.Insecure, "tracing-insecure", false, "otlp without tls")
+	flags.Float64Var(&tracingConf.SampleRatio, "tracing-sampleratio", 0, "part of the recorded traces")
+	flags.Parse(args)
+
+	if err := media.SetResourceLimitsV3(limits); err != nil {
+		log.Fatalf("cannot set imagemagick limits: %v", err)
+	}
+	shutdownTracing, err := tracing.Init(tracingConf, *service)
+	if err != nil {
+		log.Fatalf("cannot initialize tracing: %v", err)
+	}
+	err = worker.Run(*memoryLimit)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdownTracing(ctx)
+	if err != nil {
+		log.Fatalf("worker process failed: %v", err)
+	}
+}
+
+func tracingConfig(config Config) tracing.Config {
+	return tracing.Config{
+		Enabled:     config.Tracing.Enabled,
+		Exporter:    config.Tracing.Exporter,
+		Endpoint:    config.Tracing.Endpoint,
+		Insecure:    config.Tracing.Insecure,
+		SampleRatio: config.Tracing.SampleRatio,
+	}
+}
+
+func pdfConfig(config Config) server.PDFConfig {
+	return server.PDFConfig{
+		Profile:  config.PDF.Profile,
+		DPI:      config.PDF.DPI,
+		Metadata: config.PDF.Metadata,
+	}
+}
+
+func cbzConfig(config Config) server.CBZConfig {
+	return server.CBZConfig{
+		Profile: config.CBZ.Profile,
+	}
+}
+
+// reload applies buckets, users, templates and book profiles of the config file to the running server
+func reload(srv *server.Server, cfgFile string) error {
+	config, err := ReadConfig(cfgFile)
+	if err != nil {
+		return err
+	}
+	var users *server.UserStore
+	if config.UserFile != "" {
+		if users, err = server.LoadUserStore(config.UserFile); err != nil {
+			return errors.Wrap(err, "cannot load users")
+		}
+	}
+	return srv.Reload(config.Buckets, config.Templates, users, config.UserName, config.Password, pdfConfig(config), cbzConfig(config))
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "worker" {
+		runWorker(os.Args[2:])
+		return
+	}
+
 	cfgFile := flag.String("cfg", "/etc/s3image.toml", "locations of config file")
+	hashPassword := flag.Bool("bcrypt", false, "read a password from stdin and print its bcrypt hash for the user file")
 	flag.Parse()
+
+	if *hashPassword {
+		pw, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatalf("cannot read password: %v", err)
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(strings.TrimRight(pw, "\r\n")), bcrypt.DefaultCost)
+		if err != nil {
+			log.Fatalf("cannot hash password: %v", err)
+		}
+		fmt.Println(string(hash))
+		return
+	}
+
 	config := LoadConfig(*cfgFile)
 
 	// create logger instance
 	logger, lf := lm.CreateLogger("S3Image", config.Logfile, nil, config.Loglevel, config.Logformat)
 	defer lf.Close()
+	// application and access log as json lines
+	if config.LogJSON {
+		logging.SetFormatter(structlog.JSONFormatter{})
+	}
 
 	var fs filesystem.FileSystem
 	var err error
 
 	switch config.Filesystem {
 	case "s3":
-		fs, err = filesystem.NewS3Fs(config.S3.Endpoint, config.S3.AccessKeyId, config.S3.SecretAccessKey, config.S3CacheExp.Duration, config.S3.UseSSL)
+		fs, err = newS3Fs(config.S3, config.S3CacheExp.Duration)
 		if err != nil {
 			logger.Fatalf("cannot connect to s3 instance: %v", err)
 		}
+		if len(config.BucketS3) > 0 {
+			buckets := map[string]filesystem.FileSystem{}
+			for bucket, s3 := range config.BucketS3 {
+				if buckets[bucket], err = newS3Fs(s3, config.S3CacheExp.Duration); err != nil {
+					logger.Fatalf("cannot connect to s3 instance of bucket %s: %v", bucket, err)
+				}
+			}
+			fs = filesystem.NewBucketFs(fs, buckets)
+		}
 	case "local":
 		fs, err = filesystem.NewLocalFs(config.Local.Path, logger)
 		if err != nil {
@@ -66,6 +229,14 @@ func main() {
 		logger.Panicf("%s not a director", config.CacheDir)
 		return
 	}
+	// share links and sessions outlive a cleared cache
+	if config.StoreDir == "" {
+		config.StoreDir = filepath.Join(config.CacheDir, "store")
+	}
+	if err := os.MkdirAll(config.StoreDir, 0755); err != nil {
+		logger.Panicf("cannot create store \"%s\": %v", config.StoreDir, err)
+		return
+	}
 	if config.ClearCacheOnStartup {
 		logger.Infof("deleting cache files in %s", config.CacheDir)
 		if len(config.CacheDir) < 4 {
@@ -86,6 +257,9 @@ func main() {
 		d.Close()
 		for _, name := range names {
 			fullpath := filepath.Join(config.CacheDir, name)
+			if fullpath == filepath.Clean(config.StoreDir) {
+				continue
+			}
 			logger.Infof("delete %s", fullpath)
 			if err := os.Remove(fullpath); err != nil {
 				logger.Panicf("cannot delete %s", fullpath)
@@ -109,12 +283,132 @@ func main() {
 		return
 	}
 	defer db.Close()
+	sconfig := badger.DefaultOptions(config.StoreDir)
+	sconfig.Logger = logger
+	store, err := badger.Open(sconfig)
+	if err != nil {
+		log.Panicf("cannot open badger store: %v", err)
+		return
+	}
+	defer store.Close()
+
+	var users *server.UserStore
+	if config.UserFile != "" {
+		if users, err = server.LoadUserStore(config.UserFile); err != nil {
+			logger.Panicf("cannot load users: %v", err)
+		}
+	}
+
+	var mappings []server.ClaimMapping
+	for _, m := range config.OIDC.Mapping {
+		mappings = append(mappings, server.ClaimMapping{
+			Claim:  m.Claim,
+			Value:  m.Value,
+			Bucket: m.Bucket,
+			Prefix: m.Prefix,
+			Role:   server.Role(m.Role),
+		})
+	}
+
+	var aclRules []server.ACLRule
+	for _, r := range config.ACL.Rule {
+		rule := server.ACLRule{
+			Bucket: r.Bucket,
+			Prefix: r.Prefix,
+			Effect: r.Effect,
+			Users:  r.Users,
+			IPs:    r.IPs,
+			From:   r.From,
+			Until:  r.Until,
+		}
+		for _, a := range r.Actions {
+			rule.Actions = append(rule.Actions, server.ACLAction(a))
+		}
+		for _, role := range r.Roles {
+			rule.Roles = append(rule.Roles, server.Role(role))
+		}
+		aclRules = append(aclRules, rule)
+	}
 
-	srv, err := server.NewServer(config.ServiceName, config.Addr, config.AddrExt, config.UserName, config.Password, logger, accessLog, fs, db, config.Buckets, config.Templates)
+	if err := media.SetResourceLimitsV3(magickLimits(config)); err != nil {
+		logger.Panicf("cannot set imagemagick limits: %v", err)
+	}
+
+	// images are transformed in the server process without worker processes
+	var images worker.Transformer
+	var workers *worker.Pool
+	if config.Worker.Enabled {
+		exe, err := os.Executable()
+		if err != nil {
+			logger.Panicf("cannot find executable for worker processes: %v", err)
+		}
+		processes := config.Worker.Processes
+		if processes <= 0 {
+			processes = config.Transform.Workers
+		}
+		workers = worker.NewPool(worker.PoolConfig{
+			Executable: exe,
+			Args:       workerArgs(config),
+			Processes:  processes,
+			Timeout:    config.Worker.Timeout.Duration,
+		}, logger)
+		images = workers
+	}
+
+	srv, err := server.NewServer(config.ServiceName, config.Addr, config.AddrExt, config.UserName, config.Password, logger, accessLog, fs, db, store, config.Buckets, config.Templates, server.UploadConfig{
+		Enabled: config.Upload.Enabled,
+		Verify:  config.Upload.Verify,
+		MaxSize: config.Upload.MaxSize,
+	}, config.Manage.Enabled, server.ZipConfig{
+		MaxSize:  config.Zip.MaxSize,
+		MaxFiles: config.Zip.MaxFiles,
+	}, pdfConfig(config), cbzConfig(config), server.SortConfig{
+		Default: config.Sort.Default,
+		Folders: config.Sort.Folders,
+	}, users, server.OIDCConfig{
+		Enabled:       config.OIDC.Enabled,
+		Issuer:        config.OIDC.Issuer,
+		JWKS:          config.OIDC.JWKS,
+		Audience:      config.OIDC.Audience,
+		ClientID:      config.OIDC.ClientID,
+		ClientSecret:  config.OIDC.ClientSecret,
+		Scopes:        config.OIDC.Scopes,
+		UsernameClaim: config.OIDC.UsernameClaim,
+		Mappings:      mappings,
+		SessionTTL:    config.OIDC.SessionTTL.Duration,
+		Leeway:        config.OIDC.Leeway.Duration,
+	}, server.ACLConfig{
+		Rules:          aclRules,
+		Sidecar:        config.ACL.Sidecar,
+		SidecarTTL:     config.ACL.SidecarTTL.Duration,
+		TrustedProxies: config.ACL.TrustedProxies,
+	}, server.ShareConfig{
+		Enabled:       config.Share.Enabled,
+		DefaultExpiry: config.Share.DefaultExpiry.Duration,
+		MaxExpiry:     config.Share.MaxExpiry.Duration,
+	}, server.TransformConfig{
+		Workers:       config.Transform.Workers,
+		QueueLength:   config.Transform.QueueLength,
+		MagickThreads: config.Transform.MagickThreads,
+		RetryAfter:    config.Transform.RetryAfter.Duration,
+	}, server.InputConfig{
+		MaxSize: config.Limits.MaxInputSize,
+		Formats: config.Limits.Formats,
+	}, images, server.MetricsConfig{
+		Enabled: config.Metrics.Enabled,
+		Role:    server.Role(config.Metrics.Role),
+	}, server.LogConfig{
+		JSON: config.LogJSON,
+	})
 	if err != nil {
 		logger.Panicf("cannot start server: %v", err)
 	}
 
+	shutdownTracing, err := tracing.Init(tracingConfig(config), config.ServiceName)
+	if err != nil {
+		logger.Panicf("cannot initialize tracing: %v", err)
+	}
+
 	go func() {
 		logger.Infof("server starting at %s - %s", config.Addr, config.AddrExt)
 		if err := srv.ListenAndServe(config.CertPEM, config.KeyPEM); err != nil {
@@ -122,6 +416,18 @@ func main() {
 		}
 	}()
 
+	// SIGHUP reloads the configuration, other settings need a restart
+	go func() {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		for range sighup {
+			logger.Infof("reloading %s", *cfgFile)
+			if err := reload(srv, *cfgFile); err != nil {
+				logger.Errorf("cannot reload %s, keeping the running configuration: %v", *cfgFile, err)
+			}
+		}
+	}()
+
 	end := make(chan bool, 1)
 
 	// process waiting for interrupt signal (TERM or KILL)
@@ -142,6 +448,12 @@ func main() {
 		defer cancel()
 
 		srv.Shutdown(ctx)
+		if workers != nil {
+			workers.Close()
+		}
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Errorf("cannot flush traces: %v", err)
+		}
 
 		end <- true
 	}()
@@ -150,3 +462,27 @@ func main() {
 	logger.Info("server stopped")
 
 }
+
+// newS3Fs connects to the s3 instance of conf
+func newS3Fs(conf S3, exp time.Duration) (*filesystem.S3Fs, error) {
+	return filesystem.NewS3Fs(conf.Endpoint, exp, filesystem.S3Options{
+		AccessKeyId:        conf.AccessKeyId,
+		SecretAccessKey:    conf.SecretAccessKey,
+		SessionToken:       conf.SessionToken,
+		Credentials:        conf.Credentials,
+		AWSCredentialsFile: conf.AWSCredentialsFile,
+		AWSProfile:         conf.AWSProfile,
+		MinioConfigFile:    conf.MinioConfigFile,
+		MinioAlias:         conf.MinioAlias,
+		IAMEndpoint:        conf.IAMEndpoint,
+		STSEndpoint:        conf.STSEndpoint,
+		STSRoleARN:         conf.STSRoleARN,
+		STSRoleSessionName: conf.STSRoleSessionName,
+		STSDuration:        conf.STSDuration.Duration,
+		Region:             conf.Region,
+		BucketLookup:       conf.BucketLookup,
+		UseSSL:             conf.UseSSL,
+		CACert:             conf.CACert,
+		SkipVerify:         conf.SkipVerify,
+	})
+}
@@ -0,0 +1,103 @@
+package filesystem
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"io/fs"
+)
+
+// BucketFs uses an own filesystem for some buckets, e.g. s3 mounts with other endpoints or credentials.
+// all other buckets are on the default filesystem
+type BucketFs struct {
+	def     FileSystem
+	buckets map[string]FileSystem
+}
+
+func NewBucketFs(def FileSystem, buckets map[string]FileSystem) *BucketFs {
+	return &BucketFs{def: def, buckets: buckets}
+}
+
+// get returns the filesystem of bucket
+func (bfs *BucketFs) get(bucket string) FileSystem {
+	if fs, ok := bfs.buckets[bucket]; ok {
+		return fs
+	}
+	return bfs.def
+}
+
+func (bfs *BucketFs) Protocol() string {
+	return bfs.def.Protocol()
+}
+
+func (bfs *BucketFs) String() string {
+	return bfs.def.String()
+}
+
+func (bfs *BucketFs) FolderExists(folder string) (bool, error) {
+	return bfs.get(folder).FolderExists(folder)
+}
+
+func (bfs *BucketFs) FolderCreate(folder string, opts FolderCreateOptions) error {
+	return bfs.get(folder).FolderCreate(folder, opts)
+}
+
+func (bfs *BucketFs) FileExists(folder, name string) (bool, error) {
+	return bfs.get(folder).FileExists(folder, name)
+}
+
+func (bfs *BucketFs) FileGet(folder, name string, opts FileGetOptions) ([]byte, error) {
+	return bfs.get(folder).FileGet(folder, name, opts)
+}
+
+func (bfs *BucketFs) FilePut(folder, name string, data []byte, opts FilePutOptions) error {
+	return bfs.get(folder).FilePut(folder, name, data, opts)
+}
+
+func (bfs *BucketFs) FileWrite(folder, name string, r io.Reader, size int64, opts FilePutOptions) error {
+	return bfs.get(folder).FileWrite(folder, name, r, size, opts)
+}
+
+func (bfs *BucketFs) FileRead(folder, name string, w io.Writer, size int64, opts FileGetOptions) error {
+	return bfs.get(folder).FileRead(folder, name, w, size, opts)
+}
+
+func (bfs *BucketFs) FileOpenRead(folder, name string, opts FileGetOptions) (io.ReadCloser, string, error) {
+	return bfs.get(folder).FileOpenRead(folder, name, opts)
+}
+
+func (bfs *BucketFs) FileStat(folder, name string, opts FileStatOptions) (fs.FileInfo, error) {
+	return bfs.get(folder).FileStat(folder, name, opts)
+}
+
+func (bfs *BucketFs) FileList(folder, name string) ([]fs.DirEntry, error) {
+	return bfs.get(folder).FileList(folder, name)
+}
+
+func (bfs *BucketFs) FileDelete(folder, name string, opts FileDeleteOptions) error {
+	return bfs.get(folder).FileDelete(folder, name, opts)
+}
+
+// sameFs returns the filesystem of both buckets, copies between filesystems are not supported
+func (bfs *BucketFs) sameFs(srcFolder, dstFolder string) (FileSystem, error) {
+	src := bfs.get(srcFolder)
+	if src != bfs.get(dstFolder) {
+		return nil, errors.Errorf("cannot copy between the filesystems of %s and %s", srcFolder, dstFolder)
+	}
+	return src, nil
+}
+
+func (bfs *BucketFs) FileCopy(srcFolder, srcName, dstFolder, dstName string, opts FileCopyOptions) error {
+	fs, err := bfs.sameFs(srcFolder, dstFolder)
+	if err != nil {
+		return err
+	}
+	return fs.FileCopy(srcFolder, srcName, dstFolder, dstName, opts)
+}
+
+func (bfs *BucketFs) FileMove(srcFolder, srcName, dstFolder, dstName string, opts FileCopyOptions) error {
+	fs, err := bfs.sameFs(srcFolder, dstFolder)
+	if err != nil {
+		return err
+	}
+	return fs.FileMove(srcFolder, srcName, dstFolder, dstName, opts)
+}
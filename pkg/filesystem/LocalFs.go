@@ -18,7 +18,7 @@ type LocalFs struct {
 
 func FileExists(filename string) bool {
 	info, err := os.Stat(filename)
-	if os.IsNotExist(err) {
+	if err != nil {
 		return false
 	}
 	return !info.IsDir()
@@ -88,6 +88,9 @@ func (lfs *LocalFs) FilePut(folder, name string, data []byte, opts FilePutOption
 		return errors.Wrapf(err, "cannot create folder %v", folder)
 	}
 	path := filepath.Join(lfs.basepath, filepath.Join(folder, name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return errors.Wrapf(err, "cannot create folder for %v", path)
+	}
 	lfs.logger.Debugf("writing data to: %v", path)
 	if err := ioutil.WriteFile(path, data, 0644); err != nil {
 		return errors.Wrapf(err, "cannot write data to %v", path)
@@ -100,6 +103,9 @@ func (lfs *LocalFs) FileWrite(folder, name string, r io.Reader, size int64, opts
 		return errors.Wrapf(err, "cannot create folder %v", folder)
 	}
 	path := filepath.Join(folder, name)
+	if err := os.MkdirAll(filepath.Dir(filepath.Join(lfs.basepath, path)), 0755); err != nil {
+		return errors.Wrapf(err, "cannot create folder for %v", path)
+	}
 	file, err := os.OpenFile(filepath.Join(lfs.basepath, path), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return errors.Wrapf(err, "cannot open file %v", path)
@@ -167,3 +173,85 @@ func (lfs *LocalFs) FileList(folder, name string) ([]fs.DirEntry, error) {
 	}
 	return list, nil
 }
+
+func (lfs *LocalFs) FileDelete(folder, name string, opts FileDeleteOptions) error {
+	path := filepath.Join(lfs.basepath, filepath.Join(folder, name))
+	lfs.logger.Debugf("delete %v", path)
+	if opts.Recursive {
+		if err := os.RemoveAll(path); err != nil {
+			return errors.Wrapf(err, "cannot remove %v", path)
+		}
+		return nil
+	}
+	if err := os.Remove(path); err != nil {
+		return errors.Wrapf(err, "cannot remove %v", path)
+	}
+	return nil
+}
+
+func (lfs *LocalFs) copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "cannot open %v", src)
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return errors.Wrapf(err, "cannot create folder for %v", dst)
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create %v", dst)
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return errors.Wrapf(err, "cannot copy %v to %v", src, dst)
+	}
+	if err := out.Close(); err != nil {
+		return errors.Wrapf(err, "cannot close %v", dst)
+	}
+	return nil
+}
+
+func (lfs *LocalFs) FileCopy(srcFolder, srcName, dstFolder, dstName string, opts FileCopyOptions) error {
+	src := filepath.Join(lfs.basepath, filepath.Join(srcFolder, srcName))
+	dst := filepath.Join(lfs.basepath, filepath.Join(dstFolder, dstName))
+	lfs.logger.Debugf("copy %v to %v", src, dst)
+	if !opts.Recursive {
+		return lfs.copyFile(src, dst)
+	}
+	if srcFolder == dstFolder && Overlaps(srcName, dstName) {
+		return errors.Errorf("cannot copy %v into itself: %v", src, dst)
+	}
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return errors.Wrapf(err, "cannot get relative path of %v", path)
+		}
+		return lfs.copyFile(path, filepath.Join(dst, rel))
+	})
+}
+
+func (lfs *LocalFs) FileMove(srcFolder, srcName, dstFolder, dstName string, opts FileCopyOptions) error {
+	src := filepath.Join(lfs.basepath, filepath.Join(srcFolder, srcName))
+	dst := filepath.Join(lfs.basepath, filepath.Join(dstFolder, dstName))
+	lfs.logger.Debugf("move %v to %v", src, dst)
+	if !opts.Recursive && FolderExists(src) {
+		return errors.Errorf("%v is a folder", src)
+	}
+	if srcFolder == dstFolder && Overlaps(srcName, dstName) {
+		return errors.Errorf("cannot move %v into itself: %v", src, dst)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return errors.Wrapf(err, "cannot create folder for %v", dst)
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return errors.Wrapf(err, "cannot rename %v to %v", src, dst)
+	}
+	return nil
+}
@@ -44,3 +44,11 @@ func (sfi *S3FileInfo) IsDir() bool { // abbreviation for Mode().IsDir()
 func (sfi *S3FileInfo) Sys() interface{} { // underlying data source (can return nil)
 	return nil
 }
+
+func (sfi *S3FileInfo) ETag() string { // etag of the object
+	return sfi.info.ETag
+}
+
+func (sfi *S3FileInfo) ContentType() string { // content type of the object
+	return sfi.info.ContentType
+}
@@ -3,6 +3,8 @@ package filesystem
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
@@ -19,15 +21,162 @@ type S3Fs struct {
 	endpoint string
 }
 
+// S3Options configures the connection and the credential chain of a S3 mount
+type S3Options struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	// Credentials is the ordered list of credential providers to try.
+	// valid entries: static, env, aws, minio, iam, sts
+	Credentials []string
+	// AWS shared credentials file and profile (empty: default locations)
+	AWSCredentialsFile string
+	AWSProfile         string
+	// MinIO client config file and alias (empty: default locations)
+	MinioConfigFile string
+	MinioAlias      string
+	// IAMEndpoint replaces the EC2 metadata service (e.g. a local stand-in)
+	IAMEndpoint string
+	// STS AssumeRole endpoint, uses AccessKeyId/SecretAccessKey as base credentials
+	STSEndpoint        string
+	STSRoleARN         string
+	STSRoleSessionName string
+	STSDuration        time.Duration
+	Region             string
+	// BucketLookup is one of auto, path, dns (virtual-host)
+	BucketLookup string
+	UseSSL       bool
+	// CACert is a PEM file with additional root certificates
+	CACert     string
+	SkipVerify bool
+}
+
+var defaultS3Credentials = []string{"static", "env", "aws", "minio", "iam"}
+
+func newS3Credentials(opts S3Options, client *http.Client) (*credentials.Credentials, error) {
+	chain := opts.Credentials
+	if len(chain) == 0 {
+		chain = defaultS3Credentials
+	}
+	var providers = []credentials.Provider{}
+	for _, c := range chain {
+		switch strings.ToLower(c) {
+		case "static":
+			if opts.AccessKeyId == "" {
+				continue
+			}
+			providers = append(providers, &credentials.Static{
+				Value: credentials.Value{
+					AccessKeyID:     opts.AccessKeyId,
+					SecretAccessKey: opts.SecretAccessKey,
+					SessionToken:    opts.SessionToken,
+					SignerType:      credentials.SignatureV4,
+				},
+			})
+		case "env":
+			providers = append(providers, &credentials.EnvAWS{}, &credentials.EnvMinio{})
+		case "aws":
+			providers = append(providers, &credentials.FileAWSCredentials{
+				Filename: opts.AWSCredentialsFile,
+				Profile:  opts.AWSProfile,
+			})
+		case "minio":
+			providers = append(providers, &credentials.FileMinioClient{
+				Filename: opts.MinioConfigFile,
+				Alias:    opts.MinioAlias,
+			})
+		case "iam":
+			providers = append(providers, &credentials.IAM{
+				Client:   client,
+				Endpoint: opts.IAMEndpoint,
+			})
+		case "sts":
+			if opts.STSEndpoint == "" {
+				return nil, errors.New("sts credentials need an sts endpoint")
+			}
+			if opts.AccessKeyId == "" || opts.SecretAccessKey == "" {
+				return nil, errors.New("sts credentials need accesskeyid and secretaccesskey")
+			}
+			providers = append(providers, &credentials.STSAssumeRole{
+				Client:      client,
+				STSEndpoint: opts.STSEndpoint,
+				Options: credentials.STSAssumeRoleOptions{
+					AccessKey:       opts.AccessKeyId,
+					SecretKey:       opts.SecretAccessKey,
+					Location:        opts.Region,
+					DurationSeconds: int(opts.STSDuration.Seconds()),
+					RoleARN:         opts.STSRoleARN,
+					RoleSessionName: opts.STSRoleSessionName,
+				},
+			})
+		default:
+			return nil, errors.Errorf("unknown credential provider %s", c)
+		}
+	}
+	if len(providers) == 0 {
+		return nil, errors.New("no credential provider configured")
+	}
+	return credentials.NewChainCredentials(providers), nil
+}
+
+func newS3Transport(opts S3Options) (*http.Transport, error) {
+	transport, err := minio.DefaultTransport(opts.UseSSL)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create transport")
+	}
+	if opts.CACert == "" && !opts.SkipVerify {
+		return transport, nil
+	}
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if opts.CACert != "" {
+		pem, err := os.ReadFile(opts.CACert)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read ca bundle %s", opts.CACert)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %s", opts.CACert)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig.InsecureSkipVerify = opts.SkipVerify
+	return transport, nil
+}
+
 func NewS3Fs(Endpoint string,
-	AccessKeyId string,
-	SecretAccessKey string,
 	Expiration time.Duration,
-	UseSSL bool) (*S3Fs, error) {
+	opts S3Options) (*S3Fs, error) {
+	transport, err := newS3Transport(opts)
+	if err != nil {
+		return nil, err
+	}
+	creds, err := newS3Credentials(opts, &http.Client{Transport: transport})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create s3 credentials")
+	}
+	var lookup minio.BucketLookupType
+	switch strings.ToLower(opts.BucketLookup) {
+	case "", "auto":
+		lookup = minio.BucketLookupAuto
+	case "path":
+		lookup = minio.BucketLookupPath
+	case "dns", "virtual", "virtualhost":
+		lookup = minio.BucketLookupDNS
+	default:
+		return nil, errors.Errorf("unknown bucket lookup %s", opts.BucketLookup)
+	}
 	// connect to S3 / Minio
 	s3, err := minio.New(Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(AccessKeyId, SecretAccessKey, ""),
-		Secure: UseSSL,
+		Creds:        creds,
+		Secure:       opts.UseSSL,
+		Transport:    transport,
+		Region:       opts.Region,
+		BucketLookup: lookup,
 	})
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot connect to s3 instance")
@@ -226,3 +375,111 @@ func (fs *S3Fs) FileOpenRead(folder, name string, opts FileGetOptions) (io.ReadC
 	}
 	return object, oinfo.ContentType, nil
 }
+
+// listRecursive returns all object keys below prefix/
+func (fs *S3Fs) listRecursive(ctx context.Context, folder, prefix string) ([]string, error) {
+	prefix = strings.TrimRight(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	var keys = []string{}
+	for object := range fs.s3.ListObjects(ctx, folder, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	}) {
+		if object.Err != nil {
+			return nil, errors.Wrapf(object.Err, "cannot list %v/%v", folder, prefix)
+		}
+		keys = append(keys, object.Key)
+	}
+	return keys, nil
+}
+
+func (fs *S3Fs) FileDelete(folder, name string, opts FileDeleteOptions) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if !opts.Recursive {
+		if err := fs.s3.RemoveObject(ctx, folder, name, minio.RemoveObjectOptions{}); err != nil {
+			return errors.Wrapf(err, "cannot remove %v/%v", folder, name)
+		}
+		return nil
+	}
+	keys, err := fs.listRecursive(ctx, folder, name)
+	if err != nil {
+		return err
+	}
+	return fs.removeKeys(ctx, folder, keys)
+}
+
+// removeKeys removes the objects with the given keys
+func (fs *S3Fs) removeKeys(ctx context.Context, folder string, keys []string) error {
+	objectsCh := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(objectsCh)
+		for _, key := range keys {
+			select {
+			case objectsCh <- minio.ObjectInfo{Key: key}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for rErr := range fs.s3.RemoveObjects(ctx, folder, objectsCh, minio.RemoveObjectsOptions{}) {
+		return errors.Wrapf(rErr.Err, "cannot remove %v/%v", folder, rErr.ObjectName)
+	}
+	return nil
+}
+
+func (fs *S3Fs) FileCopy(srcFolder, srcName, dstFolder, dstName string, opts FileCopyOptions) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := fs.copy(ctx, srcFolder, srcName, dstFolder, dstName, opts)
+	return err
+}
+
+// copy copies the objects and returns the keys of the copied sources
+func (fs *S3Fs) copy(ctx context.Context, srcFolder, srcName, dstFolder, dstName string, opts FileCopyOptions) ([]string, error) {
+	if opts.Recursive && srcFolder == dstFolder && Overlaps(srcName, dstName) {
+		return nil, errors.Errorf("cannot copy %v/%v into itself: %v", srcFolder, srcName, dstName)
+	}
+	var pairs = [][2]string{}
+	if opts.Recursive {
+		keys, err := fs.listRecursive(ctx, srcFolder, srcName)
+		if err != nil {
+			return nil, err
+		}
+		srcPrefix := strings.TrimRight(srcName, "/")
+		dstPrefix := strings.TrimRight(dstName, "/")
+		for _, key := range keys {
+			pairs = append(pairs, [2]string{key, strings.TrimLeft(dstPrefix+strings.TrimPrefix(key, srcPrefix), "/")})
+		}
+	} else {
+		pairs = append(pairs, [2]string{srcName, dstName})
+	}
+	var copied = []string{}
+	for _, pair := range pairs {
+		// server side copy
+		if _, err := fs.s3.CopyObject(ctx,
+			minio.CopyDestOptions{Bucket: dstFolder, Object: pair[1]},
+			minio.CopySrcOptions{Bucket: srcFolder, Object: pair[0]},
+		); err != nil {
+			return copied, errors.Wrapf(err, "cannot copy %v/%v to %v/%v", srcFolder, pair[0], dstFolder, pair[1])
+		}
+		copied = append(copied, pair[0])
+	}
+	return copied, nil
+}
+
+func (fs *S3Fs) FileMove(srcFolder, srcName, dstFolder, dstName string, opts FileCopyOptions) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// s3 has no rename. only the copied objects are removed, not the ones which appeared below the source meanwhile
+	copied, err := fs.copy(ctx, srcFolder, srcName, dstFolder, dstName, opts)
+	if err != nil {
+		return err
+	}
+	if err := fs.removeKeys(ctx, srcFolder, copied); err != nil {
+		return errors.Wrapf(err, "cannot remove source %v/%v after copy", srcFolder, srcName)
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"strings"
 )
 
 type NotFoundError struct {
@@ -37,6 +38,24 @@ type FolderCreateOptions struct {
 	ObjectLocking bool
 }
 
+// FileDeleteOptions Recursive removes all objects below name/
+type FileDeleteOptions struct {
+	Recursive bool
+}
+
+// FileCopyOptions Recursive copies or moves all objects below name/
+type FileCopyOptions struct {
+	Recursive bool
+}
+
+// Overlaps checks whether the keys are equal or one of them lies below the other.
+// a recursive copy or move between overlapping keys would read its own output
+func Overlaps(a, b string) bool {
+	a = strings.Trim(a, "/") + "/"
+	b = strings.Trim(b, "/") + "/"
+	return a == "/" || b == "/" || strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
 type FileSystem interface {
 	FolderExists(folder string) (bool, error)
 	FolderCreate(folder string, opts FolderCreateOptions) error
@@ -48,6 +67,9 @@ type FileSystem interface {
 	FileOpenRead(folder, name string, opts FileGetOptions) (io.ReadCloser, string, error)
 	FileStat(folder, name string, opts FileStatOptions) (fs.FileInfo, error)
 	FileList(folder, name string) ([]fs.DirEntry, error)
+	FileDelete(folder, name string, opts FileDeleteOptions) error
+	FileCopy(srcFolder, srcName, dstFolder, dstName string, opts FileCopyOptions) error
+	FileMove(srcFolder, srcName, dstFolder, dstName string, opts FileCopyOptions) error
 	String() string
 	Protocol() string
 }
@@ -0,0 +1,91 @@
+package filesystem
+
+import (
+	logging "github.com/op/go-logging"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOverlaps(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		overlaps bool
+	}{
+		{"a", "a", true},
+		{"a/", "a", true},
+		{"a", "a/sub", true},
+		{"a/sub", "a", true},
+		{"/a/sub/", "a/sub/deeper", true},
+		{"a", "", true},
+		// s3 keys are prefixes of other keys without being folders of them
+		{"a", "ab", false},
+		{"ab", "a", false},
+		{"a/sub", "a/subfolder", false},
+		{"a/sub", "b/sub", false},
+	}
+	for _, test := range tests {
+		if got := Overlaps(test.a, test.b); got != test.overlaps {
+			t.Errorf("Overlaps(%q, %q) is %v", test.a, test.b, got)
+		}
+	}
+}
+
+func TestLocalFsMoveIntoItself(t *testing.T) {
+	base := t.TempDir()
+	src := filepath.Join(base, "bucket", "a", "x.txt")
+	if err := os.MkdirAll(filepath.Dir(src), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(src, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lfs, err := NewLocalFs(base, logging.MustGetLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := FileCopyOptions{Recursive: true}
+	if err := lfs.FileMove("bucket", "a", "bucket", "a/sub", opts); err == nil {
+		t.Errorf("move into a subfolder accepted")
+	}
+	if err := lfs.FileCopy("bucket", "a", "bucket", "a/sub", opts); err == nil {
+		t.Errorf("copy into a subfolder accepted")
+	}
+	if err := lfs.FileMove("bucket", "a", "bucket", "ab", opts); err != nil {
+		t.Errorf("move to a sibling rejected: %v", err)
+	}
+	if !FileExists(filepath.Join(base, "bucket", "ab", "x.txt")) {
+		t.Errorf("file not moved")
+	}
+}
+
+func TestBucketFs(t *testing.T) {
+	logger := logging.MustGetLogger("test")
+	defBase, otherBase := t.TempDir(), t.TempDir()
+	for _, dir := range []string{filepath.Join(defBase, "a"), filepath.Join(otherBase, "b")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	def, err := NewLocalFs(defBase, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewLocalFs(otherBase, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bfs := NewBucketFs(def, map[string]FileSystem{"b": other})
+	if err := bfs.FilePut("a", "x.txt", []byte("x"), FilePutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bfs.FilePut("b", "y.txt", []byte("y"), FilePutOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !FileExists(filepath.Join(defBase, "a", "x.txt")) || !FileExists(filepath.Join(otherBase, "b", "y.txt")) {
+		t.Errorf("files not written to the filesystem of their bucket")
+	}
+	if err := bfs.FileCopy("a", "x.txt", "b", "x.txt", FileCopyOptions{}); err == nil {
+		t.Errorf("copy between filesystems accepted")
+	}
+}
@@ -0,0 +1,157 @@
+package media
+
+import (
+	"github.com/pkg/errors"
+	"gopkg.in/gographics/imagick.v3/imagick"
+)
+
+// ContactSheetCell is one image of a contact sheet with its caption
+type ContactSheetCell struct {
+	Image   []byte
+	Caption string
+}
+
+// ContactSheetOptions defines the layout of a contact sheet
+type ContactSheetOptions struct {
+	Columns               int
+	CellWidth, CellHeight int64
+	Margin                int64
+	// FontSize of the caption, no caption if 0
+	FontSize        float64
+	BackgroundColor string
+	TargetFormat    string
+}
+
+const (
+	// maxContactSheetSize is the maximum width and height of a sheet, jpeg allows at most 65535
+	maxContactSheetSize = 65000
+	// maxContactSheetPixels is the maximum area of a sheet
+	maxContactSheetPixels = 100000000
+)
+
+func (opts ContactSheetOptions) captionHeight() int64 {
+	if opts.FontSize <= 0 {
+		return 0
+	}
+	return int64(opts.FontSize * 1.5)
+}
+
+// width returns the width of a sheet with all columns
+func (opts ContactSheetOptions) width() int64 {
+	columns := int64(opts.Columns)
+	if columns < 1 {
+		columns = 1
+	}
+	return columns*(opts.CellWidth+opts.Margin) + opts.Margin
+}
+
+// MaxRows returns the number of rows, which fit into the maximum height and area of a sheet
+func (opts ContactSheetOptions) MaxRows() int64 {
+	height := int64(maxContactSheetPixels) / opts.width()
+	if height > maxContactSheetSize {
+		height = maxContactSheetSize
+	}
+	rows := (height - opts.Margin) / (opts.CellHeight + opts.captionHeight() + opts.Margin)
+	if rows < 1 {
+		return 1
+	}
+	return rows
+}
+
+// ContactSheetV3 renders the cells as grid into one image
+func ContactSheetV3(cells []ContactSheetCell, opts ContactSheetOptions) ([]byte, *CoreMeta, error) {
+	if len(cells) == 0 {
+		return nil, nil, errors.New("no images for contact sheet")
+	}
+	if opts.Columns < 1 {
+		opts.Columns = 1
+	}
+	if opts.BackgroundColor == "" {
+		opts.BackgroundColor = "white"
+	}
+	captionHeight := opts.captionHeight()
+	columns := opts.Columns
+	if len(cells) < columns {
+		columns = len(cells)
+	}
+	rows := (len(cells) + opts.Columns - 1) / opts.Columns
+	width := int64(columns)*(opts.CellWidth+opts.Margin) + opts.Margin
+	height := int64(rows)*(opts.CellHeight+captionHeight+opts.Margin) + opts.Margin
+	if width > maxContactSheetSize || height > maxContactSheetSize || width*height > maxContactSheetPixels {
+		return nil, nil, errors.Errorf("contact sheet %vx%v too large, maximum is %v pixels and %v per side", width, height, maxContactSheetPixels, maxContactSheetSize)
+	}
+
+	bg := imagick.NewPixelWand()
+	defer bg.Destroy()
+	bg.SetColor(opts.BackgroundColor)
+	sheet := imagick.NewMagickWand()
+	defer sheet.Destroy()
+	if err := sheet.NewImage(uint(width), uint(height), bg); err != nil {
+		return nil, nil, errors.Wrapf(err, "cannot create contact sheet %vx%v", width, height)
+	}
+
+	dw := imagick.NewDrawingWand()
+	defer dw.Destroy()
+	fg := imagick.NewPixelWand()
+	defer fg.Destroy()
+	fg.SetColor("black")
+	if captionHeight > 0 {
+		dw.SetFillColor(fg)
+		dw.SetFontSize(opts.FontSize)
+		dw.SetTextAntialias(true)
+		dw.SetGravity(imagick.GRAVITY_NORTH_WEST)
+	}
+	// rough estimation of the caption length, which fits into a cell
+	maxChars := int(float64(opts.CellWidth) / (opts.FontSize * 0.6))
+
+	for i, cell := range cells {
+		x := opts.Margin + int64(i%opts.Columns)*(opts.CellWidth+opts.Margin)
+		y := opts.Margin + int64(i/opts.Columns)*(opts.CellHeight+captionHeight+opts.Margin)
+		if err := contactSheetCell(sheet, cell.Image, x, y, opts); err != nil {
+			return nil, nil, errors.Wrapf(err, "cannot add %s to contact sheet", cell.Caption)
+		}
+		if captionHeight > 0 && cell.Caption != "" {
+			caption := []rune(cell.Caption)
+			if maxChars > 3 && len(caption) > maxChars {
+				caption = append([]rune("..."), caption[len(caption)-maxChars+3:]...)
+			}
+			if err := sheet.AnnotateImage(dw, float64(x), float64(y+opts.CellHeight)+opts.FontSize*0.2, 0, string(caption)); err != nil {
+				return nil, nil, errors.Wrapf(err, "cannot write caption %s", cell.Caption)
+			}
+		}
+	}
+
+	if err := sheet.SetImageFormat(opts.TargetFormat); err != nil {
+		return nil, nil, errors.Wrapf(err, "cannot set format %s", opts.TargetFormat)
+	}
+	data := sheet.GetImageBlob()
+	cm := &CoreMeta{
+		Width:    width,
+		Height:   height,
+		Format:   sheet.GetImageFormat(),
+		Mimetype: "application/octet-stream",
+		Size:     int64(len(data)),
+	}
+	return data, cm, nil
+}
+
+func contactSheetCell(sheet *imagick.MagickWand, data []byte, x, y int64, opts ContactSheetOptions) error {
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+	if err := pinFormatV3(mw, data); err != nil {
+		return err
+	}
+	if err := mw.ReadImageBlob(data); err != nil {
+		return errors.Wrap(err, "cannot read image from blob")
+	}
+	nw, nh := CalcSizeMin(int64(mw.GetImageWidth()), int64(mw.GetImageHeight()), opts.CellWidth, opts.CellHeight)
+	if err := mw.ResizeImage(uint(nw), uint(nh), imagick.FILTER_LANCZOS); err != nil {
+		return errors.Wrapf(err, "cannot resizeimage(%v, %v)", uint(nw), uint(nh))
+	}
+	cx := int(x + (opts.CellWidth-nw)/2)
+	cy := int(y + (opts.CellHeight-nh)/2)
+	if err := sheet.CompositeImage(mw, imagick.COMPOSITE_OP_OVER, true, cx, cy); err != nil {
+		return errors.Wrapf(err, "cannot composite image at %v, %v", cx, cy)
+	}
+	return nil
+}
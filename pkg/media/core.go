@@ -1,5 +1,7 @@
 package media
 
+import "time"
+
 type CoreMeta struct {
 	Width    int64
 	Height   int64
@@ -7,4 +9,6 @@ type CoreMeta struct {
 	Mimetype string
 	Format   string
 	Size     int64
+	// CaptureDate is the exif creation date of images (zero if unknown)
+	CaptureDate time.Time
 }
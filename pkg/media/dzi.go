@@ -0,0 +1,150 @@
+package media
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"gopkg.in/gographics/imagick.v3/imagick"
+	"io"
+	"math"
+)
+
+// DZIMaxLevel returns the level of the full resolution image
+func DZIMaxLevel(width, height int64) int {
+	max := width
+	if height > max {
+		max = height
+	}
+	if max <= 1 {
+		return 0
+	}
+	return int(math.Ceil(math.Log2(float64(max))))
+}
+
+// DZILevelSize returns the image size at level
+func DZILevelSize(width, height int64, level, maxLevel int) (int64, int64) {
+	scale := math.Pow(2, float64(level-maxLevel))
+	w := int64(math.Ceil(float64(width) * scale))
+	h := int64(math.Ceil(float64(height) * scale))
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
+
+// DZIRegion is a block of tiles of one level
+type DZIRegion struct {
+	Col, Row   int
+	Cols, Rows int
+}
+
+// DZITilesV3 cuts the tiles of region at one deep zoom level and hands them to fn.
+// only the part of the master below the region is resized, so the size of the level does not matter
+func DZITilesV3(reader io.Reader, level, tileSize, overlap int, format string, region DZIRegion, fn func(col, row int, data []byte) error) error {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(reader); err != nil {
+		return errors.Wrapf(err, "cannot read raw image blob")
+	}
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+	if err := readImageBlobV3(mw, buf.Bytes()); err != nil {
+		return err
+	}
+	buf.Reset()
+	if err := mw.AutoOrientImage(); err != nil {
+		return errors.Wrapf(err, "cannot auto orient image")
+	}
+	width, height := int64(mw.GetImageWidth()), int64(mw.GetImageHeight())
+	maxLevel := DZIMaxLevel(width, height)
+	if level < 0 || level > maxLevel {
+		return errors.Errorf("invalid level %d [0..%d]", level, maxLevel)
+	}
+	lw, lh := DZILevelSize(width, height, level, maxLevel)
+	cols := int((lw + int64(tileSize) - 1) / int64(tileSize))
+	rows := int((lh + int64(tileSize) - 1) / int64(tileSize))
+	if region.Col < 0 || region.Row < 0 || region.Col >= cols || region.Row >= rows {
+		return errors.Errorf("no tile %d_%d at level %d", region.Col, region.Row, level)
+	}
+	lastCol := region.Col + region.Cols
+	if lastCol > cols {
+		lastCol = cols
+	}
+	lastRow := region.Row + region.Rows
+	if lastRow > rows {
+		lastRow = rows
+	}
+
+	// the block with the overlap of the outer tiles in level coordinates
+	bx0, by0 := tileOrigin(region.Col, tileSize, overlap), tileOrigin(region.Row, tileSize, overlap)
+	bx1, by1 := tileEnd(lastCol-1, tileSize, overlap, lw), tileEnd(lastRow-1, tileSize, overlap, lh)
+	// and in master coordinates
+	sx, sy := float64(width)/float64(lw), float64(height)/float64(lh)
+	mx0, my0 := int64(math.Floor(float64(bx0)*sx)), int64(math.Floor(float64(by0)*sy))
+	mx1, my1 := int64(math.Ceil(float64(bx1)*sx)), int64(math.Ceil(float64(by1)*sy))
+	if mx1 > width {
+		mx1 = width
+	}
+	if my1 > height {
+		my1 = height
+	}
+	if mx0 != 0 || my0 != 0 || mx1 != width || my1 != height {
+		if err := mw.CropImage(uint(mx1-mx0), uint(my1-my0), int(mx0), int(my0)); err != nil {
+			return errors.Wrapf(err, "cannot cropimage(%v, %v, %v, %v)", mx1-mx0, my1-my0, mx0, my0)
+		}
+		if err := mw.SetImagePage(uint(mx1-mx0), uint(my1-my0), 0, 0); err != nil {
+			return errors.Wrap(err, "cannot reset page")
+		}
+	}
+	if bw, bh := bx1-bx0, by1-by0; bw != mx1-mx0 || bh != my1-my0 {
+		if err := mw.ResizeImage(uint(bw), uint(bh), imagick.FILTER_LANCZOS); err != nil {
+			return errors.Wrapf(err, "cannot resizeimage(%v, %v)", bw, bh)
+		}
+	}
+
+	for row := region.Row; row < lastRow; row++ {
+		for col := region.Col; col < lastCol; col++ {
+			x := tileOrigin(col, tileSize, overlap)
+			y := tileOrigin(row, tileSize, overlap)
+			w := tileEnd(col, tileSize, overlap, lw) - x
+			h := tileEnd(row, tileSize, overlap, lh) - y
+			tile := mw.Clone()
+			if err := tile.CropImage(uint(w), uint(h), int(x-bx0), int(y-by0)); err != nil {
+				tile.Destroy()
+				return errors.Wrapf(err, "cannot cropimage(%v, %v, %v, %v)", w, h, x-bx0, y-by0)
+			}
+			if err := tile.SetImagePage(uint(w), uint(h), 0, 0); err != nil {
+				tile.Destroy()
+				return errors.Wrap(err, "cannot reset page")
+			}
+			if err := tile.SetImageFormat(format); err != nil {
+				tile.Destroy()
+				return errors.Wrapf(err, "cannot set format %s", format)
+			}
+			data := tile.GetImageBlob()
+			tile.Destroy()
+			if err := fn(col, row, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tileOrigin is the left or upper edge of tile i including the overlap
+func tileOrigin(i, tileSize, overlap int) int64 {
+	if i == 0 {
+		return 0
+	}
+	return int64(i*tileSize - overlap)
+}
+
+// tileEnd is the right or lower edge of tile i including the overlap
+func tileEnd(i, tileSize, overlap int, size int64) int64 {
+	end := int64((i+1)*tileSize + overlap)
+	if end > size {
+		return size
+	}
+	return end
+}
@@ -6,6 +6,8 @@ import (
 	"gopkg.in/gographics/imagick.v3/imagick"
 	"io"
 	"math"
+	"strings"
+	"time"
 )
 
 type ImageMagickV3 struct {
@@ -21,6 +23,41 @@ func NewImageMagickV3(reader io.Reader) (*ImageMagickV3, error) {
 	return im, nil
 }
 
+// IdentifyV3 reads the technical metadata of an image without decoding the pixels
+func IdentifyV3(reader io.Reader) (*CoreMeta, error) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(reader); err != nil {
+		return nil, errors.Wrapf(err, "cannot read raw image blob")
+	}
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+	if err := pinFormatV3(mw, buf.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := mw.PingImageBlob(buf.Bytes()); err != nil {
+		return nil, errors.Wrapf(err, "cannot ping image from blob")
+	}
+	cm := &CoreMeta{
+		Width:    int64(mw.GetImageWidth()),
+		Height:   int64(mw.GetImageHeight()),
+		Duration: 0,
+		Format:   mw.GetImageFormat(),
+		Mimetype: "application/octet-stream",
+		Size:     int64(buf.Len()),
+	}
+	if dt := mw.GetImageProperty("exif:DateTimeOriginal"); dt != "" {
+		if t, err := time.ParseInLocation("2006:01:02 15:04:05", strings.TrimSpace(dt), time.Local); err == nil {
+			cm.CaptureDate = t
+		}
+	}
+	// dimensions after auto orientation
+	switch mw.GetImageOrientation() {
+	case imagick.ORIENTATION_LEFT_TOP, imagick.ORIENTATION_RIGHT_TOP, imagick.ORIENTATION_RIGHT_BOTTOM, imagick.ORIENTATION_LEFT_BOTTOM:
+		cm.Width, cm.Height = cm.Height, cm.Width
+	}
+	return cm, nil
+}
+
 func (im *ImageMagickV3) Close() {
 	im.mw.Destroy()
 }
@@ -30,10 +67,7 @@ func (im *ImageMagickV3) LoadImage(reader io.Reader) error {
 	if _, err := buf.ReadFrom(reader); err != nil {
 		return errors.Wrapf(err, "cannot read raw image blob")
 	}
-	if err := im.mw.ReadImageBlob(buf.Bytes()); err != nil {
-		return errors.Wrapf(err, "cannot read image from blob")
-	}
-	return nil
+	return readImageBlobV3(im.mw, buf.Bytes())
 }
 
 func (im *ImageMagickV3) StoreImage(format string) (io.ReadCloser, *CoreMeta, error) {
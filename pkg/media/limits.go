@@ -0,0 +1,166 @@
+package media
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"gopkg.in/gographics/imagick.v3/imagick"
+	"sync"
+	"time"
+)
+
+// ErrImageTooLarge is returned for images, which exceed the dimension limits
+var ErrImageTooLarge = errors.New("image exceeds the size limits")
+
+// MagickLimits restricts the resources of imagemagick. zero values keep the imagemagick defaults
+type MagickLimits struct {
+	// Width, Height and Pixels are checked before an image is decoded
+	Width, Height, Pixels int64
+	// Area is the maximum pixel cache in memory, Memory, Map and Disk are bytes
+	Area, Memory, Map, Disk int64
+	// Time is the maximum elapsed time of one operation
+	Time    time.Duration
+	Threads int
+}
+
+var dimensionLimits struct {
+	sync.RWMutex
+	width, height, pixels int64
+}
+
+// SetResourceLimitsV3 sets the resource limits of imagemagick for the whole process
+func SetResourceLimitsV3(l MagickLimits) error {
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+	for _, rl := range []struct {
+		rtype imagick.ResourceType
+		name  string
+		limit int64
+	}{
+		{imagick.RESOURCE_AREA, "area", l.Area},
+		{imagick.RESOURCE_MEMORY, "memory", l.Memory},
+		{imagick.RESOURCE_MAP, "map", l.Map},
+		{imagick.RESOURCE_DISK, "disk", l.Disk},
+		{imagick.RESOURCE_TIME, "time", int64(l.Time / time.Second)},
+		{imagick.RESOURCE_THREAD, "thread", int64(l.Threads)},
+	} {
+		if rl.limit <= 0 {
+			continue
+		}
+		if err := mw.SetResourceLimit(rl.rtype, rl.limit); err != nil {
+			return errors.Wrapf(err, "cannot set %s limit %d", rl.name, rl.limit)
+		}
+	}
+	dimensionLimits.Lock()
+	dimensionLimits.width, dimensionLimits.height, dimensionLimits.pixels = l.Width, l.Height, l.Pixels
+	dimensionLimits.Unlock()
+	return nil
+}
+
+// checkDimensionsV3 reads the size from the header of the image blob and compares it with the limits
+func checkDimensionsV3(data []byte) error {
+	dimensionLimits.RLock()
+	maxWidth, maxHeight, maxPixels := dimensionLimits.width, dimensionLimits.height, dimensionLimits.pixels
+	dimensionLimits.RUnlock()
+	if maxWidth <= 0 && maxHeight <= 0 && maxPixels <= 0 {
+		return nil
+	}
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+	if err := pinFormatV3(mw, data); err != nil {
+		return err
+	}
+	if err := mw.PingImageBlob(data); err != nil {
+		return errors.Wrapf(err, "cannot ping image from blob")
+	}
+	var pixels int64
+	mw.ResetIterator()
+	for mw.NextImage() {
+		width, height := int64(mw.GetImageWidth()), int64(mw.GetImageHeight())
+		if (maxWidth > 0 && width > maxWidth) || (maxHeight > 0 && height > maxHeight) {
+			return errors.Wrapf(ErrImageTooLarge, "%dx%d", width, height)
+		}
+		pixels += width * height
+	}
+	if maxPixels > 0 && pixels > maxPixels {
+		return errors.Wrapf(ErrImageTooLarge, "%d pixels", pixels)
+	}
+	return nil
+}
+
+// pinFormatV3 sets the decoder of the magic bytes, imagemagick must not guess another coder
+func pinFormatV3(mw *imagick.MagickWand, data []byte) error {
+	format := DetectFormat(data)
+	if format == "" {
+		return errors.New("unknown image format")
+	}
+	// the jpeg 2000 codestream without jp2 container has its own coder
+	if format == "JP2" && data[0] == 0xff {
+		format = "J2K"
+	}
+	if err := mw.SetFormat(format); err != nil {
+		return errors.Wrapf(err, "cannot set format %s", format)
+	}
+	// the prefix makes the format explicit, also for coders which check the magic bytes
+	if err := mw.SetFilename(format + ":"); err != nil {
+		return errors.Wrapf(err, "cannot set filename %s:", format)
+	}
+	return nil
+}
+
+// readImageBlobV3 checks the limits and decodes the image blob into mw with the coder of its magic bytes
+func readImageBlobV3(mw *imagick.MagickWand, data []byte) error {
+	if err := checkDimensionsV3(data); err != nil {
+		return err
+	}
+	if err := pinFormatV3(mw, data); err != nil {
+		return err
+	}
+	if err := mw.ReadImageBlob(data); err != nil {
+		return errors.Wrapf(err, "cannot read image from blob")
+	}
+	return nil
+}
+
+// magic are the signatures of the image formats
+var magic = []struct {
+	format string
+	offset int
+	sig    []byte
+}{
+	{"JPEG", 0, []byte{0xff, 0xd8, 0xff}},
+	{"PNG", 0, []byte("\x89PNG\r\n\x1a\n")},
+	{"GIF", 0, []byte("GIF87a")},
+	{"GIF", 0, []byte("GIF89a")},
+	{"TIFF", 0, []byte("II*\x00")},
+	{"TIFF", 0, []byte("MM\x00*")},
+	{"TIFF", 0, []byte("II+\x00")},
+	{"TIFF", 0, []byte("MM\x00+")},
+	{"WEBP", 8, []byte("WEBP")},
+	{"BMP", 0, []byte("BM")},
+	{"JP2", 0, []byte("\x00\x00\x00\x0cjP  \r\n\x87\n")},
+	{"JP2", 0, []byte{0xff, 0x4f, 0xff, 0x51}},
+	{"HEIC", 4, []byte("ftypheic")},
+	{"HEIC", 4, []byte("ftypheix")},
+	{"HEIC", 4, []byte("ftypmif1")},
+	{"AVIF", 4, []byte("ftypavif")},
+	{"PSD", 0, []byte("8BPS")},
+	{"PDF", 0, []byte("%PDF-")},
+	{"PS", 0, []byte("%!PS")},
+	{"SVG", 0, []byte("<svg")},
+	{"SVG", 0, []byte("<?xml")},
+}
+
+// DetectFormat returns the image format of the magic bytes at the start of data or an empty string
+func DetectFormat(data []byte) string {
+	for _, m := range magic {
+		if len(data) < m.offset+len(m.sig) || !bytes.Equal(data[m.offset:m.offset+len(m.sig)], m.sig) {
+			continue
+		}
+		// webp is a riff container, other riff files (avi, wav) have another type at offset 8
+		if m.format == "WEBP" && !bytes.HasPrefix(data, []byte("RIFF")) {
+			continue
+		}
+		return m.format
+	}
+	return ""
+}
@@ -0,0 +1,166 @@
+package media
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pkg/errors"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"time"
+	"unicode/utf16"
+)
+
+// PDFWriter writes a pdf with one page per jpeg image.
+// pages are streamed to the writer, the page tree is written on Close
+type PDFWriter struct {
+	w       io.Writer
+	pos     int64
+	offsets []int64
+	pages   []int
+	title   string
+	dpi     float64
+}
+
+type pdfCounter struct {
+	pw *PDFWriter
+}
+
+func (pc pdfCounter) Write(p []byte) (int, error) {
+	n, err := pc.pw.w.Write(p)
+	pc.pw.pos += int64(n)
+	return n, err
+}
+
+// NewPDFWriter starts a new pdf. dpi defines the page size of the images (72 dpi: one pixel per point)
+func NewPDFWriter(w io.Writer, title string, dpi float64) (*PDFWriter, error) {
+	if dpi <= 0 {
+		dpi = 72
+	}
+	// object 0 is unused, 1 is the catalog, 2 the page tree
+	pw := &PDFWriter{w: w, offsets: []int64{0, 0, 0}, title: title, dpi: dpi}
+	if _, err := io.WriteString(pdfCounter{pw}, "%PDF-1.4\n%\xe2\xe3\xcf\xd3\n"); err != nil {
+		return nil, errors.Wrap(err, "cannot write pdf header")
+	}
+	return pw, nil
+}
+
+func (pw *PDFWriter) newObject() int {
+	pw.offsets = append(pw.offsets, 0)
+	return len(pw.offsets) - 1
+}
+
+func (pw *PDFWriter) writeObject(id int, dict string, stream []byte) error {
+	pw.offsets[id] = pw.pos
+	out := pdfCounter{pw}
+	if _, err := fmt.Fprintf(out, "%d 0 obj\n%s\n", id, dict); err != nil {
+		return errors.Wrapf(err, "cannot write object %d", id)
+	}
+	if stream != nil {
+		if _, err := io.WriteString(out, "stream\n"); err != nil {
+			return errors.Wrapf(err, "cannot write object %d", id)
+		}
+		if _, err := out.Write(stream); err != nil {
+			return errors.Wrapf(err, "cannot write stream of object %d", id)
+		}
+		if _, err := io.WriteString(out, "\nendstream\n"); err != nil {
+			return errors.Wrapf(err, "cannot write object %d", id)
+		}
+	}
+	if _, err := io.WriteString(out, "endobj\n"); err != nil {
+		return errors.Wrapf(err, "cannot write object %d", id)
+	}
+	return nil
+}
+
+// AddJPEG adds a page with the jpeg image
+func (pw *PDFWriter) AddJPEG(data []byte) error {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "cannot decode jpeg header")
+	}
+	var colorSpace, decode string
+	switch cfg.ColorModel {
+	case color.GrayModel:
+		colorSpace = "/DeviceGray"
+	case color.CMYKModel:
+		// adobe writes inverted cmyk jpegs
+		colorSpace = "/DeviceCMYK"
+		decode = " /Decode [1 0 1 0 1 0 1 0]"
+	default:
+		colorSpace = "/DeviceRGB"
+	}
+	width := float64(cfg.Width) * 72 / pw.dpi
+	height := float64(cfg.Height) * 72 / pw.dpi
+
+	imageID := pw.newObject()
+	if err := pw.writeObject(imageID, fmt.Sprintf(
+		"<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8 /Filter /DCTDecode%s /Length %d >>",
+		cfg.Width, cfg.Height, colorSpace, decode, len(data)), data); err != nil {
+		return err
+	}
+	content := []byte(fmt.Sprintf("q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q", width, height))
+	contentID := pw.newObject()
+	if err := pw.writeObject(contentID, fmt.Sprintf("<< /Length %d >>", len(content)), content); err != nil {
+		return err
+	}
+	pageID := pw.newObject()
+	if err := pw.writeObject(pageID, fmt.Sprintf(
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>",
+		width, height, imageID, contentID), nil); err != nil {
+		return err
+	}
+	pw.pages = append(pw.pages, pageID)
+	return nil
+}
+
+// pdfString encodes s as utf-16be pdf text string
+func pdfString(s string) string {
+	buf := bytes.NewBufferString("<FEFF")
+	for _, c := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(buf, "%04X", c)
+	}
+	buf.WriteString(">")
+	return buf.String()
+}
+
+// Close writes page tree, catalog, document info and cross reference table
+func (pw *PDFWriter) Close() error {
+	if len(pw.pages) == 0 {
+		return errors.New("pdf has no pages")
+	}
+	kids := bytes.NewBuffer(nil)
+	for _, id := range pw.pages {
+		fmt.Fprintf(kids, "%d 0 R ", id)
+	}
+	if err := pw.writeObject(2, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", kids.String(), len(pw.pages)), nil); err != nil {
+		return err
+	}
+	if err := pw.writeObject(1, "<< /Type /Catalog /Pages 2 0 R >>", nil); err != nil {
+		return err
+	}
+	infoID := pw.newObject()
+	info := fmt.Sprintf("<< /Producer %s /CreationDate (D:%s)", pdfString("s3image"), time.Now().UTC().Format("20060102150405Z"))
+	if pw.title != "" {
+		info += " /Title " + pdfString(pw.title)
+	}
+	info += " >>"
+	if err := pw.writeObject(infoID, info, nil); err != nil {
+		return err
+	}
+
+	xref := pw.pos
+	out := pdfCounter{pw}
+	if _, err := fmt.Fprintf(out, "xref\n0 %d\n0000000000 65535 f \n", len(pw.offsets)); err != nil {
+		return errors.Wrap(err, "cannot write xref")
+	}
+	for _, offset := range pw.offsets[1:] {
+		if _, err := fmt.Fprintf(out, "%010d 00000 n \n", offset); err != nil {
+			return errors.Wrap(err, "cannot write xref")
+		}
+	}
+	if _, err := fmt.Fprintf(out, "trailer\n<< /Size %d /Root 1 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(pw.offsets), infoID, xref); err != nil {
+		return errors.Wrap(err, "cannot write trailer")
+	}
+	return nil
+}
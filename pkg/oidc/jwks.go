@@ -0,0 +1,230 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWK is a json web key with the public rsa and ec parameters
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is a json web key set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func b64Int(str string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// PublicKey returns the rsa or ecdsa key
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64Int(k.N)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid modulus of key %s", k.Kid)
+		}
+		e, err := b64Int(k.E)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid exponent of key %s", k.Kid)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported curve %s of key %s", k.Crv, k.Kid)
+		}
+		x, err := b64Int(k.X)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid x of key %s", k.Kid)
+		}
+		y, err := b64Int(k.Y)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid y of key %s", k.Kid)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.Errorf("unsupported key type %s of key %s", k.Kty, k.Kid)
+}
+
+// NewRSAJWK returns the public jwk of an rsa key
+func NewRSAJWK(kid string, pub *rsa.PublicKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+// keySetRefresh is the minimum time between two loads of a key set
+const keySetRefresh = time.Minute
+
+// keySetTimeout limits a load of a remote key set, also with a client without timeout
+const keySetTimeout = 10 * time.Second
+
+// KeySet holds the signature keys from a jwks url or a local file.
+// remote key sets are reloaded if a token references an unknown key
+type KeySet struct {
+	sync.Mutex
+	source string
+	client *http.Client
+	keys   map[string]crypto.PublicKey
+	// loaded is the time of the last load attempt, it limits the reloads
+	loaded time.Time
+}
+
+// NewKeySet loads the keys from source, which is an http(s) url or a filename
+func NewKeySet(source string, client *http.Client) (*KeySet, error) {
+	if client == nil {
+		client = defaultClient
+	}
+	ks := &KeySet{source: source, client: client}
+	keys, err := ks.fetch()
+	if err != nil {
+		return nil, err
+	}
+	ks.keys = keys
+	ks.loaded = time.Now()
+	return ks, nil
+}
+
+func (ks *KeySet) remote() bool {
+	return strings.HasPrefix(ks.source, "http://") || strings.HasPrefix(ks.source, "https://")
+}
+
+// fetch reads the keys from the source. it is called without the lock held
+func (ks *KeySet) fetch() (map[string]crypto.PublicKey, error) {
+	var data []byte
+	var err error
+	if ks.remote() {
+		ctx, cancel := context.WithTimeout(context.Background(), keySetTimeout)
+		defer cancel()
+		data, err = getJSON(ctx, ks.client, ks.source)
+	} else {
+		data, err = os.ReadFile(ks.source)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot load key set %s", ks.source)
+	}
+	var jwks JWKS
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, errors.Wrapf(err, "cannot unmarshal key set %s", ks.source)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.PublicKey()
+		if err != nil {
+			// keys of unknown types are ignored
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	if len(keys) == 0 {
+		return nil, errors.Errorf("no signature keys in %s", ks.source)
+	}
+	return keys, nil
+}
+
+// Key returns the key with the key id kid. an empty kid is allowed for key sets with one key
+func (ks *KeySet) Key(kid string) (crypto.PublicKey, error) {
+	ks.Lock()
+	key, ok := ks.key(kid)
+	// only one caller reloads, the others fail until the new keys are there
+	reload := !ok && ks.remote() && time.Since(ks.loaded) >= keySetRefresh
+	if reload {
+		ks.loaded = time.Now()
+	}
+	ks.Unlock()
+	if ok {
+		return key, nil
+	}
+	if !reload {
+		return nil, errors.Errorf("unknown key %s", kid)
+	}
+	keys, err := ks.fetch()
+	if err != nil {
+		return nil, err
+	}
+	ks.Lock()
+	defer ks.Unlock()
+	ks.keys = keys
+	if key, ok := ks.key(kid); ok {
+		return key, nil
+	}
+	return nil, errors.Errorf("unknown key %s", kid)
+}
+
+// key looks kid up in the loaded keys. the lock must be held
+func (ks *KeySet) key(kid string) (crypto.PublicKey, bool) {
+	if key, ok := ks.keys[kid]; ok {
+		return key, true
+	}
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot create request for %s", url)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot get %s", url)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read %s", url)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("cannot get %s: %s", url, resp.Status)
+	}
+	return data, nil
+}
@@ -0,0 +1,228 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Claims is the payload of a jwt
+type Claims map[string]interface{}
+
+// lookup returns the value of name. dots separate nested objects (realm_access.roles)
+func (c Claims) lookup(name string) (interface{}, bool) {
+	var cur interface{} = map[string]interface{}(c)
+	for _, part := range strings.Split(name, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[part]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// String returns the string claim name or ""
+func (c Claims) String(name string) string {
+	v, _ := c.lookup(name)
+	str, _ := v.(string)
+	return str
+}
+
+// Strings returns the claim name as list. a single string is a list with one element
+func (c Claims) Strings(name string) []string {
+	v, ok := c.lookup(name)
+	if !ok {
+		return nil
+	}
+	switch val := v.(type) {
+	case string:
+		return []string{val}
+	case []interface{}:
+		var result []string
+		for _, e := range val {
+			if str, ok := e.(string); ok {
+				result = append(result, str)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+// Time returns the numeric date claim name
+func (c Claims) Time(name string) (time.Time, bool) {
+	v, ok := c.lookup(name)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ,omitempty"`
+}
+
+var algHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// Verifier checks signature and standard claims of tokens
+type Verifier struct {
+	Keys *KeySet
+	// Issuer is compared with the iss claim, if not empty
+	Issuer string
+	// Audience has to be in the aud claim. without audience every token of the issuer would be accepted
+	Audience string
+	// Nonce has to match the nonce claim of id tokens, if not empty
+	Nonce string
+	// Leeway is the allowed clock skew for exp and nbf
+	Leeway time.Duration
+}
+
+// Verify checks token and returns its claims
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is no jws compact serialization")
+	}
+	hdrData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decode token header")
+	}
+	var hdr header
+	if err := json.Unmarshal(hdrData, &hdr); err != nil {
+		return nil, errors.Wrap(err, "cannot unmarshal token header")
+	}
+	hash, ok := algHashes[hdr.Alg]
+	if !ok {
+		return nil, errors.Errorf("unsupported algorithm %s", hdr.Alg)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decode token signature")
+	}
+	key, err := v.Keys.Key(hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+	if err := verifySignature(hdr.Alg, key, hash, digest, sig); err != nil {
+		return nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decode token payload")
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.Wrap(err, "cannot unmarshal token payload")
+	}
+	now := time.Now()
+	exp, ok := claims.Time("exp")
+	if !ok {
+		return nil, errors.New("token without expiry")
+	}
+	if now.After(exp.Add(v.Leeway)) {
+		return nil, errors.Errorf("token expired at %s", exp)
+	}
+	if nbf, ok := claims.Time("nbf"); ok && now.Add(v.Leeway).Before(nbf) {
+		return nil, errors.Errorf("token not valid before %s", nbf)
+	}
+	if v.Issuer != "" && claims.String("iss") != v.Issuer {
+		return nil, errors.Errorf("invalid issuer %s", claims.String("iss"))
+	}
+	if v.Audience == "" {
+		return nil, errors.New("verifier without audience")
+	}
+	var found bool
+	for _, aud := range claims.Strings("aud") {
+		if aud == v.Audience {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, errors.Errorf("token not issued for %s", v.Audience)
+	}
+	if v.Nonce != "" && claims.String("nonce") != v.Nonce {
+		return nil, errors.New("invalid nonce")
+	}
+	return claims, nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, hash crypto.Hash, digest, sig []byte) error {
+	switch alg[:2] {
+	case "RS", "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.Errorf("key is no rsa key for %s", alg)
+		}
+		var err error
+		if alg[0] == 'R' {
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+		} else {
+			err = rsa.VerifyPSS(pub, hash, digest, sig, nil)
+		}
+		if err != nil {
+			return errors.Wrap(err, "invalid token signature")
+		}
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.Errorf("key is no ecdsa key for %s", alg)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid token signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid token signature")
+		}
+	}
+	return nil
+}
+
+// SignRS256 creates a token with claims signed by key
+func SignRS256(claims Claims, kid string, key *rsa.PrivateKey) (string, error) {
+	hdrData, err := json.Marshal(header{Alg: "RS256", Kid: kid, Typ: "JWT"})
+	if err != nil {
+		return "", errors.Wrap(err, "cannot marshal token header")
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot marshal claims")
+	}
+	signed := base64.RawURLEncoding.EncodeToString(hdrData) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	h := crypto.SHA256.New()
+	h.Write([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h.Sum(nil))
+	if err != nil {
+		return "", errors.Wrap(err, "cannot sign token")
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
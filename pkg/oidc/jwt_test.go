@@ -0,0 +1,236 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIssuer serves discovery and key set like cmd/mockoidc
+type testIssuer struct {
+	*httptest.Server
+	lock  sync.Mutex
+	keys  map[string]*rsa.PrivateKey
+	loads int
+}
+
+var (
+	testKeyOnce sync.Once
+	testKeys    [2]*rsa.PrivateKey
+)
+
+func rsaKeys(t *testing.T) [2]*rsa.PrivateKey {
+	testKeyOnce.Do(func() {
+		for i := range testKeys {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				t.Fatalf("cannot generate key: %v", err)
+			}
+			testKeys[i] = key
+		}
+	})
+	return testKeys
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	is := &testIssuer{keys: map[string]*rsa.PrivateKey{"k1": rsaKeys(t)[0]}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(Provider{
+			Issuer:                is.URL,
+			AuthorizationEndpoint: is.URL + "/authorize",
+			TokenEndpoint:         is.URL + "/token",
+			JWKSURI:               is.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, req *http.Request) {
+		is.lock.Lock()
+		defer is.lock.Unlock()
+		is.loads++
+		var jwks JWKS
+		for kid, key := range is.keys {
+			jwks.Keys = append(jwks.Keys, NewRSAJWK(kid, &key.PublicKey))
+		}
+		json.NewEncoder(w).Encode(jwks)
+	})
+	is.Server = httptest.NewServer(mux)
+	t.Cleanup(is.Close)
+	return is
+}
+
+func (is *testIssuer) verifier(t *testing.T) *Verifier {
+	p, err := Discover(context.Background(), is.URL, nil)
+	if err != nil {
+		t.Fatalf("cannot discover: %v", err)
+	}
+	keys, err := NewKeySet(p.JWKSURI, nil)
+	if err != nil {
+		t.Fatalf("cannot load key set: %v", err)
+	}
+	return &Verifier{Keys: keys, Issuer: is.URL, Audience: "s3image", Nonce: "n0nce"}
+}
+
+func (is *testIssuer) claims() Claims {
+	now := time.Now()
+	return Claims{
+		"iss":   is.URL,
+		"sub":   "tester",
+		"aud":   "s3image",
+		"iat":   float64(now.Unix()),
+		"exp":   float64(now.Add(time.Hour).Unix()),
+		"nonce": "n0nce",
+	}
+}
+
+// sign creates a token with any header, the signature is made with key for RS256
+func sign(t *testing.T, hdr header, claims Claims, key *rsa.PrivateKey) string {
+	hdrData, _ := json.Marshal(hdr)
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(hdrData) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	h := crypto.SHA256.New()
+	h.Write([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h.Sum(nil))
+	if err != nil {
+		t.Fatalf("cannot sign: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerify(t *testing.T) {
+	is := newTestIssuer(t)
+	v := is.verifier(t)
+	key := rsaKeys(t)[0]
+
+	token, err := SignRS256(is.claims(), "k1", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := v.Verify(token)
+	if err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+	if claims.String("sub") != "tester" {
+		t.Errorf("sub is %q", claims.String("sub"))
+	}
+
+	with := func(name string, value interface{}) Claims {
+		c := is.claims()
+		if value == nil {
+			delete(c, name)
+		} else {
+			c[name] = value
+		}
+		return c
+	}
+	now := time.Now()
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"bad signature", sign(t, header{Alg: "RS256", Kid: "k1"}, is.claims(), rsaKeys(t)[1]), "invalid token signature"},
+		{"changed payload", func() string {
+			parts := strings.Split(token, ".")
+			payload, _ := json.Marshal(with("sub", "admin"))
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+		}(), "invalid token signature"},
+		{"alg none", sign(t, header{Alg: "none", Kid: "k1"}, is.claims(), key), "unsupported algorithm"},
+		{"alg hs256", sign(t, header{Alg: "HS256", Kid: "k1"}, is.claims(), key), "unsupported algorithm"},
+		{"ec alg with rsa key", sign(t, header{Alg: "ES256", Kid: "k1"}, is.claims(), key), "no ecdsa key"},
+		{"unknown kid", sign(t, header{Alg: "RS256", Kid: "k2"}, is.claims(), key), "unknown key k2"},
+		{"no compact jws", "a.b", "no jws"},
+		{"expired", sign(t, header{Alg: "RS256", Kid: "k1"}, with("exp", float64(now.Add(-time.Minute).Unix())), key), "expired"},
+		{"no expiry", sign(t, header{Alg: "RS256", Kid: "k1"}, with("exp", nil), key), "without expiry"},
+		{"not yet valid", sign(t, header{Alg: "RS256", Kid: "k1"}, with("nbf", float64(now.Add(time.Minute).Unix())), key), "not valid before"},
+		{"wrong issuer", sign(t, header{Alg: "RS256", Kid: "k1"}, with("iss", "https://evil.example"), key), "invalid issuer"},
+		{"wrong audience", sign(t, header{Alg: "RS256", Kid: "k1"}, with("aud", []string{"other"}), key), "not issued for s3image"},
+		{"wrong nonce", sign(t, header{Alg: "RS256", Kid: "k1"}, with("nonce", "other"), key), "invalid nonce"},
+		{"no nonce", sign(t, header{Alg: "RS256", Kid: "k1"}, with("nonce", nil), key), "invalid nonce"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := v.Verify(test.token)
+			if err == nil {
+				t.Fatalf("token accepted")
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error %q does not contain %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestVerifyWithoutAudience(t *testing.T) {
+	is := newTestIssuer(t)
+	v := is.verifier(t)
+	v.Audience = ""
+	token, err := SignRS256(is.claims(), "k1", rsaKeys(t)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify(token); err == nil {
+		t.Errorf("token accepted by a verifier without audience")
+	}
+}
+
+func TestVerifyLeeway(t *testing.T) {
+	is := newTestIssuer(t)
+	v := is.verifier(t)
+	v.Leeway = 2 * time.Minute
+	now := time.Now()
+	c := is.claims()
+	c["exp"] = float64(now.Add(-time.Minute).Unix())
+	c["nbf"] = float64(now.Add(time.Minute).Unix())
+	token, err := SignRS256(c, "k1", rsaKeys(t)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify(token); err != nil {
+		t.Errorf("token within leeway rejected: %v", err)
+	}
+}
+
+func TestKeySetReload(t *testing.T) {
+	is := newTestIssuer(t)
+	v := is.verifier(t)
+	token, err := SignRS256(is.claims(), "k2", rsaKeys(t)[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	is.lock.Lock()
+	is.keys["k2"] = rsaKeys(t)[1]
+	is.lock.Unlock()
+
+	// the key set was loaded just now, an unknown key does not reload it
+	if _, err := v.Verify(token); err == nil {
+		t.Fatalf("token with new key accepted before the refresh interval")
+	}
+	v.Keys.Lock()
+	v.Keys.loaded = time.Now().Add(-keySetRefresh)
+	v.Keys.Unlock()
+	if _, err := v.Verify(token); err != nil {
+		t.Fatalf("token with new key rejected after reload: %v", err)
+	}
+	is.lock.Lock()
+	loads := is.loads
+	is.lock.Unlock()
+	if loads != 2 {
+		t.Errorf("key set loaded %d times, expected 2", loads)
+	}
+}
+
+func TestDiscoverIssuerMismatch(t *testing.T) {
+	is := newTestIssuer(t)
+	if _, err := Discover(context.Background(), is.URL+"/other", nil); err == nil {
+		t.Errorf("discovery of a wrong issuer accepted")
+	}
+}
@@ -0,0 +1,105 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// defaultClient is used if no client is given. a hanging issuer must not block logins
+// and token validation forever
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// Provider holds the endpoints of an openid connect issuer
+type Provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	EndSessionEndpoint    string `json:"end_session_endpoint,omitempty"`
+
+	client *http.Client
+}
+
+// Discover loads the openid configuration of issuer
+func Discover(ctx context.Context, issuer string, client *http.Client) (*Provider, error) {
+	if client == nil {
+		client = defaultClient
+	}
+	wellKnown := strings.TrimRight(issuer, "/") + "/.well-known/openid-configuration"
+	data, err := getJSON(ctx, client, wellKnown)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot discover issuer %s", issuer)
+	}
+	p := &Provider{client: client}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, errors.Wrapf(err, "cannot unmarshal %s", wellKnown)
+	}
+	if p.Issuer != issuer {
+		return nil, errors.Errorf("issuer %s of %s does not match", p.Issuer, wellKnown)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, errors.Errorf("incomplete configuration in %s", wellKnown)
+	}
+	return p, nil
+}
+
+// AuthCodeURL returns the login url of the authorization code flow
+func (p *Provider) AuthCodeURL(clientID, redirectURI, state, nonce string, scopes []string) string {
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", clientID)
+	q.Set("redirect_uri", redirectURI)
+	q.Set("scope", strings.Join(append([]string{"openid"}, scopes...), " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.AuthorizationEndpoint + sep + q.Encode()
+}
+
+// Exchange redeems the authorization code and returns the id token
+func (p *Provider) Exchange(ctx context.Context, clientID, clientSecret, redirectURI, code string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot create request for %s", p.TokenEndpoint)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot post to %s", p.TokenEndpoint)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot read token response")
+	}
+	var result struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return "", errors.Wrapf(err, "cannot unmarshal token response (%s)", resp.Status)
+	}
+	if result.Error != "" {
+		return "", errors.Errorf("token request failed: %s %s", result.Error, result.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || result.IDToken == "" {
+		return "", errors.Errorf("no id token in response (%s)", resp.Status)
+	}
+	return result.IDToken, nil
+}
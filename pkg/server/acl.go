@@ -0,0 +1,422 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/gorilla/handlers"
+	"github.com/je4/s3image/v2/pkg/filesystem"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACLAction is the kind of access controlled by acl rules
+type ACLAction string
+
+const (
+	ACLRead       ACLAction = "read"
+	ACLMaster     ACLAction = "master"
+	ACLDerivative ACLAction = "derivative"
+)
+
+// aclSidecar is the name of the acl file of a folder
+const aclSidecar = ".s3image-acl"
+
+// routeActions is the acl action of the named routes
+var routeActions = map[string]ACLAction{
+	"index":        ACLRead,
+	"book":         ACLRead,
+	"view":         ACLRead,
+	"zoom":         ACLRead,
+	"thumb":        ACLDerivative,
+	"page":         ACLDerivative,
+	"profile":      ACLDerivative,
+	"dzi":          ACLDerivative,
+	"dzitile":      ACLDerivative,
+	"contactsheet": ACLDerivative,
+	"bookpdf":      ACLDerivative,
+	"bookcbz":      ACLDerivative,
+	"master":       ACLMaster,
+	"zip":          ACLMaster,
+}
+
+// ACLRule allows or denies actions on a prefix. all given conditions have to match.
+// in sidecar files the prefix is relative to the folder of the sidecar
+type ACLRule struct {
+	Bucket string `toml:"bucket"`
+	Prefix string `toml:"prefix"`
+	// Effect is allow or deny
+	Effect  string      `toml:"effect"`
+	Actions []ACLAction `toml:"actions"`
+	Users   []string    `toml:"users"`
+	Roles   []Role      `toml:"roles"`
+	// IPs are addresses or cidr ranges
+	IPs []string `toml:"ips"`
+	// the rule applies from From until Until, if set
+	From  time.Time `toml:"from"`
+	Until time.Time `toml:"until"`
+
+	nets []*net.IPNet
+}
+
+// ACLConfig defines the access control rules
+type ACLConfig struct {
+	Rules []ACLRule
+	// Sidecar enables .s3image-acl files in the folders
+	Sidecar bool
+	// SidecarTTL is the time sidecar files are cached
+	SidecarTTL time.Duration
+	// TrustedProxies are addresses or cidr ranges of the reverse proxies. only their
+	// forwarded headers are used for the client address, scheme and host
+	TrustedProxies []string
+}
+
+type aclDecision int
+
+const (
+	aclNone aclDecision = iota
+	aclAllow
+	aclDeny
+)
+
+func (r *ACLRule) init() error {
+	if r.Effect != "allow" && r.Effect != "deny" {
+		return errors.Errorf("invalid effect %s for prefix %s", r.Effect, r.Prefix)
+	}
+	for _, a := range r.Actions {
+		if a != ACLRead && a != ACLMaster && a != ACLDerivative {
+			return errors.Errorf("invalid action %s for prefix %s", a, r.Prefix)
+		}
+	}
+	for _, role := range r.Roles {
+		if !role.valid() {
+			return errors.Errorf("invalid role %s for prefix %s", role, r.Prefix)
+		}
+	}
+	var err error
+	if r.nets, err = parseNets(r.IPs); err != nil {
+		return errors.Wrapf(err, "invalid ips for prefix %s", r.Prefix)
+	}
+	return nil
+}
+
+// parseNets parses addresses and cidr ranges
+func parseNets(ips []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, ip := range ips {
+		if !strings.Contains(ip, "/") {
+			if strings.Contains(ip, ":") {
+				ip += "/128"
+			} else {
+				ip += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(ip)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid ip range %s", ip)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// applies checks the conditions of the rule
+func (r *ACLRule) applies(action ACLAction, bucket, key string, user *User, ip net.IP, now time.Time) bool {
+	if len(r.Actions) > 0 {
+		var found bool
+		for _, a := range r.Actions {
+			if a == action {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !r.From.IsZero() && now.Before(r.From) {
+		return false
+	}
+	if !r.Until.IsZero() && !now.Before(r.Until) {
+		return false
+	}
+	if len(r.Users) > 0 {
+		if user == nil {
+			return false
+		}
+		var found bool
+		for _, u := range r.Users {
+			if u == user.Name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.Roles) > 0 {
+		role := user.RoleFor(bucket, key)
+		var found bool
+		for _, required := range r.Roles {
+			if required != RoleNone && role.Includes(required) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.nets) > 0 && (ip == nil || !containsIP(r.nets, ip)) {
+		return false
+	}
+	return true
+}
+
+type aclSidecarEntry struct {
+	rules  []ACLRule
+	loaded time.Time
+}
+
+// aclStore holds the configured rules and caches the sidecar files
+type aclStore struct {
+	sync.Mutex
+	conf     ACLConfig
+	sidecars map[string]aclSidecarEntry
+}
+
+func newACLStore(conf ACLConfig) (*aclStore, error) {
+	if conf.SidecarTTL <= 0 {
+		conf.SidecarTTL = time.Minute
+	}
+	for i := range conf.Rules {
+		if conf.Rules[i].Bucket == "" {
+			return nil, errors.Errorf("acl rule for prefix %s without bucket", conf.Rules[i].Prefix)
+		}
+		if err := conf.Rules[i].init(); err != nil {
+			return nil, err
+		}
+	}
+	return &aclStore{conf: conf, sidecars: map[string]aclSidecarEntry{}}, nil
+}
+
+// sidecarRules returns the rules of the sidecar in bucket/folder with prefixes relative to the bucket
+func (s *Server) sidecarRules(ctx context.Context, bucket, folder string) ([]ACLRule, error) {
+	cacheKey := bucket + "/" + folder
+	s.acl.Lock()
+	entry, ok := s.acl.sidecars[cacheKey]
+	s.acl.Unlock()
+	if ok && time.Since(entry.loaded) < s.acl.conf.SidecarTTL {
+		return entry.rules, nil
+	}
+	name := strings.TrimLeft(folder+"/"+aclSidecar, "/")
+	exists, err := s.files(ctx).FileExists(bucket, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot check %s/%s", bucket, name)
+	}
+	var rules []ACLRule
+	if exists {
+		data, err := s.files(ctx).FileGet(bucket, name, filesystem.FileGetOptions{})
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read %s/%s", bucket, name)
+		}
+		var sidecar struct {
+			Rule []ACLRule `toml:"rule"`
+		}
+		if _, err := toml.NewDecoder(bytes.NewReader(data)).Decode(&sidecar); err != nil {
+			return nil, errors.Wrapf(err, "cannot decode %s/%s", bucket, name)
+		}
+		for _, r := range sidecar.Rule {
+			r.Bucket = bucket
+			r.Prefix = strings.Trim(folder+"/"+strings.Trim(r.Prefix, "/"), "/")
+			if err := r.init(); err != nil {
+				return nil, errors.Wrapf(err, "invalid rule in %s/%s", bucket, name)
+			}
+			rules = append(rules, r)
+		}
+	}
+	s.acl.Lock()
+	s.acl.sidecars[cacheKey] = aclSidecarEntry{rules: rules, loaded: time.Now()}
+	s.acl.Unlock()
+	return rules, nil
+}
+
+// aclDecide evaluates the rules for key. the rules of the longest prefix are checked first,
+// the first applying rule decides. the sidecar of key itself is only used for folders
+func (s *Server) aclDecide(ctx context.Context, bucket, key string, folder bool, action ACLAction) (aclDecision, error) {
+	if s.acl == nil || action == "" {
+		return aclNone, nil
+	}
+	key = strings.Trim(key, "/")
+	var rules []ACLRule
+	for _, r := range s.acl.conf.Rules {
+		if (Grant{Bucket: r.Bucket, Prefix: r.Prefix}).matches(bucket, key) {
+			rules = append(rules, r)
+		}
+	}
+	if s.acl.conf.Sidecar {
+		// sidecars of all folders from the bucket root to key
+		folders := []string{""}
+		if key != "" {
+			elements := strings.Split(key, "/")
+			if !folder {
+				elements = elements[:len(elements)-1]
+			}
+			for i := range elements {
+				folders = append(folders, strings.Join(elements[:i+1], "/"))
+			}
+		}
+		for _, f := range folders {
+			sidecar, err := s.sidecarRules(ctx, bucket, f)
+			if err != nil {
+				return aclDeny, err
+			}
+			for _, r := range sidecar {
+				if (Grant{Bucket: r.Bucket, Prefix: r.Prefix}).matches(bucket, key) {
+					rules = append(rules, r)
+				}
+			}
+		}
+	}
+	if len(rules) == 0 {
+		return aclNone, nil
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(strings.Trim(rules[i].Prefix, "/")) > len(strings.Trim(rules[j].Prefix, "/"))
+	})
+	user := userFromContext(ctx)
+	ip := clientIPFromContext(ctx)
+	now := time.Now()
+	for _, r := range rules {
+		if r.applies(action, bucket, key, user, ip, now) {
+			if r.Effect == "allow" {
+				return aclAllow, nil
+			}
+			return aclDeny, nil
+		}
+	}
+	return aclNone, nil
+}
+
+// allowed checks acl rules and the role of the user for key. requests of share links may access the content of the share
+func (s *Server) allowed(ctx context.Context, bucket, key string, folder bool, action ACLAction, role Role) bool {
+	sh := shareFromContext(ctx)
+	if sh != nil && !sh.covers(bucket, key) {
+		return false
+	}
+	decision, err := s.aclDecide(ctx, bucket, key, folder, action)
+	if err != nil {
+		s.logger(ctx).Errorf("cannot evaluate acl of %s/%s: %v", bucket, key, err)
+		return false
+	}
+	if sh != nil {
+		return decision != aclDeny
+	}
+	switch decision {
+	case aclAllow:
+		return true
+	case aclDeny:
+		return false
+	}
+	return userFromContext(ctx).RoleFor(bucket, key).Includes(role)
+}
+
+// filterFiles removes the files, which are not allowed for action. acl sidecar files are never listed
+func (s *Server) filterFiles(ctx context.Context, bucket string, files []folderFile, action ACLAction, role Role) []folderFile {
+	var result = []folderFile{}
+	for _, f := range files {
+		if filepath.Base(f.Key) == aclSidecar {
+			continue
+		}
+		if s.allowed(ctx, bucket, f.Key, f.IsDir, action, role) {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+// filterDirEntries removes the entries of a FileList, which are not allowed for action
+func (s *Server) filterDirEntries(ctx context.Context, bucket string, de []os.DirEntry, action ACLAction, role Role) []os.DirEntry {
+	var result = []os.DirEntry{}
+	for _, e := range de {
+		f := dirEntryFile(bucket, e)
+		if filepath.Base(f.Key) == aclSidecar {
+			continue
+		}
+		if s.allowed(ctx, bucket, f.Key, f.IsDir, action, role) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+type clientIPContextKey struct{}
+
+func clientIPFromContext(ctx context.Context) net.IP {
+	ip, _ := ctx.Value(clientIPContextKey{}).(net.IP)
+	return ip
+}
+
+// proxyHeaders applies the forwarded headers of trusted proxies, the headers of other clients are ignored.
+// the client address is the last address in X-Forwarded-For, which is not a trusted proxy
+func (s *Server) proxyHeaders(next http.Handler) http.Handler {
+	proxied := handlers.ProxyHeaders(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !containsIP(s.trustedProxies, clientIP(req)) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if forwarded := req.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			addrs := strings.Split(strings.Join(forwarded, ","), ",")
+			var client string
+			for i := len(addrs) - 1; i >= 0; i-- {
+				ip := net.ParseIP(strings.TrimSpace(addrs[i]))
+				if ip == nil {
+					break
+				}
+				client = ip.String()
+				if !containsIP(s.trustedProxies, ip) {
+					break
+				}
+			}
+			req.Header.Del("X-Forwarded-For")
+			if client != "" {
+				// ProxyHeaders uses the first address
+				req.Header.Set("X-Forwarded-For", client)
+			}
+		}
+		proxied.ServeHTTP(w, req)
+	})
+}
+
+// clientIP returns the address of the client. forwarded headers of trusted proxies are already applied to RemoteAddr
+func clientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+func (s *Server) aclError(w http.ResponseWriter, req *http.Request, bucket, key string, err error) {
+	s.logger(req.Context()).Errorf("cannot evaluate acl of %s/%s: %v", bucket, key, err)
+	writeError(w, http.StatusInternalServerError, fmt.Sprintf("cannot evaluate acl of %s/%s", bucket, key))
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"context"
+	"github.com/je4/s3image/v2/pkg/filesystem"
+	"github.com/je4/s3image/v2/pkg/structlog"
+	logging "github.com/op/go-logging"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newACLServer creates a server with the acl rules on a local filesystem with the bucket photos
+func newACLServer(t *testing.T, conf ACLConfig, sidecars map[string]string) *Server {
+	base := t.TempDir()
+	for folder, content := range sidecars {
+		path := filepath.Join(base, "photos", folder, aclSidecar)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(base, "photos"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	logger := logging.MustGetLogger("test")
+	lfs, err := filesystem.NewLocalFs(base, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := newACLStore(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{
+		acl:     acl,
+		fs:      lfs,
+		log:     logger,
+		flog:    structlog.New(logger),
+		metrics: newMetrics(nil, newTransformPool(TransformConfig{Workers: 1})),
+	}
+}
+
+// aclContext is the context of a request of user from ip
+func aclContext(user *User, ip string) context.Context {
+	ctx := context.WithValue(context.Background(), clientIPContextKey{}, net.ParseIP(ip))
+	if user != nil {
+		ctx = context.WithValue(ctx, userContextKey{}, user)
+	}
+	return ctx
+}
+
+func TestACLDecide(t *testing.T) {
+	now := time.Now()
+	s := newACLServer(t, ACLConfig{
+		Sidecar: true,
+		Rules: []ACLRule{
+			{Bucket: "photos", Effect: "allow", Actions: []ACLAction{ACLRead}},
+			{Bucket: "photos", Prefix: "private", Effect: "deny"},
+			{Bucket: "photos", Prefix: "private/open", Effect: "allow", Roles: []Role{RoleViewer}},
+			{Bucket: "photos", Prefix: "staff", Effect: "allow", Users: []string{"alice"}},
+			{Bucket: "photos", Prefix: "embargo", Effect: "deny", Until: now.Add(time.Hour)},
+			{Bucket: "photos", Prefix: "released", Effect: "deny", Until: now.Add(-time.Hour)},
+			{Bucket: "photos", Prefix: "future", Effect: "deny", From: now.Add(time.Hour)},
+			// rules of the same prefix are checked in order
+			{Bucket: "photos", Prefix: "campus", Effect: "allow", IPs: []string{"10.0.0.0/8", "2001:db8::1"}},
+			{Bucket: "photos", Prefix: "campus", Effect: "deny"},
+			{Bucket: "docs", Prefix: "private", Effect: "deny"},
+		},
+	}, map[string]string{
+		"side":      "[[rule]]\nprefix = \"secret\"\neffect = \"deny\"\n",
+		"folderacl": "[[rule]]\neffect = \"deny\"\nactions = [\"master\"]\n",
+	})
+	viewer := &User{Name: "bob", Role: RoleViewer}
+	alice := &User{Name: "alice"}
+	tests := []struct {
+		name     string
+		key      string
+		folder   bool
+		action   ACLAction
+		user     *User
+		ip       string
+		decision aclDecision
+	}{
+		{"root rule", "x.jpg", false, ACLRead, nil, "", aclAllow},
+		{"other action", "x.jpg", false, ACLMaster, nil, "", aclNone},
+		{"longer prefix denies", "private/x.jpg", false, ACLRead, nil, "", aclDeny},
+		{"prefix matches the folder itself", "private", true, ACLRead, nil, "", aclDeny},
+		{"prefix matches path elements only", "privateer.jpg", false, ACLRead, nil, "", aclAllow},
+		{"longest prefix allows with role", "private/open/x.jpg", false, ACLMaster, viewer, "", aclAllow},
+		{"longest prefix without role", "private/open/x.jpg", false, ACLMaster, nil, "", aclDeny},
+		{"user rule", "staff/x.jpg", false, ACLMaster, alice, "", aclAllow},
+		{"user rule for other user", "staff/x.jpg", false, ACLMaster, viewer, "", aclNone},
+		{"embargo", "embargo/x.jpg", false, ACLRead, nil, "", aclDeny},
+		{"embargo over", "released/x.jpg", false, ACLRead, nil, "", aclAllow},
+		{"embargo not started", "future/x.jpg", false, ACLRead, nil, "", aclAllow},
+		{"ip range", "campus/x.jpg", false, ACLMaster, nil, "10.1.2.3", aclAllow},
+		{"ipv6 address", "campus/x.jpg", false, ACLMaster, nil, "2001:db8::1", aclAllow},
+		{"outside ip range", "campus/x.jpg", false, ACLMaster, nil, "192.168.1.1", aclDeny},
+		{"no ip", "campus/x.jpg", false, ACLMaster, nil, "", aclDeny},
+		{"sidecar below", "side/secret/x.jpg", false, ACLRead, nil, "", aclDeny},
+		{"sidecar prefix is relative", "secret/x.jpg", false, ACLRead, nil, "", aclAllow},
+		{"sidecar of the folder", "folderacl", true, ACLMaster, nil, "", aclDeny},
+		{"sidecar of a folder does not apply to a file of the same name", "folderacl", false, ACLMaster, nil, "", aclNone},
+		{"sidecar of the parent", "folderacl/x.jpg", false, ACLMaster, nil, "", aclDeny},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decision, err := s.aclDecide(aclContext(test.user, test.ip), "photos", test.key, test.folder, test.action)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decision != test.decision {
+				t.Errorf("decision for %s is %v, expected %v", test.key, decision, test.decision)
+			}
+		})
+	}
+}
+
+func TestACLAllowed(t *testing.T) {
+	s := newACLServer(t, ACLConfig{
+		Rules: []ACLRule{
+			{Bucket: "photos", Prefix: "public", Effect: "allow", Actions: []ACLAction{ACLRead, ACLDerivative}},
+			{Bucket: "photos", Prefix: "hidden", Effect: "deny"},
+		},
+	}, nil)
+	admin := &User{Name: "admin", Role: RoleAdmin}
+	viewer := &User{Name: "bob", Role: RoleViewer}
+	tests := []struct {
+		key     string
+		action  ACLAction
+		role    Role
+		user    *User
+		allowed bool
+	}{
+		// allow rules open content without role
+		{"public/x.jpg", ACLRead, RoleViewer, nil, true},
+		// deny rules also apply to admins
+		{"hidden/x.jpg", ACLRead, RoleViewer, admin, false},
+		// without a rule the role decides
+		{"other/x.jpg", ACLRead, RoleViewer, viewer, true},
+		{"other/x.jpg", ACLMaster, RoleDownloader, viewer, false},
+		{"public/x.jpg", ACLMaster, RoleDownloader, nil, false},
+	}
+	for _, test := range tests {
+		if allowed := s.allowed(aclContext(test.user, ""), "photos", test.key, false, test.action, test.role); allowed != test.allowed {
+			t.Errorf("allowed(%s, %s) is %v", test.key, test.action, allowed)
+		}
+	}
+}
+
+func TestACLFilterFiles(t *testing.T) {
+	s := newACLServer(t, ACLConfig{
+		Rules: []ACLRule{
+			{Bucket: "photos", Prefix: "a/hidden.jpg", Effect: "deny"},
+		},
+	}, nil)
+	files := []folderFile{
+		{Key: "a/x.jpg"},
+		{Key: "a/" + aclSidecar},
+		{Key: "a/hidden.jpg"},
+		{Key: "a/sub", IsDir: true},
+	}
+	result := s.filterFiles(aclContext(&User{Name: "admin", Role: RoleAdmin}, ""), "photos", files, ACLRead, RoleViewer)
+	var keys []string
+	for _, f := range result {
+		keys = append(keys, f.Key)
+	}
+	if len(keys) != 2 || keys[0] != "a/x.jpg" || keys[1] != "a/sub" {
+		t.Errorf("filtered files are %v", keys)
+	}
+}
+
+func TestProxyHeaders(t *testing.T) {
+	nets, err := parseNets([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{trustedProxies: nets}
+	var client string
+	handler := s.proxyHeaders(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		client = clientIP(req).String()
+	}))
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded string
+		client    string
+	}{
+		{"untrusted client", "192.0.2.1:1234", "203.0.113.7", "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", "203.0.113.7", "203.0.113.7"},
+		{"chain of trusted proxies", "10.0.0.1:1234", "198.51.100.1, 203.0.113.7, 10.0.0.2", "203.0.113.7"},
+		{"ipv6 proxy", "[::1]:1234", "203.0.113.7", "203.0.113.7"},
+		{"no header", "10.0.0.1:1234", "", "10.0.0.1"},
+		{"invalid address stops", "10.0.0.1:1234", "203.0.113.7, garbage, 10.0.0.2", "10.0.0.2"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if client != test.client {
+			t.Errorf("%s: client is %s, expected %s", test.name, client, test.client)
+		}
+	}
+}
+
+func TestACLRuleInit(t *testing.T) {
+	for _, r := range []ACLRule{
+		{Prefix: "a", Effect: "permit"},
+		{Prefix: "a", Effect: "allow", Actions: []ACLAction{"write"}},
+		{Prefix: "a", Effect: "allow", Roles: []Role{"owner"}},
+		{Prefix: "a", Effect: "allow", IPs: []string{"10.0.0.300"}},
+	} {
+		if err := r.init(); err == nil {
+			t.Errorf("invalid rule %v accepted", r)
+		}
+	}
+}
+
+func TestBucketEntries(t *testing.T) {
+	s := newACLServer(t, ACLConfig{
+		Rules: []ACLRule{
+			{Bucket: "public", Effect: "allow", Actions: []ACLAction{ACLRead}},
+		},
+	}, nil)
+	s.state.Store(&reloadable{buckets: map[string]string{"photos": "photos", "docs": "docs", "public": "public", "archive": "archive"}})
+	tests := []struct {
+		name    string
+		user    *User
+		buckets []string
+	}{
+		{"anonymous", nil, []string{"public"}},
+		{"admin", &User{Name: "admin", Role: RoleAdmin}, []string{"archive", "docs", "photos", "public"}},
+		{"grant on the bucket", &User{Name: "a", Grants: []Grant{{Bucket: "photos", Role: RoleViewer}}}, []string{"photos", "public"}},
+		{"grant below the root", &User{Name: "b", Grants: []Grant{{Bucket: "docs", Prefix: "a/b", Role: RoleDownloader}}}, []string{"docs", "public"}},
+		{"denying grant", &User{Name: "c", Role: RoleViewer, Grants: []Grant{{Bucket: "archive", Role: RoleNone}}}, []string{"docs", "photos", "public"}},
+	}
+	for _, test := range tests {
+		var names []string
+		for _, e := range s.bucketEntries(aclContext(test.user, "")) {
+			names = append(names, e.Name())
+		}
+		sort.Strings(names)
+		if strings.Join(names, ",") != strings.Join(test.buckets, ",") {
+			t.Errorf("%s: buckets are %v, expected %v", test.name, names, test.buckets)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Role is the permission level of a user. every role includes the permissions of the lower ones
+type Role string
+
+const (
+	RoleNone       Role = ""
+	RoleViewer     Role = "viewer"
+	RoleDownloader Role = "downloader"
+	RoleUploader   Role = "uploader"
+	RoleAdmin      Role = "admin"
+)
+
+var roleLevels = map[Role]int{
+	RoleNone:       0,
+	RoleViewer:     1,
+	RoleDownloader: 2,
+	RoleUploader:   3,
+	RoleAdmin:      4,
+}
+
+func (r Role) valid() bool {
+	_, ok := roleLevels[r]
+	return ok
+}
+
+// Includes checks whether r has at least the permissions of required
+func (r Role) Includes(required Role) bool {
+	return roleLevels[r] >= roleLevels[required]
+}
+
+// Grant gives a role on a bucket or on a prefix within the bucket
+type Grant struct {
+	Bucket string `toml:"bucket"`
+	Prefix string `toml:"prefix"`
+	Role   Role   `toml:"role"`
+}
+
+// matches checks whether key in bucket is covered by the grant. the prefix is matched by path elements
+func (g Grant) matches(bucket, key string) bool {
+	if g.Bucket != bucket {
+		return false
+	}
+	prefix := strings.Trim(g.Prefix, "/")
+	key = strings.Trim(key, "/")
+	return prefix == "" || key == prefix || strings.HasPrefix(key, prefix+"/")
+}
+
+// User is an account with a bcrypt hashed password
+type User struct {
+	Name     string  `toml:"name"`
+	Password string  `toml:"password"`
+	Role     Role    `toml:"role"`
+	Grants   []Grant `toml:"grant"`
+}
+
+// RoleFor returns the role of the user for key in bucket.
+// the grant with the longest prefix wins, the global role is used if no grant matches
+func (u *User) RoleFor(bucket, key string) Role {
+	if u == nil {
+		return RoleNone
+	}
+	role := u.Role
+	match := -1
+	for _, g := range u.Grants {
+		if !g.matches(bucket, key) {
+			continue
+		}
+		if l := len(strings.Trim(g.Prefix, "/")); l > match || (l == match && g.Role.Includes(role)) {
+			role, match = g.Role, l
+		}
+	}
+	return role
+}
+
+// grantsBelow checks whether a grant gives the user at least role for a part of bucket
+func (u *User) grantsBelow(bucket string, role Role) bool {
+	if u == nil {
+		return false
+	}
+	for _, g := range u.Grants {
+		if g.Bucket == bucket && g.Role.Includes(role) {
+			return true
+		}
+	}
+	return false
+}
+
+// authCacheTime is the time a verified password is kept, to avoid bcrypt on every request
+const authCacheTime = 5 * time.Minute
+
+// UserStore holds the user accounts
+type UserStore struct {
+	sync.Mutex
+	users    map[string]*User
+	verified map[[sha256.Size]byte]time.Time
+}
+
+func NewUserStore() *UserStore {
+	return &UserStore{
+		users:    map[string]*User{},
+		verified: map[[sha256.Size]byte]time.Time{},
+	}
+}
+
+// LoadUserStore reads the users from a toml file with a [[user]] table per account
+func LoadUserStore(filename string) (*UserStore, error) {
+	var data struct {
+		User []*User `toml:"user"`
+	}
+	if _, err := toml.DecodeFile(filename, &data); err != nil {
+		return nil, errors.Wrapf(err, "cannot load users from %s", filename)
+	}
+	us := NewUserStore()
+	for _, u := range data.User {
+		if err := us.Add(u); err != nil {
+			return nil, errors.Wrapf(err, "invalid user in %s", filename)
+		}
+	}
+	return us, nil
+}
+
+// clone returns a store with the same users and without verified passwords
+func (us *UserStore) clone() *UserStore {
+	c := NewUserStore()
+	for name, u := range us.all() {
+		c.users[name] = u
+	}
+	return c
+}
+
+// all returns the users by name
+func (us *UserStore) all() map[string]*User {
+	us.Lock()
+	defer us.Unlock()
+	users := make(map[string]*User, len(us.users))
+	for name, u := range us.users {
+		users[name] = u
+	}
+	return users
+}
+
+// Add adds or replaces a user
+func (us *UserStore) Add(u *User) error {
+	if u.Name == "" {
+		return errors.New("user without name")
+	}
+	if _, err := bcrypt.Cost([]byte(u.Password)); err != nil {
+		return errors.Wrapf(err, "password of user %s is no bcrypt hash", u.Name)
+	}
+	if !u.Role.valid() {
+		return errors.Errorf("invalid role %s of user %s", u.Role, u.Name)
+	}
+	for _, g := range u.Grants {
+		if g.Bucket == "" || !g.Role.valid() {
+			return errors.Errorf("invalid grant %v of user %s", g, u.Name)
+		}
+	}
+	us.Lock()
+	defer us.Unlock()
+	us.users[u.Name] = u
+	return nil
+}
+
+// AddPlain adds a user with a cleartext password
+func (us *UserStore) AddPlain(name, password string, role Role, grants ...Grant) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return errors.Wrapf(err, "cannot hash password of user %s", name)
+	}
+	return us.Add(&User{Name: name, Password: string(hash), Role: role, Grants: grants})
+}
+
+var (
+	dummyHashOnce  sync.Once
+	dummyHashValue []byte
+)
+
+// dummyHash is compared with the passwords of unknown users
+func dummyHash() []byte {
+	dummyHashOnce.Do(func() {
+		hash, err := bcrypt.GenerateFromPassword([]byte("s3image dummy password"), bcrypt.DefaultCost)
+		if err != nil {
+			panic(err)
+		}
+		dummyHashValue = hash
+	})
+	return dummyHashValue
+}
+
+// Authenticate returns the user, if the password is valid
+func (us *UserStore) Authenticate(name, password string) (*User, bool) {
+	us.Lock()
+	u, ok := us.users[name]
+	sum := sha256.Sum256([]byte(name + "\x00" + password + "\x00" + u.passwordHash()))
+	verified, cached := us.verified[sum]
+	us.Unlock()
+	if !ok {
+		// unknown users take as long as wrong passwords, the timing does not reveal user names
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return nil, false
+	}
+	if cached && time.Since(verified) < authCacheTime {
+		return u, true
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)); err != nil {
+		return nil, false
+	}
+	us.Lock()
+	for k, t := range us.verified {
+		if time.Since(t) >= authCacheTime {
+			delete(us.verified, k)
+		}
+	}
+	us.verified[sum] = time.Now()
+	us.Unlock()
+	return u, true
+}
+
+func (u *User) passwordHash() string {
+	if u == nil {
+		return ""
+	}
+	return u.Password
+}
+
+type userContextKey struct{}
+
+// userFromContext returns the authenticated user of the request or nil
+func userFromContext(ctx context.Context) *User {
+	u, _ := ctx.Value(userContextKey{}).(*User)
+	return u
+}
+
+// routeRoles is the role needed for the named routes
+var routeRoles = map[string]Role{
+	"index":        RoleViewer,
+	"book":         RoleViewer,
+	"thumb":        RoleViewer,
+	"page":         RoleViewer,
+	"view":         RoleViewer,
+	"profile":      RoleViewer,
+	"dzi":          RoleViewer,
+	"dzitile":      RoleViewer,
+	"zoom":         RoleViewer,
+	"contactsheet": RoleViewer,
+	"master":       RoleDownloader,
+	"zip":          RoleDownloader,
+	"bookpdf":      RoleDownloader,
+	"bookcbz":      RoleDownloader,
+	"upload":       RoleUploader,
+	"uploadform":   RoleUploader,
+	"delete":       RoleAdmin,
+	"copy":         RoleAdmin,
+	"move":         RoleAdmin,
+	"share":        RoleUploader,
+}
+
+// splitPath returns bucket and key of a route path
+func splitPath(path string) (bucket, key string) {
+	parts := strings.SplitN(strings.Trim(path, "/"), "/", 2)
+	bucket = parts[0]
+	if len(parts) > 1 {
+		key = parts[1]
+	}
+	return
+}
+
+// permitted checks whether the user of req has at least role for key in bucket
+func (s *Server) permitted(req *http.Request, bucket, key string, role Role) bool {
+	return userFromContext(req.Context()).RoleFor(bucket, key).Includes(role)
+}
+
+func (s *Server) unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="s3image"`)
+	if s.oidc != nil {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="s3image"`)
+	}
+	writeError(w, http.StatusUnauthorized, "Unauthorised.")
+}
+
+// authenticate returns the user of a bearer token, a login session or basic auth credentials
+func (s *Server) authenticate(req *http.Request) (*User, bool) {
+	if s.oidc != nil {
+		if user, ok := s.bearerUser(req); ok {
+			return user, user != nil
+		}
+		if user := s.sessionUser(req); user != nil {
+			return user, true
+		}
+	}
+	name, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, false
+	}
+	user, ok := s.current().users.Authenticate(name, password)
+	if !ok {
+		s.logger(req.Context()).Infof("authentication of user %s failed", name)
+	}
+	return user, ok
+}
+
+// serveBucketList authenticates the user of the bucket list, which is filtered by the grants and the acl rules.
+// anonymous users, who see no bucket, have to log in
+func (s *Server) serveBucketList(w http.ResponseWriter, req *http.Request, next http.Handler) {
+	ctx := context.WithValue(req.Context(), clientIPContextKey{}, clientIP(req))
+	user, ok := s.authenticate(req)
+	if ok {
+		ctx = context.WithValue(ctx, userContextKey{}, user)
+		requestInfoFromContext(ctx).setUser(user.Name)
+	} else if req.Header.Get("Authorization") != "" {
+		s.unauthorized(w)
+		return
+	} else if len(s.bucketEntries(ctx)) == 0 {
+		if !s.loginRedirect(w, req) {
+			s.unauthorized(w)
+		}
+		return
+	}
+	next.ServeHTTP(w, req.WithContext(ctx))
+}
+
+// folderRoutes are the routes, which address folders
+var folderRoutes = map[string]bool{
+	"index":        true,
+	"book":         true,
+	"zip":          true,
+	"bookpdf":      true,
+	"bookcbz":      true,
+	"contactsheet": true,
+}
+
+// authMiddleware authenticates the user and checks acl rules and the role needed for the route
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var routeName string
+		if route := mux.CurrentRoute(req); route != nil {
+			routeName = route.GetName()
+		}
+		required := routeRoles[routeName]
+		path := mux.Vars(req)["path"]
+		bucket, key := splitPath(path)
+		// the acl sidecars are not accessible by any route
+		if filepath.Base(key) == aclSidecar {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("cannot open file %s", path))
+			return
+		}
+		if bucket == "" && required != RoleNone && shareFromContext(req.Context()) == nil {
+			s.serveBucketList(w, req, next)
+			return
+		}
+		if _, ok := s.current().buckets[bucket]; required == RoleNone || !ok {
+			// bucket list, static content or unknown bucket
+			next.ServeHTTP(w, req)
+			return
+		}
+		folder := folderRoutes[routeName] || strings.HasSuffix(path, "/")
+		if sh := shareFromContext(req.Context()); sh != nil {
+			s.serveShared(w, req, next, sh, routeName, bucket, key, folder)
+			return
+		}
+		ctx := context.WithValue(req.Context(), clientIPContextKey{}, clientIP(req))
+		user, ok := s.authenticate(req)
+		if ok {
+			ctx = context.WithValue(ctx, userContextKey{}, user)
+			requestInfoFromContext(ctx).setUser(user.Name)
+		} else if req.Header.Get("Authorization") != "" {
+			// invalid credentials
+			s.unauthorized(w)
+			return
+		}
+		decision, err := s.aclDecide(ctx, bucket, key, folder, routeActions[routeName])
+		if err != nil {
+			s.aclError(w, req, bucket, key, err)
+			return
+		}
+		if decision == aclAllow {
+			next.ServeHTTP(w, req.WithContext(ctx))
+			return
+		}
+		if user == nil {
+			if !s.loginRedirect(w, req) {
+				s.unauthorized(w)
+			}
+			return
+		}
+		if decision == aclDeny {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("access to %s/%s denied for user %s", bucket, key, user.Name))
+			return
+		}
+		if !user.RoleFor(bucket, key).Includes(required) {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("user %s has no %s permission for %s/%s", user.Name, required, bucket, key))
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
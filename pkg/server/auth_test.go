@@ -0,0 +1,55 @@
+package server
+
+import "testing"
+
+func TestRoleFor(t *testing.T) {
+	u := &User{
+		Name: "tester",
+		Role: RoleViewer,
+		Grants: []Grant{
+			{Bucket: "photos", Role: RoleDownloader},
+			{Bucket: "photos", Prefix: "/private/", Role: RoleNone},
+			{Bucket: "photos", Prefix: "private/shared", Role: RoleUploader},
+			{Bucket: "docs", Prefix: "a", Role: RoleViewer},
+			{Bucket: "docs", Prefix: "a", Role: RoleAdmin},
+		},
+	}
+	tests := []struct {
+		bucket, key string
+		role        Role
+	}{
+		{"other", "x.jpg", RoleViewer},
+		{"photos", "", RoleDownloader},
+		{"photos", "x.jpg", RoleDownloader},
+		// the longest prefix wins, also with a lower role
+		{"photos", "private", RoleNone},
+		{"photos", "private/x.jpg", RoleNone},
+		{"photos", "/private/shared/x.jpg", RoleUploader},
+		// prefixes match path elements, not parts of names
+		{"photos", "privateer.jpg", RoleDownloader},
+		{"photos", "private/sharedfolder/x.jpg", RoleNone},
+		// the higher role of grants with the same prefix
+		{"docs", "a/b.pdf", RoleAdmin},
+		{"docs", "ab.pdf", RoleViewer},
+	}
+	for _, test := range tests {
+		if role := u.RoleFor(test.bucket, test.key); role != test.role {
+			t.Errorf("RoleFor(%q, %q) is %q, expected %q", test.bucket, test.key, role, test.role)
+		}
+	}
+	var nobody *User
+	if role := nobody.RoleFor("photos", "x.jpg"); role != RoleNone {
+		t.Errorf("nil user has role %q", role)
+	}
+}
+
+func TestRoleIncludes(t *testing.T) {
+	order := []Role{RoleNone, RoleViewer, RoleDownloader, RoleUploader, RoleAdmin}
+	for i, a := range order {
+		for j, b := range order {
+			if got := a.Includes(b); got != (i >= j) {
+				t.Errorf("%q.Includes(%q) is %v", a, b, got)
+			}
+		}
+	}
+}
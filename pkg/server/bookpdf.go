@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/je4/s3image/v2/pkg/media"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// PDFConfig defines the pdf export of book folders
+type PDFConfig struct {
+	// Profile of the page images, must produce jpeg
+	Profile string
+	// DPI of the page images
+	DPI float64
+	// Metadata adds the folder name as title
+	Metadata bool
+}
+
+// BookPDFHandler creates a pdf with one page per image of /{bucket}/{folder}
+func (s *Server) BookPDFHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	path := strings.Trim(vars["path"], "/")
+
+	parts := strings.SplitN(path, "/", 2)
+	if parts[0] == "" {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("invalid path %s", path))
+		return
+	}
+	var name = parts[0]
+	var folder string
+	if len(parts) >= 2 {
+		folder = parts[1]
+	}
+
+	_, ok := s.current().buckets[name]
+	if !ok {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("Bucket %s not available", name))
+		return
+	}
+
+	profile := s.current().pdf.Profile
+	if profile == "" {
+		profile = "page"
+	}
+	if opts, ok := defaultProfiles[profile]; !ok || opts.TargetFormat != "JPEG" {
+		s.logger(req.Context()).Errorf("pdf profile %s not available or no jpeg", profile)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("pdf profile %s not available or no jpeg", profile))
+		return
+	}
+
+	ctx := req.Context()
+	mode := s.sortMode(req, name, folder)
+	files, err := s.listSorted(ctx, name, folder, false, mode)
+	if err != nil {
+		s.logger(req.Context()).Infof("cannot read folder %s: %v", path, err)
+		writeError(w, http.StatusNotFound, fmt.Sprintf("cannot read folder %s: %v", path, err))
+		return
+	}
+	files = s.filterFiles(ctx, name, files, ACLDerivative, RoleDownloader)
+
+	// the pdf changes with the folder content
+	cachePrefix := fmt.Sprintf("%s/book.pdf/%s", path, mode)
+	cacheKey := fmt.Sprintf("%s/%s", cachePrefix, listingHash(files))
+	data, err := s.cacheGet(req.Context(), cacheKey)
+	if err != nil {
+		s.logger(req.Context()).Errorf("cannot read cache %v", err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("cannot read cache %v", err))
+		return
+	}
+	if data == nil {
+		var title string
+		if s.current().pdf.Metadata {
+			title = filepath.Base("/" + path)
+		}
+		buf := bytes.NewBuffer(nil)
+		pdf, err := media.NewPDFWriter(buf, title, s.current().pdf.DPI)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("cannot create pdf: %v", err))
+			return
+		}
+		for _, f := range files {
+			if err := ctx.Err(); err != nil {
+				s.logger(req.Context()).Infof("pdf creation of %s canceled: %v", path, err)
+				return
+			}
+			img, _, err := s.derivative(ctx, name, f.Key, profile, PriorityExport)
+			if err != nil {
+				s.logger(req.Context()).Infof("skipping %s/%s: %v", name, f.Key, err)
+				continue
+			}
+			if err := pdf.AddJPEG(img); err != nil {
+				s.logger(req.Context()).Infof("skipping %s/%s: %v", name, f.Key, err)
+				continue
+			}
+		}
+		if err := pdf.Close(); err != nil {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("cannot create pdf of %s: %v", path, err))
+			return
+		}
+		data = buf.Bytes()
+		// remove pdfs of older listings
+		if err := s.cacheInvalidate(cachePrefix); err != nil {
+			s.logger(req.Context()).Errorf("cannot invalidate cache: %v", err)
+		}
+		if err := s.cacheSet(req.Context(), cacheKey, data); err != nil {
+			s.logger(req.Context()).Errorf("cannot write pdf to cache: %v", err)
+		}
+	}
+	w.Header().Set("Content-type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s.pdf\"", filepath.Base("/"+path)))
+	w.Write(data)
+}
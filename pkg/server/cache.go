@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/je4/s3image/v2/pkg/tracing"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+	"time"
+)
+
+// cacheSetTTL writes an entry, which expires after ttl
+func (s *Server) cacheSetTTL(ctx context.Context, key string, data []byte, ttl time.Duration) (err error) {
+	_, span := tracer.Start(ctx, "cache.set", trace.WithAttributes(attribute.String("cache.key", key), attribute.Int("cache.size", len(data))))
+	defer func() { tracing.End(span, err) }()
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry([]byte(key), data).WithTTL(ttl))
+	}); err != nil {
+		return errors.Wrapf(err, "cannot write %s to cache", key)
+	}
+	return nil
+}
+
+// cacheDelete removes one entry
+func (s *Server) cacheDelete(key string) error {
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(key))
+	}); err != nil {
+		return errors.Wrapf(err, "cannot delete %s from cache", key)
+	}
+	return nil
+}
+
+// cacheInvalidate removes all derivatives of path (path/thumb, path/page, ...) from the cache
+func (s *Server) cacheInvalidate(path string) error {
+	prefix := []byte(path + "/")
+	var keys = [][]byte{}
+	if err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	}); err != nil {
+		return errors.Wrapf(err, "cannot iterate cache for %s", path)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, key := range keys {
+		if err := wb.Delete(key); err != nil {
+			return errors.Wrapf(err, "cannot delete %s from cache", string(key))
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return errors.Wrapf(err, "cannot flush cache deletes for %s", path)
+	}
+	s.log.Debugf("removed %d cache entries for %s", len(keys), path)
+	return nil
+}
+
+// cacheRekey moves (or copies if keep is true) all cache entries below src/ to dst/
+func (s *Server) cacheRekey(src, dst string, keep bool) error {
+	prefix := []byte(src + "/")
+	var entries = map[string][]byte{}
+	if err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			val, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return errors.Wrapf(err, "cannot read %s from cache", string(it.Item().Key()))
+			}
+			entries[string(it.Item().Key())] = val
+		}
+		return nil
+	}); err != nil {
+		return errors.Wrapf(err, "cannot iterate cache for %s", src)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for key, val := range entries {
+		newKey := dst + "/" + strings.TrimPrefix(key, string(prefix))
+		if err := wb.Set([]byte(newKey), val); err != nil {
+			return errors.Wrapf(err, "cannot write %s to cache", newKey)
+		}
+		if !keep {
+			if err := wb.Delete([]byte(key)); err != nil {
+				return errors.Wrapf(err, "cannot delete %s from cache", key)
+			}
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return errors.Wrapf(err, "cannot flush cache for %s", src)
+	}
+	s.log.Debugf("rekeyed %d cache entries from %s to %s", len(entries), src, dst)
+	return nil
+}
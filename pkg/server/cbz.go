@@ -0,0 +1,154 @@
+package server
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CBZConfig defines the comic book archive export of book folders
+type CBZConfig struct {
+	// Profile of the page images
+	Profile string
+}
+
+type comicInfoPage struct {
+	Image     int    `xml:"Image,attr"`
+	Type      string `xml:"Type,attr,omitempty"`
+	ImageSize int    `xml:"ImageSize,attr"`
+}
+
+// comicInfo is the ComicRack metadata of a cbz file
+type comicInfo struct {
+	XMLName   xml.Name        `xml:"ComicInfo"`
+	XSI       string          `xml:"xmlns:xsi,attr"`
+	XSD       string          `xml:"xmlns:xsd,attr"`
+	Title     string          `xml:"Title"`
+	Series    string          `xml:"Series,omitempty"`
+	Notes     string          `xml:"Notes,omitempty"`
+	Year      int             `xml:"Year,omitempty"`
+	Month     int             `xml:"Month,omitempty"`
+	Day       int             `xml:"Day,omitempty"`
+	PageCount int             `xml:"PageCount"`
+	Pages     []comicInfoPage `xml:"Pages>Page"`
+}
+
+// BookCBZHandler streams the images of /{bucket}/{folder} as comic book archive
+func (s *Server) BookCBZHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	path := strings.Trim(vars["path"], "/")
+
+	parts := strings.SplitN(path, "/", 2)
+	if parts[0] == "" {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("invalid path %s", path))
+		return
+	}
+	var name = parts[0]
+	var folder string
+	if len(parts) >= 2 {
+		folder = parts[1]
+	}
+
+	_, ok := s.current().buckets[name]
+	if !ok {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("Bucket %s not available", name))
+		return
+	}
+
+	profile := s.current().cbz.Profile
+	if profile == "" {
+		profile = "page"
+	}
+	opts, ok := defaultProfiles[profile]
+	if !ok {
+		s.logger(req.Context()).Errorf("cbz profile %s not available", profile)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("cbz profile %s not available", profile))
+		return
+	}
+	ext := strings.ToLower(opts.TargetFormat)
+	if ext == "jpeg" {
+		ext = "jpg"
+	}
+
+	ctx := req.Context()
+	files, err := s.listSorted(ctx, name, folder, false, s.sortMode(req, name, folder))
+	if err != nil {
+		s.logger(req.Context()).Infof("cannot read folder %s: %v", path, err)
+		writeError(w, http.StatusNotFound, fmt.Sprintf("cannot read folder %s: %v", path, err))
+		return
+	}
+	files = s.filterFiles(ctx, name, files, ACLDerivative, RoleDownloader)
+
+	title := filepath.Base("/" + path)
+	w.Header().Set("Content-type", "application/vnd.comicbook+zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.cbz\"", title))
+
+	info := comicInfo{
+		XSI:   "http://www.w3.org/2001/XMLSchema-instance",
+		XSD:   "http://www.w3.org/2001/XMLSchema",
+		Title: title,
+		Notes: fmt.Sprintf("%s/%s", s.addrExt, path),
+		Pages: []comicInfoPage{},
+	}
+	if dir := filepath.Dir("/" + path); dir != "/" {
+		info.Series = filepath.Base(dir)
+	}
+	var modTime time.Time
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			s.logger(req.Context()).Infof("cbz download of %s canceled: %v", path, err)
+			return
+		}
+		data, _, err := s.derivative(ctx, name, f.Key, profile, PriorityExport)
+		if err != nil {
+			s.logger(req.Context()).Infof("skipping %s/%s: %v", name, f.Key, err)
+			continue
+		}
+		if f.ModTime.After(modTime) {
+			modTime = f.ModTime
+		}
+		page := comicInfoPage{Image: len(info.Pages), ImageSize: len(data)}
+		if page.Image == 0 {
+			page.Type = "FrontCover"
+		}
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     fmt.Sprintf("%04d.%s", page.Image+1, ext),
+			Method:   zip.Store,
+			Modified: f.ModTime,
+		})
+		if err != nil {
+			s.logger(req.Context()).Errorf("cannot create cbz entry: %v", err)
+			return
+		}
+		if _, err := fw.Write(data); err != nil {
+			s.logger(req.Context()).Errorf("cannot write %s/%s to cbz: %v", name, f.Key, err)
+			return
+		}
+		info.Pages = append(info.Pages, page)
+	}
+	info.PageCount = len(info.Pages)
+	if !modTime.IsZero() {
+		info.Year, info.Month, info.Day = modTime.Year(), int(modTime.Month()), modTime.Day()
+	}
+	fw, err := zw.Create("ComicInfo.xml")
+	if err != nil {
+		s.logger(req.Context()).Errorf("cannot create ComicInfo.xml: %v", err)
+		return
+	}
+	fw.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(fw)
+	enc.Indent("", "  ")
+	if err := enc.Encode(info); err != nil {
+		s.logger(req.Context()).Errorf("cannot write ComicInfo.xml: %v", err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		s.logger(req.Context()).Errorf("cannot finish cbz of %s: %v", path, err)
+	}
+}
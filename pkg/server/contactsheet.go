@@ -0,0 +1,220 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/je4/s3image/v2/pkg/media"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// queryInt returns the integer query parameter name within min and max or def
+func queryInt(req *http.Request, name string, def, min, max int64) int64 {
+	str := req.URL.Query().Get(name)
+	if str == "" {
+		return def
+	}
+	val, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return def
+	}
+	if val < min {
+		return min
+	}
+	if val > max {
+		return max
+	}
+	return val
+}
+
+// contactSheetCellSizes are the possible cell sizes, other sizes are rounded up.
+// every layout is a new cache entry
+var contactSheetCellSizes = []int64{64, 100, 128, 200, 256, 300, 400, 512, 768, 1024}
+
+// snapCellSize rounds size up to the next cell size
+func snapCellSize(size int64) int64 {
+	for _, s := range contactSheetCellSizes {
+		if size <= s {
+			return s
+		}
+	}
+	return contactSheetCellSizes[len(contactSheetCellSizes)-1]
+}
+
+// ContactSheetHandler renders the thumbnails of /{bucket}/{folder} as grid image or pdf.
+// query parameters: columns, width, height (cell size, see contactSheetCellSizes), margin, fontsize, format (jpeg, png, pdf), rows (rows per pdf page or image).
+// a jpeg or png sheet has at most rows rows, the other images are on the sheets ?page=2...
+func (s *Server) ContactSheetHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	path := strings.Trim(vars["path"], "/")
+
+	parts := strings.SplitN(path, "/", 2)
+	if parts[0] == "" {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("invalid path %s", path))
+		return
+	}
+	var name = parts[0]
+	var folder string
+	if len(parts) >= 2 {
+		folder = parts[1]
+	}
+
+	_, ok := s.current().buckets[name]
+	if !ok {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("Bucket %s not available", name))
+		return
+	}
+
+	format := strings.ToLower(req.URL.Query().Get("format"))
+	var mimetype, targetFormat string
+	switch format {
+	case "", "jpg", "jpeg":
+		format, mimetype, targetFormat = "jpeg", "image/jpeg", "JPEG"
+	case "png":
+		mimetype, targetFormat = "image/png", "PNG"
+	case "pdf":
+		mimetype, targetFormat = "application/pdf", "JPEG"
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown format %s", format))
+		return
+	}
+	cellWidth := snapCellSize(queryInt(req, "width", 200, 32, 1024))
+	opts := media.ContactSheetOptions{
+		Columns:      int(queryInt(req, "columns", 5, 1, 20)),
+		CellWidth:    cellWidth,
+		CellHeight:   snapCellSize(queryInt(req, "height", cellWidth, 32, 1024)),
+		Margin:       queryInt(req, "margin", 10, 0, 200),
+		FontSize:     float64(queryInt(req, "fontsize", 12, 0, 72)),
+		TargetFormat: targetFormat,
+	}
+	var rowsPerPage int64
+	if format == "pdf" {
+		rowsPerPage = queryInt(req, "rows", 6, 1, 50)
+	} else {
+		rowsPerPage = queryInt(req, "rows", 20, 1, 50)
+	}
+	if max := opts.MaxRows(); rowsPerPage > max {
+		rowsPerPage = max
+	}
+
+	ctx := req.Context()
+	mode := s.sortMode(req, name, folder)
+	files, err := s.listSorted(ctx, name, folder, false, mode)
+	if err != nil {
+		s.logger(req.Context()).Infof("cannot read folder %s: %v", path, err)
+		writeError(w, http.StatusNotFound, fmt.Sprintf("cannot read folder %s: %v", path, err))
+		return
+	}
+	files = s.filterFiles(ctx, name, files, ACLDerivative, RoleViewer)
+
+	// the height of jpeg and png sheets is limited, larger folders are split into pages
+	page := 1
+	if format != "pdf" {
+		perPage := int(rowsPerPage) * opts.Columns
+		pages := (len(files) + perPage - 1) / perPage
+		if pages < 1 {
+			pages = 1
+		}
+		page = int(queryInt(req, "page", 1, 1, int64(pages)))
+		if page > 1 {
+			w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"prev\"", pageQuery(req, page-1)))
+		}
+		if page < pages {
+			w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"next\"", pageQuery(req, page+1)))
+		}
+		start := (page - 1) * perPage
+		end := start + perPage
+		if end > len(files) {
+			end = len(files)
+		}
+		files = files[start:end]
+	}
+
+	// the contact sheet changes with the layout and the folder content
+	cachePrefix := fmt.Sprintf("%s/contactsheet/%s-%s-%d-%d-%d-%d-%d-%d-%d", path, mode, format, opts.Columns, opts.CellWidth, opts.CellHeight, opts.Margin, int(opts.FontSize), rowsPerPage, page)
+	cacheKey := fmt.Sprintf("%s/%s", cachePrefix, listingHash(files))
+	data, err := s.cacheGet(req.Context(), cacheKey)
+	if err != nil {
+		s.logger(req.Context()).Errorf("cannot read cache %v", err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("cannot read cache %v", err))
+		return
+	}
+	if data == nil {
+		var cells = []media.ContactSheetCell{}
+		for _, f := range files {
+			if err := ctx.Err(); err != nil {
+				s.logger(req.Context()).Infof("contact sheet of %s canceled: %v", path, err)
+				return
+			}
+			thumb, _, err := s.derivative(ctx, name, f.Key, "thumb", PriorityExport)
+			if err != nil {
+				s.logger(req.Context()).Infof("skipping %s/%s: %v", name, f.Key, err)
+				continue
+			}
+			cells = append(cells, media.ContactSheetCell{Image: thumb, Caption: filepath.Base(f.Key)})
+		}
+		if len(cells) == 0 {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("no images in %s", path))
+			return
+		}
+		if format == "pdf" {
+			buf := bytes.NewBuffer(nil)
+			pdf, err := media.NewPDFWriter(buf, filepath.Base("/"+path), 72)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, fmt.Sprintf("cannot create pdf: %v", err))
+				return
+			}
+			perPage := int(rowsPerPage) * opts.Columns
+			for start := 0; start < len(cells); start += perPage {
+				end := start + perPage
+				if end > len(cells) {
+					end = len(cells)
+				}
+				page, err := s.contactSheet(ctx, name, cells[start:end], opts)
+				if err == nil {
+					err = pdf.AddJPEG(page)
+				}
+				if err != nil {
+					s.logger(req.Context()).Errorf("cannot create contact sheet of %s: %v", path, err)
+					writeError(w, http.StatusInternalServerError, fmt.Sprintf("cannot create contact sheet of %s: %v", path, err))
+					return
+				}
+			}
+			if err := pdf.Close(); err != nil {
+				writeError(w, http.StatusInternalServerError, fmt.Sprintf("cannot create pdf: %v", err))
+				return
+			}
+			data = buf.Bytes()
+		} else {
+			data, err = s.contactSheet(ctx, name, cells, opts)
+			if err != nil {
+				s.logger(req.Context()).Errorf("cannot create contact sheet of %s: %v", path, err)
+				writeError(w, http.StatusInternalServerError, fmt.Sprintf("cannot create contact sheet of %s: %v", path, err))
+				return
+			}
+		}
+		// remove sheets of older listings
+		if err := s.cacheInvalidate(cachePrefix); err != nil {
+			s.logger(req.Context()).Errorf("cannot invalidate cache: %v", err)
+		}
+		if err := s.cacheSet(req.Context(), cacheKey, data); err != nil {
+			s.logger(req.Context()).Errorf("cannot write contact sheet to cache: %v", err)
+		}
+	}
+	w.Header().Set("Content-type", mimetype)
+	w.Write(data)
+}
+
+// contactSheet composes the cells in the transform pool
+func (s *Server) contactSheet(ctx context.Context, bucket string, cells []media.ContactSheetCell, opts media.ContactSheetOptions) ([]byte, error) {
+	release, err := s.acquireTransform(ctx, bucket, PriorityExport, "contactsheet", opts.TargetFormat)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return s.images.ContactSheet(ctx, cells, opts)
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/je4/s3image/v2/pkg/media"
+	"github.com/je4/s3image/v2/pkg/tracing"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strings"
+)
+
+// defaultProfiles are the derivatives, which can be created from a master
+var defaultProfiles = map[string]media.ImageOptions{
+	"thumb": {
+		Width:        359,
+		Height:       225,
+		ActionType:   media.ResizeActionTypeKeep,
+		TargetFormat: "JPEG",
+	},
+	"page": {
+		Width:        600,
+		Height:       800,
+		ActionType:   media.ResizeActionTypeKeep,
+		TargetFormat: "JPEG",
+	},
+	"view": {
+		Width:        1600,
+		Height:       1600,
+		ActionType:   media.ResizeActionTypeKeep,
+		TargetFormat: "JPEG",
+	},
+}
+
+var formatMimetypes = map[string]string{
+	"JPEG": "image/jpeg",
+	"PNG":  "image/png",
+	"GIF":  "image/gif",
+	"WEBP": "image/webp",
+	"TIFF": "image/tiff",
+}
+
+func profileMimetype(opts media.ImageOptions) string {
+	if mt, ok := formatMimetypes[opts.TargetFormat]; ok {
+		return mt
+	}
+	return "application/octet-stream"
+}
+
+type openError struct {
+	err error
+}
+
+func (oe *openError) Error() string {
+	return oe.err.Error()
+}
+
+// cacheGet returns the cached value of key or nil and counts the lookup in the metrics
+func (s *Server) cacheGet(ctx context.Context, key string) ([]byte, error) {
+	data, err := s.cacheRead(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	s.cacheResult(ctx, key, data != nil)
+	return data, nil
+}
+
+// cacheResult records a cache lookup in the metrics and the request log
+func (s *Server) cacheResult(ctx context.Context, key string, hit bool) {
+	s.metrics.cacheResult(key, hit)
+	if !strings.HasPrefix(key, "_") {
+		requestInfoFromContext(ctx).setCache(hit)
+	}
+}
+
+// cacheRead returns the cached value of key or nil
+func (s *Server) cacheRead(ctx context.Context, key string) (data []byte, err error) {
+	_, span := tracer.Start(ctx, "cache.get", trace.WithAttributes(attribute.String("cache.key", key)))
+	defer func() {
+		span.SetAttributes(attribute.Bool("cache.hit", data != nil))
+		tracing.End(span, err)
+	}()
+	if err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			if err != badger.ErrKeyNotFound {
+				return errors.Wrapf(err, "cannot get %s from cache", key)
+			}
+			return nil
+		}
+		data, err = item.ValueCopy(nil)
+		if err != nil {
+			return errors.Wrapf(err, "cannot get value for %s from cache", key)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *Server) cacheSet(ctx context.Context, key string, data []byte) (err error) {
+	_, span := tracer.Start(ctx, "cache.set", trace.WithAttributes(attribute.String("cache.key", key), attribute.Int("cache.size", len(data))))
+	defer func() { tracing.End(span, err) }()
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), data)
+	}); err != nil {
+		return errors.Wrapf(err, "cannot write %s to cache", key)
+	}
+	return nil
+}
+
+// derivative returns the profile derivative of bucket/key from cache or creates it in the transform pool
+func (s *Server) derivative(ctx context.Context, bucket, key, profile string, priority TransformPriority) ([]byte, string, error) {
+	requestInfoFromContext(ctx).setProfile(profile)
+	opts, ok := defaultProfiles[profile]
+	if !ok {
+		return nil, "", errors.Errorf("unknown profile %s", profile)
+	}
+	mimetype := profileMimetype(opts)
+	cacheKey := fmt.Sprintf("%s/%s/%s", bucket, key, profile)
+	data, err := s.cacheGet(ctx, cacheKey)
+	if err != nil {
+		return nil, "", err
+	}
+	if data != nil {
+		return data, mimetype, nil
+	}
+	// concurrent requests for the same derivative share one transformation
+	data, err = s.flights.do(ctx, cacheKey, func(ctx context.Context) ([]byte, error) {
+		return s.createDerivative(ctx, bucket, key, profile, cacheKey, opts, priority)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return data, mimetype, nil
+}
+
+// createDerivative transforms bucket/key in the transform pool and stores the result in the cache
+func (s *Server) createDerivative(ctx context.Context, bucket, key, profile, cacheKey string, opts media.ImageOptions, priority TransformPriority) ([]byte, error) {
+	// another generation may have finished after the cache lookup of the caller
+	data, err := s.cacheRead(ctx, cacheKey)
+	if err != nil || data != nil {
+		return data, err
+	}
+
+	release, err := s.acquireTransform(ctx, bucket, priority, profile, opts.TargetFormat)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot create %s", cacheKey)
+	}
+	defer release()
+
+	master, _, err := s.readImage(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = s.images.Derivative(ctx, master, opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot transform image %s/%s", bucket, key)
+	}
+	if err := s.cacheSet(ctx, cacheKey, data); err != nil {
+		return nil, errors.Wrap(err, "cannot output image to cache")
+	}
+	return data, nil
+}
+
+// serveDerivative writes the profile derivative of bucket/key to w
+func (s *Server) serveDerivative(w http.ResponseWriter, req *http.Request, bucket, key, profile string) {
+	data, mimetype, err := s.derivative(req.Context(), bucket, key, profile, profilePriority(profile))
+	if err != nil {
+		if s.transformBusy(w, err) || s.inputRejected(w, req, err) {
+			return
+		}
+		if _, ok := errors.Cause(err).(*openError); ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("cannot open file %s/%s", bucket, key))
+			return
+		}
+		s.logger(req.Context()).Errorf("cannot create %s of %s/%s: %v", profile, bucket, key, err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("cannot create %s of %s/%s: %v", profile, bucket, key, err))
+		return
+	}
+	w.Header().Set("Content-type", mimetype)
+	w.Write(data)
+}
+
+// serveFolderThumb writes the cover thumb of bucket/folder to w
+func (s *Server) serveFolderThumb(w http.ResponseWriter, req *http.Request, bucket, folder string) {
+	data, mimetype, err := s.folderThumb(req.Context(), bucket, folder)
+	if err != nil {
+		if s.transformBusy(w, err) || s.inputRejected(w, req, err) {
+			return
+		}
+		if _, ok := errors.Cause(err).(*openError); ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("no thumb for folder %s/%s", bucket, folder))
+			return
+		}
+		s.logger(req.Context()).Errorf("cannot create thumb of folder %s/%s: %v", bucket, folder, err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("cannot create thumb of folder %s/%s: %v", bucket, folder, err))
+		return
+	}
+	w.Header().Set("Content-type", mimetype)
+	w.Write(data)
+}
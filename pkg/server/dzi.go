@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/je4/s3image/v2/pkg/media"
+	"github.com/pkg/errors"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const dziTileSize = 254
+const dziOverlap = 1
+
+// dziBlock is the number of columns and rows of tiles, which are created together
+const dziBlock = 8
+
+var dziFormats = map[string]string{
+	"jpg":  "JPEG",
+	"jpeg": "JPEG",
+	"png":  "PNG",
+}
+
+type dziSize struct {
+	Width  int64 `xml:"Width,attr"`
+	Height int64 `xml:"Height,attr"`
+}
+
+type dziImage struct {
+	XMLName  xml.Name `xml:"http://schemas.microsoft.com/deepzoom/2008 Image"`
+	Format   string   `xml:"Format,attr"`
+	Overlap  int      `xml:"Overlap,attr"`
+	TileSize int      `xml:"TileSize,attr"`
+	Size     dziSize  `xml:"Size"`
+}
+
+// dziCheck checks the bucket and splits the path into bucket and key
+func (s *Server) dziCheck(w http.ResponseWriter, req *http.Request) (name, key string, ok bool) {
+	vars := mux.Vars(req)
+	path := strings.Trim(vars["path"], "/")
+
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) < 2 || parts[1] == "" {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("invalid path %s", path))
+		return "", "", false
+	}
+	name = parts[0]
+	key = parts[1]
+
+	_, ok = s.current().buckets[name]
+	if !ok {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("Bucket %s not available", name))
+		return "", "", false
+	}
+	return name, key, true
+}
+
+// DZIHandler returns the deep zoom descriptor of /{bucket}/{path}
+func (s *Server) DZIHandler(w http.ResponseWriter, req *http.Request) {
+	name, key, ok := s.dziCheck(w, req)
+	if !ok {
+		return
+	}
+	meta, err := s.imageMeta(req.Context(), name, key)
+	if err != nil {
+		if _, ok := errors.Cause(err).(*openError); ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("cannot open file %s/%s", name, key))
+			return
+		}
+		s.logger(req.Context()).Errorf("cannot identify %s/%s: %v", name, key, err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("cannot identify %s/%s: %v", name, key, err))
+		return
+	}
+	w.Header().Set("Content-type", "application/xml")
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(dziImage{
+		Format:   "jpg",
+		Overlap:  dziOverlap,
+		TileSize: dziTileSize,
+		Size:     dziSize{Width: meta.Width, Height: meta.Height},
+	}); err != nil {
+		s.logger(req.Context()).Errorf("cannot write dzi descriptor: %v", err)
+	}
+}
+
+// DZITileHandler returns the tile /{bucket}/{path}/dzi_files/{level}/{col}_{row}.{format}.
+// the tiles of a block of dziBlock x dziBlock tiles are created and cached at once
+func (s *Server) DZITileHandler(w http.ResponseWriter, req *http.Request) {
+	name, key, ok := s.dziCheck(w, req)
+	if !ok {
+		return
+	}
+	vars := mux.Vars(req)
+	level, _ := strconv.Atoi(vars["level"])
+	col, _ := strconv.Atoi(vars["col"])
+	row, _ := strconv.Atoi(vars["row"])
+	format := vars["format"]
+	targetFormat, ok := dziFormats[format]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown format %s", format))
+		return
+	}
+	mimetype := formatMimetypes[targetFormat]
+
+	tileKey := func(c, r int) string {
+		return fmt.Sprintf("%s/%s/dzi/%d/%d_%d.%s", name, key, level, c, r, format)
+	}
+	data, err := s.cacheGet(req.Context(), tileKey(col, row))
+	if err != nil {
+		s.logger(req.Context()).Errorf("cannot read cache %v", err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("cannot read cache %v", err))
+		return
+	}
+	if data == nil {
+		if !s.dziTileExists(w, req, name, key, level, col, row) {
+			return
+		}
+		// all requests for tiles of the block share one transformation
+		region := media.DZIRegion{Col: col - col%dziBlock, Row: row - row%dziBlock, Cols: dziBlock, Rows: dziBlock}
+		blockKey := fmt.Sprintf("%s/%s/dzi/%d/%d_%d/%s", name, key, level, region.Col, region.Row, format)
+		_, err := s.flights.do(req.Context(), blockKey, func(ctx context.Context) ([]byte, error) {
+			return nil, s.createDZIBlock(ctx, name, key, level, targetFormat, region, tileKey)
+		})
+		if err != nil {
+			if s.transformBusy(w, err) || s.inputRejected(w, req, err) {
+				return
+			}
+			if _, ok := errors.Cause(err).(*openError); ok {
+				writeError(w, http.StatusNotFound, fmt.Sprintf("cannot open file %s/%s", name, key))
+				return
+			}
+			s.logger(req.Context()).Errorf("cannot create tiles of %s/%s level %d: %v", name, key, level, err)
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("cannot create tiles of %s/%s level %d: %v", name, key, level, err))
+			return
+		}
+		if data, err = s.cacheRead(req.Context(), tileKey(col, row)); err != nil || data == nil {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("no tile %d_%d at level %d", col, row, level))
+			return
+		}
+	}
+	w.Header().Set("Content-type", mimetype)
+	w.Write(data)
+}
+
+// dziTileExists checks the tile against the size of the level without a transformation
+func (s *Server) dziTileExists(w http.ResponseWriter, req *http.Request, name, key string, level, col, row int) bool {
+	meta, err := s.imageMeta(req.Context(), name, key)
+	if err != nil {
+		if _, ok := errors.Cause(err).(*openError); ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("cannot open file %s/%s", name, key))
+			return false
+		}
+		s.logger(req.Context()).Errorf("cannot identify %s/%s: %v", name, key, err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("cannot identify %s/%s: %v", name, key, err))
+		return false
+	}
+	maxLevel := media.DZIMaxLevel(meta.Width, meta.Height)
+	if level <= maxLevel {
+		lw, lh := media.DZILevelSize(meta.Width, meta.Height, level, maxLevel)
+		if int64(col*dziTileSize) < lw && int64(row*dziTileSize) < lh {
+			return true
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Sprintf("no tile %d_%d at level %d", col, row, level))
+	return false
+}
+
+// createDZIBlock creates the tiles of region in the transform pool and stores them in the cache
+func (s *Server) createDZIBlock(ctx context.Context, bucket, key string, level int, targetFormat string, region media.DZIRegion, tileKey func(c, r int) string) error {
+	// another generation may have finished after the cache lookup of the caller
+	if data, err := s.cacheRead(ctx, tileKey(region.Col, region.Row)); err != nil || data != nil {
+		return err
+	}
+	release, err := s.acquireTransform(ctx, bucket, PriorityAdhoc, "dzi", targetFormat)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create tiles of %s/%s level %d", bucket, key, level)
+	}
+	defer release()
+	master, _, err := s.readImage(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	tiles, err := s.images.Tiles(ctx, master, level, dziTileSize, dziOverlap, targetFormat, region)
+	if err != nil {
+		return errors.Wrapf(err, "cannot create tiles of %s/%s level %d", bucket, key, level)
+	}
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, tile := range tiles {
+		if err := wb.Set([]byte(tileKey(tile.Col, tile.Row)), tile.Data); err != nil {
+			return errors.Wrap(err, "cannot write tiles to cache")
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return errors.Wrap(err, "cannot write tiles to cache")
+	}
+	return nil
+}
+
+// ZoomHandler shows /{bucket}/{path} in a deep zoom viewer
+func (s *Server) ZoomHandler(w http.ResponseWriter, req *http.Request) {
+	name, key, ok := s.dziCheck(w, req)
+	if !ok {
+		return
+	}
+	tpl, ok := s.current().templates["zoom"]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no zoom template")
+		return
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := tpl.Execute(buf, struct {
+		BasePath string
+		Path     string
+		Name     string
+	}{s.basePath(req), fmt.Sprintf("%s/%s", name, key), filepath.Base(key)}); err != nil {
+		s.logger(req.Context()).Errorf("error executing zoom template: %v", err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("error executing zoom template: %v", err))
+		return
+	}
+	w.Header().Set("Content-type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
@@ -4,9 +4,15 @@ import "embed"
 
 //go:embed template/index.gohtml
 //go:embed template/pamphlet.gohtml
+//go:embed template/image.gohtml
+//go:embed template/zoom.gohtml
+//go:embed template/shares.gohtml
 var templateFS embed.FS
 
 var templateFiles = map[string]string{
 	"index":    "template/index.gohtml",
 	"pamphlet": "template/pamphlet.gohtml",
+	"image":    "template/image.gohtml",
+	"zoom":     "template/zoom.gohtml",
+	"shares":   "template/shares.gohtml",
 }
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/trace"
+	"sync"
+)
+
+// flightCall is a running generation, which is shared by all requests for the same key
+type flightCall struct {
+	done    chan struct{}
+	data    []byte
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// flightGroup coalesces concurrent generations of the same cache key
+type flightGroup struct {
+	sync.Mutex
+	calls map[string]*flightCall
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: map[string]*flightCall{}}
+}
+
+// do runs fn once for all concurrent callers with the same key. fn gets its own context,
+// which is canceled when the last caller gave up. every caller may cancel independently via ctx
+func (fg *flightGroup) do(ctx context.Context, key string, fn func(ctx context.Context) ([]byte, error)) ([]byte, error) {
+	fg.Lock()
+	c, ok := fg.calls[key]
+	if !ok {
+		// the generation is traced as child of the first caller
+		fctx, cancel := context.WithCancel(trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx)))
+		c = &flightCall{done: make(chan struct{}), cancel: cancel}
+		fg.calls[key] = c
+		go func() {
+			c.data, c.err = fn(fctx)
+			fg.Lock()
+			if fg.calls[key] == c {
+				delete(fg.calls, key)
+			}
+			fg.Unlock()
+			cancel()
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	fg.Unlock()
+
+	select {
+	case <-c.done:
+		return c.data, c.err
+	case <-ctx.Done():
+		fg.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// nobody waits anymore, later callers start a new generation
+			c.cancel()
+			if fg.calls[key] == c {
+				delete(fg.calls, key)
+			}
+		}
+		fg.Unlock()
+		return nil, ctx.Err()
+	}
+}
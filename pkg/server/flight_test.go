@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupShared(t *testing.T) {
+	fg := newFlightGroup()
+	var calls int32
+	start := make(chan struct{})
+	fn := func(ctx context.Context) ([]byte, error) {
+		atomic.AddInt32(&calls, 1)
+		<-start
+		return []byte("data"), nil
+	}
+	var wg sync.WaitGroup
+	results := make([][]byte, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, err := fg.do(context.Background(), "key", fn)
+			if err != nil {
+				t.Errorf("caller %d: %v", i, err)
+			}
+			results[i] = data
+		}(i)
+	}
+	// all callers wait for the first generation
+	waitFor(t, func() bool {
+		fg.Lock()
+		defer fg.Unlock()
+		c := fg.calls["key"]
+		return c != nil && c.waiters == len(results)
+	})
+	close(start)
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("fn called %d times, expected 1", n)
+	}
+	for i, data := range results {
+		if string(data) != "data" {
+			t.Errorf("caller %d got %q", i, data)
+		}
+	}
+	if len(fg.calls) != 0 {
+		t.Errorf("%d calls left after the generation", len(fg.calls))
+	}
+}
+
+func TestFlightGroupCancel(t *testing.T) {
+	fg := newFlightGroup()
+	canceled := make(chan struct{})
+	fn := func(ctx context.Context) ([]byte, error) {
+		<-ctx.Done()
+		close(canceled)
+		return nil, ctx.Err()
+	}
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() { _, err := fg.do(ctx1, "key", fn); errs <- err }()
+	go func() { _, err := fg.do(ctx2, "key", fn); errs <- err }()
+	waitFor(t, func() bool {
+		fg.Lock()
+		defer fg.Unlock()
+		c := fg.calls["key"]
+		return c != nil && c.waiters == 2
+	})
+
+	// the generation goes on as long as one caller waits
+	cancel1()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("first caller got %v", err)
+	}
+	select {
+	case <-canceled:
+		t.Fatalf("generation canceled with a waiting caller")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	cancel2()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("second caller got %v", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatalf("generation not canceled after the last caller")
+	}
+	fg.Lock()
+	defer fg.Unlock()
+	if len(fg.calls) != 0 {
+		t.Errorf("canceled call is still registered")
+	}
+}
+
+func TestFlightGroupNewAfterCancel(t *testing.T) {
+	fg := newFlightGroup()
+	block := make(chan struct{})
+	defer close(block)
+	ctx, cancel := context.WithCancel(context.Background())
+	go fg.do(ctx, "key", func(ctx context.Context) ([]byte, error) {
+		<-block
+		return []byte("old"), nil
+	})
+	waitFor(t, func() bool {
+		fg.Lock()
+		defer fg.Unlock()
+		return fg.calls["key"] != nil
+	})
+	cancel()
+	waitFor(t, func() bool {
+		fg.Lock()
+		defer fg.Unlock()
+		return fg.calls["key"] == nil
+	})
+	// the abandoned generation does not answer later callers
+	data, err := fg.do(context.Background(), "key", func(ctx context.Context) ([]byte, error) {
+		return []byte("new"), nil
+	})
+	if err != nil || string(data) != "new" {
+		t.Errorf("got %q, %v instead of a new generation", data, err)
+	}
+}
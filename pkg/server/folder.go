@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/fs"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// folderFile is a file within a folder listing with the key relative to the bucket
+type folderFile struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	ETag    string
+	IsDir   bool
+}
+
+type etagger interface {
+	ETag() string
+}
+
+// listingHash combines the etags of all files to a key, which changes with the listing
+func listingHash(files []folderFile) string {
+	h := sha256.New()
+	for _, f := range files {
+		etag := f.ETag
+		if etag == "" {
+			etag = fmt.Sprintf("%d-%d", f.Size, f.ModTime.UnixNano())
+		}
+		fmt.Fprintf(h, "%s:%s\n", f.Key, etag)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// dirEntryFile converts an entry of a FileList
+func dirEntryFile(bucket string, e fs.DirEntry) folderFile {
+	ff := folderFile{
+		Key:   strings.Trim(strings.TrimPrefix(e.Name(), bucket+"/"), "/"),
+		IsDir: e.IsDir(),
+	}
+	if ff.IsDir {
+		return ff
+	}
+	if info, err := e.Info(); err == nil {
+		ff.Size = info.Size()
+		ff.ModTime = info.ModTime()
+		if et, ok := info.(etagger); ok {
+			ff.ETag = et.ETag()
+		}
+	}
+	return ff
+}
+
+// listFiles returns all files in bucket/folder. subfolders are included, if recursive is set
+func (s *Server) listFiles(ctx context.Context, bucket, folder string, recursive bool) ([]folderFile, error) {
+	folder = strings.Trim(folder, "/")
+	de, err := s.files(ctx).FileList(bucket, folder)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read folder %s/%s", bucket, folder)
+	}
+	var result = []folderFile{}
+	for _, e := range de {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		ff := dirEntryFile(bucket, e)
+		if ff.IsDir {
+			if !recursive {
+				continue
+			}
+			sub, err := s.listFiles(ctx, bucket, ff.Key, recursive)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, sub...)
+			continue
+		}
+		result = append(result, ff)
+	}
+	return result, nil
+}
+
+// listSorted returns the visible files of bucket/folder in the order of mode
+func (s *Server) listSorted(ctx context.Context, bucket, folder string, recursive bool, mode string) ([]folderFile, error) {
+	files, err := s.listFiles(ctx, bucket, folder, recursive)
+	if err != nil {
+		return nil, err
+	}
+	files = s.filterFiles(ctx, bucket, files, ACLRead, RoleViewer)
+	s.sortFiles(ctx, bucket, mode, files)
+	return files, nil
+}
+
+// ctxReader stops reading as soon as the context is done
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr ctxReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+func closeReader(r io.Reader) {
+	if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// naturalLess compares strings with embedded numbers by their numeric value (page2 < page10).
+// names, which differ only in case, are ordered bytewise
+func naturalLess(a, b string) bool {
+	origA, origB := a, b
+	for a != "" && b != "" {
+		ca, cb := a[0], b[0]
+		if isDigit(ca) && isDigit(cb) {
+			na, ra := splitNumber(a)
+			nb, rb := splitNumber(b)
+			ta, tb := strings.TrimLeft(na, "0"), strings.TrimLeft(nb, "0")
+			if len(ta) != len(tb) {
+				return len(ta) < len(tb)
+			}
+			if ta != tb {
+				return ta < tb
+			}
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			a, b = ra, rb
+			continue
+		}
+		la, lb := unicode.ToLower(rune(ca)), unicode.ToLower(rune(cb))
+		if la != lb {
+			return la < lb
+		}
+		a, b = a[1:], b[1:]
+	}
+	if len(a) == len(b) {
+		return origA < origB
+	}
+	return len(a) < len(b)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func splitNumber(s string) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return s[:i], s[i:]
+}
@@ -0,0 +1,43 @@
+package server
+
+import "testing"
+
+func TestNaturalLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		less bool
+	}{
+		{"page2", "page10", true},
+		{"page10", "page2", false},
+		{"page9.jpg", "page10.jpg", true},
+		{"2", "10", true},
+		// leading zeros do not change the value, fewer zeros first
+		{"page007", "page10", true},
+		{"page010", "page9", false},
+		{"page2", "page02", true},
+		{"page02", "page2", false},
+		{"page00", "page0", false},
+		// mixed case
+		{"Page2", "page10", true},
+		{"page10", "Page2", false},
+		{"a", "B", true},
+		{"B", "a", false},
+		{"A.jpg", "a.jpg", true},
+		{"a.jpg", "A.jpg", false},
+		// equal numeric prefixes
+		{"10a", "10b", true},
+		{"10b", "10a", false},
+		{"img1", "img1a", true},
+		{"img1a", "img1", false},
+		{"img1-2", "img1-10", true},
+		{"vol2-page10", "vol10-page2", true},
+		{"same", "same", false},
+		{"", "a", true},
+		{"a", "", false},
+	}
+	for _, test := range tests {
+		if less := naturalLess(test.a, test.b); less != test.less {
+			t.Errorf("naturalLess(%q, %q) is %v", test.a, test.b, less)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/je4/s3image/v2/pkg/media"
+	"github.com/pkg/errors"
+	"path/filepath"
+	"strings"
+)
+
+// coverNames are the base names of images, which are used as folder cover
+var coverNames = []string{"cover", "folder", "_cover"}
+
+// folderCollageCandidates limits the number of files tried for the collage
+const folderCollageCandidates = 12
+
+func isCover(key string) bool {
+	base := strings.ToLower(filepath.Base(key))
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	for _, cn := range coverNames {
+		if base == cn {
+			return true
+		}
+	}
+	return false
+}
+
+// folderThumb returns the cover image of bucket/folder or a 2x2 collage of the first images
+func (s *Server) folderThumb(ctx context.Context, bucket, folder string) ([]byte, string, error) {
+	files, err := s.listSorted(ctx, bucket, folder, false, s.sortMode(nil, bucket, folder))
+	if err != nil {
+		return nil, "", &openError{err: err}
+	}
+	files = s.filterFiles(ctx, bucket, files, ACLDerivative, RoleViewer)
+	for _, f := range files {
+		if isCover(f.Key) {
+			return s.derivative(ctx, bucket, f.Key, "thumb", PriorityThumb)
+		}
+	}
+
+	opts := defaultProfiles["thumb"]
+	cachePrefix := strings.TrimRight(fmt.Sprintf("%s/%s", bucket, folder), "/") + "/folderthumb"
+	cacheKey := fmt.Sprintf("%s/%s", cachePrefix, listingHash(files))
+	mimetype := profileMimetype(opts)
+	data, err := s.cacheGet(ctx, cacheKey)
+	if err != nil {
+		return nil, "", err
+	}
+	if data != nil {
+		return data, mimetype, nil
+	}
+
+	var cells = []media.ContactSheetCell{}
+	for i, f := range files {
+		if len(cells) >= 4 || i >= folderCollageCandidates {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, "", err
+		}
+		thumb, _, err := s.derivative(ctx, bucket, f.Key, "thumb", PriorityThumb)
+		if err != nil {
+			// an incomplete collage would be cached
+			if errors.Cause(err) == errTransformBusy {
+				return nil, "", err
+			}
+			s.logger(ctx).Debugf("no folder thumb from %s/%s: %v", bucket, f.Key, err)
+			continue
+		}
+		cells = append(cells, media.ContactSheetCell{Image: thumb})
+	}
+	switch len(cells) {
+	case 0:
+		return nil, "", &openError{err: errors.Errorf("no images in %s/%s", bucket, folder)}
+	case 1:
+		data = cells[0].Image
+	default:
+		const margin = 2
+		release, err := s.acquireTransform(ctx, bucket, PriorityThumb, "folderthumb", opts.TargetFormat)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "cannot create collage of %s/%s", bucket, folder)
+		}
+		data, err = s.images.ContactSheet(ctx, cells, media.ContactSheetOptions{
+			Columns:      2,
+			CellWidth:    (opts.Width - 3*margin) / 2,
+			CellHeight:   (opts.Height - 3*margin) / 2,
+			Margin:       margin,
+			TargetFormat: opts.TargetFormat,
+		})
+		release()
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "cannot create collage of %s/%s", bucket, folder)
+		}
+	}
+	// remove thumbs of older listings
+	if err := s.cacheInvalidate(cachePrefix); err != nil {
+		s.logger(ctx).Errorf("cannot invalidate cache: %v", err)
+	}
+	if err := s.cacheSet(ctx, cacheKey, data); err != nil {
+		return nil, "", errors.Wrap(err, "cannot output image to cache")
+	}
+	return data, mimetype, nil
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"github.com/je4/s3image/v2/pkg/media"
+	"github.com/pkg/errors"
+	"image"
+	"image/png"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// readyTimeout is the time every readiness check may take
+const readyTimeout = 5 * time.Second
+
+const readyProbeKey = "_probe/readyz"
+
+type readyCheck struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+type readyResult struct {
+	Status string       `json:"status"`
+	Checks []readyCheck `json:"checks"`
+}
+
+// probeImage is a 1x1 png to check the image backend
+var probeImage = func() []byte {
+	buf := bytes.NewBuffer(nil)
+	if err := png.Encode(buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}()
+
+// probeHandler serves the probes before the access log and the router
+func (s *Server) probeHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/healthz":
+			s.HealthHandler(w, req)
+		case "/readyz":
+			s.ReadyHandler(w, req)
+		default:
+			next.ServeHTTP(w, req)
+		}
+	})
+}
+
+// HealthHandler is the liveness probe, it does not check any dependency
+func (s *Server) HealthHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, readyResult{Status: "ok", Checks: []readyCheck{}})
+}
+
+// ReadyHandler is the readiness probe. it checks the cache, every bucket and the image backend
+func (s *Server) ReadyHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	checks := map[string]func(ctx context.Context) error{
+		"cache": s.readyCache,
+		"image": s.readyImage,
+	}
+	for bucket := range s.current().buckets {
+		bucket := bucket
+		checks["bucket:"+bucket] = func(ctx context.Context) error {
+			return s.readyBucket(ctx, bucket)
+		}
+	}
+
+	result := readyResult{Status: "ok"}
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(ctx context.Context) error) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(req.Context(), readyTimeout)
+			defer cancel()
+			start := time.Now()
+			rc := readyCheck{Name: name, Status: "ok"}
+			if err := s.ready.do(ctx, name, check); err != nil {
+				rc.Status = "fail"
+				rc.Error = err.Error()
+			}
+			rc.Duration = time.Since(start).String()
+			lock.Lock()
+			result.Checks = append(result.Checks, rc)
+			lock.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	sort.Slice(result.Checks, func(i, j int) bool { return result.Checks[i].Name < result.Checks[j].Name })
+	status := http.StatusOK
+	for _, rc := range result.Checks {
+		if rc.Status != "ok" {
+			s.logger(req.Context()).Warningf("readiness check %s failed: %s", rc.Name, rc.Error)
+			result.Status = "fail"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, result)
+}
+
+// readyCache writes a probe key to badger and reads it back
+func (s *Server) readyCache(ctx context.Context) error {
+	value := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := s.cacheSetTTL(ctx, readyProbeKey, value, time.Minute); err != nil {
+		return err
+	}
+	data, err := s.cacheRead(ctx, readyProbeKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, value) {
+		return errors.Errorf("probe key has value %q instead of %q", data, value)
+	}
+	return nil
+}
+
+// readyGroup runs every readiness check at most once at a time. filesystem and local image
+// calls cannot be canceled, a hanging check keeps running in the background. later probes
+// do not start it again, they wait for the running check and share its result
+type readyGroup struct {
+	sync.Mutex
+	calls map[string]*readyCall
+}
+
+type readyCall struct {
+	done chan struct{}
+	err  error
+}
+
+// do returns the result of check name or returns early, if ctx is done. a panic of check is returned as error
+func (rg *readyGroup) do(ctx context.Context, name string, check func(ctx context.Context) error) error {
+	rg.Lock()
+	if rg.calls == nil {
+		rg.calls = map[string]*readyCall{}
+	}
+	c, ok := rg.calls[name]
+	if !ok {
+		c = &readyCall{done: make(chan struct{})}
+		rg.calls[name] = c
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					c.err = errors.Errorf("panic: %v", r)
+				}
+				rg.Lock()
+				delete(rg.calls, name)
+				rg.Unlock()
+				close(c.done)
+			}()
+			// the check does not end with the probe, which started it
+			checkCtx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+			defer cancel()
+			c.err = check(checkCtx)
+		}()
+	}
+	rg.Unlock()
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "no answer")
+	}
+}
+
+// readyBucket checks that bucket exists
+func (s *Server) readyBucket(ctx context.Context, bucket string) error {
+	ok, err := s.files(ctx).FolderExists(bucket)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.Errorf("bucket %s does not exist", bucket)
+	}
+	return nil
+}
+
+// readyImage encodes a 1x1 image with the image backend, bypassing the transform pool
+func (s *Server) readyImage(ctx context.Context) error {
+	data, err := s.images.Derivative(ctx, probeImage, media.ImageOptions{
+		Width:        1,
+		Height:       1,
+		ActionType:   media.ResizeActionTypeKeep,
+		TargetFormat: "PNG",
+	})
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return errors.New("empty probe image")
+	}
+	return nil
+}
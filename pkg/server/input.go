@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/je4/s3image/v2/pkg/filesystem"
+	"github.com/je4/s3image/v2/pkg/media"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// defaultInputFormats are the decoded formats, if no allowlist is configured.
+// formats with interpreters like PDF, PS or SVG have to be enabled explicitly
+var defaultInputFormats = []string{"JPEG", "PNG", "GIF", "TIFF", "WEBP", "BMP", "JP2", "HEIC", "AVIF"}
+
+// InputConfig restricts the masters, which are decoded
+type InputConfig struct {
+	// MaxSize is the maximum size of a master in bytes, 0 for no limit
+	MaxSize int64
+	// Formats is the allowlist of formats (see media.DetectFormat)
+	Formats []string
+}
+
+// inputError is a master, which is not decoded because of the input restrictions
+type inputError struct {
+	err error
+}
+
+func (ie *inputError) Error() string {
+	return ie.err.Error()
+}
+
+// checkInput checks the magic bytes of data against the allowed formats
+func (s *Server) checkInput(data []byte) error {
+	format := media.DetectFormat(data)
+	formats := s.input.Formats
+	if len(formats) == 0 {
+		formats = defaultInputFormats
+	}
+	for _, f := range formats {
+		if format != "" && strings.EqualFold(f, format) {
+			return nil
+		}
+	}
+	if format == "" {
+		format = "unknown"
+	}
+	return &inputError{err: errors.Errorf("format %s not allowed", format)}
+}
+
+// readImage reads the master bucket/key up to the maximum size and checks its format
+func (s *Server) readImage(ctx context.Context, bucket, key string) ([]byte, string, error) {
+	r, contentType, err := s.files(ctx).FileOpenRead(bucket, key, filesystem.FileGetOptions{})
+	if err != nil {
+		return nil, "", &openError{err: errors.Wrapf(err, "cannot open file %s/%s", bucket, key)}
+	}
+	defer r.Close()
+	var reader io.Reader = r
+	if s.input.MaxSize > 0 {
+		reader = io.LimitReader(r, s.input.MaxSize+1)
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "cannot read %s/%s", bucket, key)
+	}
+	if s.input.MaxSize > 0 && int64(len(data)) > s.input.MaxSize {
+		return nil, "", &inputError{err: errors.Errorf("%s/%s is larger than %d bytes", bucket, key, s.input.MaxSize)}
+	}
+	if err := s.checkInput(data); err != nil {
+		return nil, "", errors.Wrapf(err, "cannot decode %s/%s", bucket, key)
+	}
+	return data, contentType, nil
+}
+
+// inputRejected writes 422, if err is caused by the input restrictions or the image limits
+func (s *Server) inputRejected(w http.ResponseWriter, req *http.Request, err error) bool {
+	cause := errors.Cause(err)
+	if _, ok := cause.(*inputError); !ok && cause != media.ErrImageTooLarge {
+		return false
+	}
+	s.logger(req.Context()).Infof("%v", err)
+	writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("%v", err))
+	return true
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	_ "embed"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultPageSize is the number of entries per listing page, if the query parameter size is missing
+const defaultPageSize = 100
+
+//go:embed openapi.yaml
+var openAPIDocument []byte
+
+// pagination is the page of a listing, Prev and Next are query strings of the neighbour pages
+type pagination struct {
+	Page, Size, Pages, Total int
+	Prev, Next               string
+}
+
+// paginate returns the page given by the query parameters page and size
+func paginate(req *http.Request, total int) pagination {
+	size := int(queryInt(req, "size", defaultPageSize, 1, 1000))
+	pages := (total + size - 1) / size
+	if pages < 1 {
+		pages = 1
+	}
+	p := pagination{
+		Page:  int(queryInt(req, "page", 1, 1, int64(pages))),
+		Size:  size,
+		Pages: pages,
+		Total: total,
+	}
+	if p.Page > 1 {
+		p.Prev = pageQuery(req, p.Page-1)
+	}
+	if p.Page < pages {
+		p.Next = pageQuery(req, p.Page+1)
+	}
+	return p
+}
+
+func pageQuery(req *http.Request, page int) string {
+	q := req.URL.Query()
+	q.Set("page", strconv.Itoa(page))
+	return "?" + q.Encode()
+}
+
+// slice returns the entries of the page
+func (p pagination) slice(de []os.DirEntry) []os.DirEntry {
+	start := (p.Page - 1) * p.Size
+	if start > len(de) {
+		start = len(de)
+	}
+	end := start + p.Size
+	if end > len(de) {
+		end = len(de)
+	}
+	return de[start:end]
+}
+
+// wantsJSON checks whether the client requests the json representation
+func wantsJSON(req *http.Request) bool {
+	if format := req.URL.Query().Get("format"); format != "" {
+		return format == "json"
+	}
+	return strings.Contains(req.Header.Get("Accept"), "application/json")
+}
+
+// listingEntry is the json representation of one entry of a folder listing
+type listingEntry struct {
+	Name        string            `json:"name"`
+	Key         string            `json:"key"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime     *time.Time        `json:"mtime,omitempty"`
+	ETag        string            `json:"etag,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	URLs        map[string]string `json:"urls"`
+}
+
+// listing is the json representation of a folder listing
+type listing struct {
+	Path     string         `json:"path"`
+	Bucket   string         `json:"bucket,omitempty"`
+	Folder   string         `json:"folder,omitempty"`
+	Sort     string         `json:"sort"`
+	Page     int            `json:"page"`
+	PageSize int            `json:"pageSize"`
+	Pages    int            `json:"pages"`
+	Total    int            `json:"total"`
+	Entries  []listingEntry `json:"entries"`
+}
+
+// listingEntry converts an entry of a FileList of bucket with urls below basePath. buckets are listed with an empty bucket name
+func (s *Server) listingEntry(basePath, bucket string, e os.DirEntry) listingEntry {
+	ff := dirEntryFile(bucket, e)
+	le := listingEntry{
+		Name: filepath.Base("/" + ff.Key),
+		Key:  ff.Key,
+		URLs: map[string]string{},
+	}
+	if bucket == "" {
+		le.Type = "bucket"
+		le.URLs["index"] = fmt.Sprintf("%s/%s", basePath, ff.Key)
+		return le
+	}
+	base := fmt.Sprintf("%s/%s/%s", basePath, bucket, ff.Key)
+	if ff.IsDir {
+		le.Type = "folder"
+		le.URLs["index"] = base
+		le.URLs["thumb"] = base + "/thumb"
+		le.URLs["book"] = base + "/book"
+		le.URLs["zip"] = base + "/zip"
+		le.URLs["pdf"] = base + "/book.pdf"
+		le.URLs["cbz"] = base + "/book.cbz"
+		le.URLs["contactsheet"] = base + "/contactsheet"
+		return le
+	}
+	le.Type = "file"
+	le.Size = ff.Size
+	if !ff.ModTime.IsZero() {
+		mtime := ff.ModTime
+		le.ModTime = &mtime
+	}
+	le.ETag = ff.ETag
+	if info, err := e.Info(); err == nil {
+		if ct, ok := info.(contentTyper); ok {
+			le.ContentType = ct.ContentType()
+		}
+	}
+	if le.ContentType == "" {
+		le.ContentType = mime.TypeByExtension(filepath.Ext(ff.Key))
+	}
+	le.URLs["master"] = base + "/master"
+	le.URLs["view"] = base + "/view"
+	le.URLs["zoom"] = base + "/zoom"
+	le.URLs["dzi"] = base + "/dzi.xml"
+	for profile := range defaultProfiles {
+		le.URLs[profile] = base + "/profile/" + profile
+	}
+	return le
+}
+
+// writeListing writes the page of the folder listing as json
+func (s *Server) writeListing(w http.ResponseWriter, req *http.Request, path, bucket, folder, mode string, p pagination, de []os.DirEntry) {
+	l := listing{
+		Path:     path,
+		Bucket:   bucket,
+		Folder:   strings.Trim(folder, "/"),
+		Sort:     mode,
+		Page:     p.Page,
+		PageSize: p.Size,
+		Pages:    p.Pages,
+		Total:    p.Total,
+		Entries:  []listingEntry{},
+	}
+	for _, e := range de {
+		l.Entries = append(l.Entries, s.listingEntry(s.basePath(req), bucket, e))
+	}
+	writeJSON(w, http.StatusOK, l)
+}
+
+// OpenAPIHandler serves the description of the json api
+func (s *Server) OpenAPIHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-type", "application/yaml")
+	w.Write(openAPIDocument)
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/je4/s3image/v2/pkg/filesystem"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+type manageRequest struct {
+	Target    string `json:"target"`
+	Recursive bool   `json:"recursive"`
+}
+
+type manageResult struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Target  string `json:"target,omitempty"`
+	// RequestID identifies the failed request in the logs
+	RequestID string `json:"requestId,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	if result, ok := data.(manageResult); ok && result.Status == "error" {
+		result.RequestID = w.Header().Get(requestIDHeader)
+		data = result
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+// writeError writes a plain text error. the request id helps to find the request in the logs
+func writeError(w http.ResponseWriter, status int, message string) {
+	message = strings.TrimRight(message, "\n")
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		message += "\nrequest id: " + id
+	}
+	w.Header().Set("Content-type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(message + "\n"))
+}
+
+// validKey checks the key of a modification. acl sidecars cannot be written
+func validKey(key string) bool {
+	return key != "" && !strings.Contains("/"+key+"/", "/../") && filepath.Base(key) != aclSidecar
+}
+
+// jsonBody checks that the body is declared as json. a cross site form cannot send
+// this content type without a cors preflight, which the server does not answer
+func jsonBody(w http.ResponseWriter, req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		writeJSON(w, http.StatusUnsupportedMediaType, manageResult{Status: "error", Message: "request body must be application/json"})
+		return false
+	}
+	return true
+}
+
+// manageCheck checks that management is enabled and the bucket is available
+func (s *Server) manageCheck(w http.ResponseWriter, req *http.Request) (name, key string, ok bool) {
+	vars := mux.Vars(req)
+	path := strings.Trim(vars["path"], "/")
+
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) < 2 || !validKey(parts[1]) {
+		writeJSON(w, http.StatusBadRequest, manageResult{Status: "error", Message: fmt.Sprintf("invalid path %s", path)})
+		return "", "", false
+	}
+	name = parts[0]
+	key = parts[1]
+
+	if !s.manage {
+		writeJSON(w, http.StatusMethodNotAllowed, manageResult{Status: "error", Message: "management not enabled"})
+		return "", "", false
+	}
+	_, ok = s.current().buckets[name]
+	if !ok {
+		writeJSON(w, http.StatusForbidden, manageResult{Status: "error", Message: fmt.Sprintf("Bucket %s not available", name)})
+		return "", "", false
+	}
+	return name, key, true
+}
+
+// DeleteHandler removes /{bucket}/{path}. With ?recursive=true all objects below path/ are removed
+func (s *Server) DeleteHandler(w http.ResponseWriter, req *http.Request) {
+	name, key, ok := s.manageCheck(w, req)
+	if !ok {
+		return
+	}
+	recursive := req.URL.Query().Get("recursive") == "true"
+	key = strings.TrimRight(key, "/")
+	if err := s.files(req.Context()).FileDelete(name, key, filesystem.FileDeleteOptions{Recursive: recursive}); err != nil {
+		s.logger(req.Context()).Errorf("cannot delete %s/%s: %v", name, key, err)
+		writeJSON(w, http.StatusInternalServerError, manageResult{Status: "error", Message: err.Error(), Source: key})
+		return
+	}
+	if err := s.cacheInvalidate(fmt.Sprintf("%s/%s", name, key)); err != nil {
+		s.logger(req.Context()).Errorf("cannot invalidate cache: %v", err)
+	}
+	writeJSON(w, http.StatusOK, manageResult{Status: "ok", Source: key})
+}
+
+// CopyHandler copies /{bucket}/{path} to the target given in the json body
+func (s *Server) CopyHandler(w http.ResponseWriter, req *http.Request) {
+	s.copyMove(w, req, false)
+}
+
+// MoveHandler moves /{bucket}/{path} to the target given in the json body
+func (s *Server) MoveHandler(w http.ResponseWriter, req *http.Request) {
+	s.copyMove(w, req, true)
+}
+
+func (s *Server) copyMove(w http.ResponseWriter, req *http.Request, move bool) {
+	name, key, ok := s.manageCheck(w, req)
+	if !ok {
+		return
+	}
+	if !jsonBody(w, req) {
+		return
+	}
+	var mr manageRequest
+	if err := json.NewDecoder(req.Body).Decode(&mr); err != nil {
+		writeJSON(w, http.StatusBadRequest, manageResult{Status: "error", Message: fmt.Sprintf("cannot decode request: %v", err)})
+		return
+	}
+	key = strings.TrimRight(key, "/")
+	target := strings.Trim(mr.Target, "/")
+	if !validKey(target) {
+		writeJSON(w, http.StatusBadRequest, manageResult{Status: "error", Message: fmt.Sprintf("invalid target %s", mr.Target)})
+		return
+	}
+	// on s3 a move into the own subfolder would delete the copies with the source
+	if filesystem.Overlaps(key, target) {
+		writeJSON(w, http.StatusBadRequest, manageResult{Status: "error", Message: fmt.Sprintf("target %s is the source %s or lies above or below it", target, key), Source: key, Target: target})
+		return
+	}
+	if !s.permitted(req, name, target, RoleAdmin) {
+		writeJSON(w, http.StatusForbidden, manageResult{Status: "error", Message: fmt.Sprintf("no permission for target %s", target)})
+		return
+	}
+	opts := filesystem.FileCopyOptions{Recursive: mr.Recursive}
+	var err error
+	if move {
+		err = s.files(req.Context()).FileMove(name, key, name, target, opts)
+	} else {
+		err = s.files(req.Context()).FileCopy(name, key, name, target, opts)
+	}
+	if err != nil {
+		s.logger(req.Context()).Errorf("cannot copy/move %s/%s to %s/%s: %v", name, key, name, target, err)
+		writeJSON(w, http.StatusInternalServerError, manageResult{Status: "error", Message: err.Error(), Source: key, Target: target})
+		return
+	}
+	// derivatives of the target are outdated, derivatives of the source can be reused
+	if err := s.cacheInvalidate(fmt.Sprintf("%s/%s", name, target)); err != nil {
+		s.logger(req.Context()).Errorf("cannot invalidate cache: %v", err)
+	}
+	if err := s.cacheRekey(fmt.Sprintf("%s/%s", name, key), fmt.Sprintf("%s/%s", name, target), !move); err != nil {
+		s.logger(req.Context()).Errorf("cannot rekey cache: %v", err)
+	}
+	writeJSON(w, http.StatusOK, manageResult{Status: "ok", Source: key, Target: target})
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gorilla/mux"
+	"github.com/je4/s3image/v2/pkg/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MetricsConfig enables the prometheus endpoint /metrics
+type MetricsConfig struct {
+	Enabled bool
+	// Role is the global role needed to read the metrics, RoleNone for no authentication
+	Role Role
+}
+
+type metrics struct {
+	registry          *prometheus.Registry
+	requests          *prometheus.CounterVec
+	requestDuration   *prometheus.HistogramVec
+	responseBytes     *prometheus.CounterVec
+	cacheRequests     *prometheus.CounterVec
+	transformDuration *prometheus.HistogramVec
+	transformWaiting  *prometheus.GaugeVec
+	fsDuration        *prometheus.HistogramVec
+	fsErrors          *prometheus.CounterVec
+}
+
+func newMetrics(db *badger.DB, tp *transformPool) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "s3image_http_requests_total",
+			Help: "Number of http requests by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "s3image_http_request_duration_seconds",
+			Help:    "Latency of http requests by route.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route"}),
+		responseBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "s3image_http_response_bytes_total",
+			Help: "Bytes served by route.",
+		}, []string{"route"}),
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "s3image_cache_requests_total",
+			Help: "Cache lookups of derivatives, tiles and metadata by result (hit or miss).",
+		}, []string{"result"}),
+		transformDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "s3image_transform_duration_seconds",
+			Help:    "Time an image transformation holds a worker slot by profile and target format.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+		}, []string{"profile", "format"}),
+		transformWaiting: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "s3image_transform_waiting",
+			Help: "Image transformations waiting for a worker slot by profile and target format.",
+		}, []string{"profile", "format"}),
+		fsDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "s3image_fs_operation_duration_seconds",
+			Help:    "Latency of filesystem (s3) operations by method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method"}),
+		fsErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "s3image_fs_operation_errors_total",
+			Help: "Failed filesystem (s3) operations by method, missing files are not counted.",
+		}, []string{"method"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.responseBytes,
+		m.cacheRequests,
+		m.transformDuration,
+		m.transformWaiting,
+		m.fsDuration,
+		m.fsErrors,
+	)
+	for _, part := range []string{"lsm", "vlog"} {
+		part := part
+		m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "s3image_cache_size_bytes",
+			Help:        "Size of the badger cache on disk.",
+			ConstLabels: prometheus.Labels{"part": part},
+		}, func() float64 {
+			lsm, vlog := db.Size()
+			if part == "lsm" {
+				return float64(lsm)
+			}
+			return float64(vlog)
+		}))
+	}
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "s3image_transform_queue_length",
+		Help: "Image transformations waiting for a worker slot.",
+	}, func() float64 {
+		tp.Lock()
+		defer tp.Unlock()
+		return float64(tp.waiting)
+	}))
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "s3image_transform_running",
+		Help: "Running image transformations.",
+	}, func() float64 {
+		tp.Lock()
+		defer tp.Unlock()
+		return float64(tp.running)
+	}))
+	return m
+}
+
+// metricsWriter records status and size of a response
+type metricsWriter struct {
+	http.ResponseWriter
+	route  string
+	status int
+	bytes  int64
+}
+
+func (mw *metricsWriter) WriteHeader(status int) {
+	if mw.status == 0 {
+		mw.status = status
+	}
+	mw.ResponseWriter.WriteHeader(status)
+}
+
+func (mw *metricsWriter) Write(data []byte) (int, error) {
+	if mw.status == 0 {
+		mw.status = http.StatusOK
+	}
+	n, err := mw.ResponseWriter.Write(data)
+	mw.bytes += int64(n)
+	return n, err
+}
+
+func (mw *metricsWriter) Flush() {
+	if f, ok := mw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// metricsRoute is the name of the route or the path template of unnamed routes
+func metricsRoute(req *http.Request) string {
+	route := mux.CurrentRoute(req)
+	if route == nil {
+		return "other"
+	}
+	if name := route.GetName(); name != "" {
+		return name
+	}
+	if tpl, err := route.GetPathTemplate(); err == nil {
+		return tpl
+	}
+	return "other"
+}
+
+func (s *Server) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// shared requests are dispatched a second time, they are counted with the inner route
+		if mw, ok := w.(*metricsWriter); ok {
+			mw.route = metricsRoute(req)
+			next.ServeHTTP(w, req)
+			return
+		}
+		start := time.Now()
+		mw := &metricsWriter{ResponseWriter: w, route: metricsRoute(req)}
+		next.ServeHTTP(mw, req)
+		if mw.status == 0 {
+			mw.status = http.StatusOK
+		}
+		s.metrics.requests.WithLabelValues(mw.route, req.Method, strconv.Itoa(mw.status)).Inc()
+		s.metrics.requestDuration.WithLabelValues(mw.route).Observe(time.Since(start).Seconds())
+		s.metrics.responseBytes.WithLabelValues(mw.route).Add(float64(mw.bytes))
+	})
+}
+
+// cacheResult counts a cache lookup. internal entries like sessions are not counted
+func (m *metrics) cacheResult(key string, hit bool) {
+	if strings.HasPrefix(key, "_") {
+		return
+	}
+	if hit {
+		m.cacheRequests.WithLabelValues("hit").Inc()
+	} else {
+		m.cacheRequests.WithLabelValues("miss").Inc()
+	}
+}
+
+// acquireTransform waits for a worker slot for a transformation into profile and format.
+// the returned function releases the slot and records the duration
+func (s *Server) acquireTransform(ctx context.Context, bucket string, priority TransformPriority, profile, format string) (func(), error) {
+	_, span := tracer.Start(ctx, "transform.wait", trace.WithAttributes(
+		attribute.String("transform.profile", profile),
+		attribute.String("transform.format", format),
+	))
+	waiting := s.metrics.transformWaiting.WithLabelValues(profile, format)
+	waiting.Inc()
+	release, err := s.transforms.acquire(ctx, bucket, priority)
+	waiting.Dec()
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	return func() {
+		release()
+		s.metrics.transformDuration.WithLabelValues(profile, format).Observe(time.Since(start).Seconds())
+	}, nil
+}
+
+// MetricsHandler exposes the metrics in the prometheus format
+func (s *Server) MetricsHandler(w http.ResponseWriter, req *http.Request) {
+	if s.metricsConfig.Role != RoleNone {
+		user, ok := s.authenticate(req)
+		if !ok {
+			s.unauthorized(w)
+			return
+		}
+		if !user.Role.Includes(s.metricsConfig.Role) {
+			writeError(w, http.StatusForbidden, "no permission to read metrics")
+			return
+		}
+	}
+	promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}).ServeHTTP(w, req)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"github.com/je4/s3image/v2/pkg/filesystem"
+	"github.com/je4/s3image/v2/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// observedFS records latency, errors and spans of the filesystem operations
+type observedFS struct {
+	filesystem.FileSystem
+	m   *metrics
+	ctx context.Context
+}
+
+// files returns the filesystem, which records its calls as children of the span in ctx
+func (s *Server) files(ctx context.Context) filesystem.FileSystem {
+	return &observedFS{FileSystem: s.fs, m: s.metrics, ctx: ctx}
+}
+
+// observe starts the span of method on folder/name. the returned function ends it and records the metrics
+func (ofs *observedFS) observe(method, folder, name string) func(err error) {
+	start := time.Now()
+	_, span := tracer.Start(ofs.ctx, "fs."+method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("fs.protocol", ofs.Protocol()),
+		attribute.String("fs.bucket", folder),
+		attribute.String("fs.key", name),
+	))
+	return func(err error) {
+		ofs.m.fsDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+		if err != nil && !filesystem.IsNotFoundError(err) {
+			ofs.m.fsErrors.WithLabelValues(method).Inc()
+		}
+		tracing.End(span, err)
+	}
+}
+
+func (ofs *observedFS) FolderExists(folder string) (bool, error) {
+	done := ofs.observe("FolderExists", folder, "")
+	ok, err := ofs.FileSystem.FolderExists(folder)
+	done(err)
+	return ok, err
+}
+
+func (ofs *observedFS) FolderCreate(folder string, opts filesystem.FolderCreateOptions) error {
+	done := ofs.observe("FolderCreate", folder, "")
+	err := ofs.FileSystem.FolderCreate(folder, opts)
+	done(err)
+	return err
+}
+
+func (ofs *observedFS) FileExists(folder, name string) (bool, error) {
+	done := ofs.observe("FileExists", folder, name)
+	ok, err := ofs.FileSystem.FileExists(folder, name)
+	done(err)
+	return ok, err
+}
+
+func (ofs *observedFS) FileGet(folder, name string, opts filesystem.FileGetOptions) ([]byte, error) {
+	done := ofs.observe("FileGet", folder, name)
+	data, err := ofs.FileSystem.FileGet(folder, name, opts)
+	done(err)
+	return data, err
+}
+
+func (ofs *observedFS) FilePut(folder, name string, data []byte, opts filesystem.FilePutOptions) error {
+	done := ofs.observe("FilePut", folder, name)
+	err := ofs.FileSystem.FilePut(folder, name, data, opts)
+	done(err)
+	return err
+}
+
+func (ofs *observedFS) FileWrite(folder, name string, r io.Reader, size int64, opts filesystem.FilePutOptions) error {
+	done := ofs.observe("FileWrite", folder, name)
+	err := ofs.FileSystem.FileWrite(folder, name, r, size, opts)
+	done(err)
+	return err
+}
+
+func (ofs *observedFS) FileRead(folder, name string, w io.Writer, size int64, opts filesystem.FileGetOptions) error {
+	done := ofs.observe("FileRead", folder, name)
+	err := ofs.FileSystem.FileRead(folder, name, w, size, opts)
+	done(err)
+	return err
+}
+
+// FileOpenRead records the time until the object is opened, not the transfer
+func (ofs *observedFS) FileOpenRead(folder, name string, opts filesystem.FileGetOptions) (io.ReadCloser, string, error) {
+	done := ofs.observe("FileOpenRead", folder, name)
+	r, contentType, err := ofs.FileSystem.FileOpenRead(folder, name, opts)
+	done(err)
+	return r, contentType, err
+}
+
+func (ofs *observedFS) FileStat(folder, name string, opts filesystem.FileStatOptions) (fs.FileInfo, error) {
+	done := ofs.observe("FileStat", folder, name)
+	info, err := ofs.FileSystem.FileStat(folder, name, opts)
+	done(err)
+	return info, err
+}
+
+func (ofs *observedFS) FileList(folder, name string) ([]fs.DirEntry, error) {
+	done := ofs.observe("FileList", folder, name)
+	entries, err := ofs.FileSystem.FileList(folder, name)
+	done(err)
+	return entries, err
+}
+
+func (ofs *observedFS) FileDelete(folder, name string, opts filesystem.FileDeleteOptions) error {
+	done := ofs.observe("FileDelete", folder, name)
+	err := ofs.FileSystem.FileDelete(folder, name, opts)
+	done(err)
+	return err
+}
+
+func (ofs *observedFS) FileCopy(srcFolder, srcName, dstFolder, dstName string, opts filesystem.FileCopyOptions) error {
+	done := ofs.observe("FileCopy", srcFolder, srcName)
+	err := ofs.FileSystem.FileCopy(srcFolder, srcName, dstFolder, dstName, opts)
+	done(err)
+	return err
+}
+
+func (ofs *observedFS) FileMove(srcFolder, srcName, dstFolder, dstName string, opts filesystem.FileCopyOptions) error {
+	done := ofs.observe("FileMove", srcFolder, srcName)
+	err := ofs.FileSystem.FileMove(srcFolder, srcName, dstFolder, dstName, opts)
+	done(err)
+	return err
+}
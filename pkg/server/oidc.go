@@ -0,0 +1,380 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/je4/s3image/v2/pkg/oidc"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ClaimMapping gives a role to tokens, which contain Value in Claim.
+// an empty Bucket sets the global role of the user
+type ClaimMapping struct {
+	Claim  string
+	Value  string
+	Bucket string
+	Prefix string
+	Role   Role
+}
+
+// OIDCConfig defines bearer token validation and the login flow
+type OIDCConfig struct {
+	Enabled bool
+	// Issuer is checked against the iss claim and used for discovery of the login flow
+	Issuer string
+	// JWKS is the url or filename of the key set. default is jwks_uri of the issuer
+	JWKS string
+	// Audience of bearer tokens, default is ClientID. one of both is required
+	Audience string
+	// ClientID and ClientSecret enable the authorization code flow for the html views
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// UsernameClaim names the user, sub is used if empty
+	UsernameClaim string
+	Mappings      []ClaimMapping
+	SessionTTL    time.Duration
+	Leeway        time.Duration
+}
+
+const (
+	sessionCookie   = "s3image_session"
+	stateCookie     = "s3image_oidcstate"
+	sessionPrefix   = "_session/"
+	oidcStatePrefix = "_oidcstate/"
+	oidcStateTTL    = 10 * time.Minute
+)
+
+type oidcAuth struct {
+	conf     OIDCConfig
+	verifier *oidc.Verifier
+	provider *oidc.Provider
+}
+
+type oidcState struct {
+	Nonce    string `json:"nonce"`
+	Redirect string `json:"redirect"`
+}
+
+type session struct {
+	User    *User     `json:"user"`
+	Expires time.Time `json:"expires"`
+}
+
+func newOIDCAuth(conf OIDCConfig) (*oidcAuth, error) {
+	oa := &oidcAuth{conf: conf}
+	if oa.conf.UsernameClaim == "" {
+		oa.conf.UsernameClaim = "sub"
+	}
+	if oa.conf.SessionTTL <= 0 {
+		oa.conf.SessionTTL = 8 * time.Hour
+	}
+	if oa.conf.Audience == "" {
+		oa.conf.Audience = conf.ClientID
+	}
+	// tokens of other applications of the identity provider have to be rejected
+	if oa.conf.Audience == "" {
+		return nil, errors.New("bearer tokens need an audience or a client id")
+	}
+	for _, m := range conf.Mappings {
+		if m.Claim == "" || !m.Role.valid() {
+			return nil, errors.Errorf("invalid claim mapping %v", m)
+		}
+	}
+	jwks := conf.JWKS
+	if conf.ClientID != "" || jwks == "" {
+		if conf.Issuer == "" {
+			return nil, errors.New("oidc login or discovery of the key set needs an issuer")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		provider, err := oidc.Discover(ctx, conf.Issuer, nil)
+		if err != nil {
+			return nil, err
+		}
+		if conf.ClientID != "" {
+			oa.provider = provider
+		}
+		if jwks == "" {
+			jwks = provider.JWKSURI
+		}
+	}
+	keys, err := oidc.NewKeySet(jwks, nil)
+	if err != nil {
+		return nil, err
+	}
+	oa.verifier = &oidc.Verifier{
+		Keys:     keys,
+		Issuer:   conf.Issuer,
+		Audience: oa.conf.Audience,
+		Leeway:   conf.Leeway,
+	}
+	return oa, nil
+}
+
+// user creates the user of the claims with the grants of the mappings
+func (oa *oidcAuth) user(claims oidc.Claims) (*User, error) {
+	name := claims.String(oa.conf.UsernameClaim)
+	if name == "" {
+		name = claims.String("sub")
+	}
+	if name == "" {
+		return nil, errors.New("token without subject")
+	}
+	u := &User{Name: name}
+	for _, m := range oa.conf.Mappings {
+		var found bool
+		for _, v := range claims.Strings(m.Claim) {
+			if m.Value == "" || m.Value == "*" || v == m.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		if m.Bucket == "" {
+			if m.Role.Includes(u.Role) {
+				u.Role = m.Role
+			}
+			continue
+		}
+		u.Grants = append(u.Grants, Grant{Bucket: m.Bucket, Prefix: m.Prefix, Role: m.Role})
+	}
+	return u, nil
+}
+
+func randomID() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Wrap(err, "cannot create random id")
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func (s *Server) cookiePath() string {
+	if u, err := url.Parse(s.addrExt); err == nil && u.Path != "" {
+		return u.Path
+	}
+	return "/"
+}
+
+// sessionUser returns the user of a valid session cookie
+func (s *Server) sessionUser(req *http.Request) *User {
+	cookie, err := req.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	data, err := s.storeGet(req.Context(), sessionPrefix+cookie.Value)
+	if err != nil || data == nil {
+		return nil
+	}
+	var sess session
+	if err := json.Unmarshal(data, &sess); err != nil || time.Now().After(sess.Expires) {
+		return nil
+	}
+	return sess.User
+}
+
+// bearerUser returns the user of a valid bearer token
+func (s *Server) bearerUser(req *http.Request) (*User, bool) {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, false
+	}
+	claims, err := s.oidc.verifier.Verify(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+	if err != nil {
+		s.logger(req.Context()).Infof("invalid bearer token: %v", err)
+		return nil, true
+	}
+	u, err := s.oidc.user(claims)
+	if err != nil {
+		s.logger(req.Context()).Infof("invalid bearer token: %v", err)
+		return nil, true
+	}
+	return u, true
+}
+
+// userName returns the name of the authenticated user or of the login session
+func (s *Server) userName(req *http.Request) string {
+	if u := userFromContext(req.Context()); u != nil {
+		return u.Name
+	}
+	if s.oidc != nil {
+		if u := s.sessionUser(req); u != nil {
+			return u.Name
+		}
+	}
+	return ""
+}
+
+// loginRedirect sends browsers without credentials to the login of the issuer
+func (s *Server) loginRedirect(w http.ResponseWriter, req *http.Request) bool {
+	if s.oidc == nil || s.oidc.provider == nil || req.Method != http.MethodGet || wantsJSON(req) || req.Header.Get("Authorization") != "" {
+		return false
+	}
+	http.Redirect(w, req, fmt.Sprintf("%s/auth/login?redirect=%s", s.addrExt, url.QueryEscape(req.URL.RequestURI())), http.StatusFound)
+	return true
+}
+
+// localRedirect returns redirect, if it is a path on this server, "/" otherwise.
+// browsers treat backslashes as slashes, so /\host would leave the server
+func localRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.ContainsAny(redirect, "\\\r\n\t") {
+		return "/"
+	}
+	u, err := url.Parse(redirect)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+		return "/"
+	}
+	return redirect
+}
+
+// stateHash is stored in the state cookie, which binds the login to the browser
+func stateHash(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoginHandler starts the authorization code flow
+func (s *Server) LoginHandler(w http.ResponseWriter, req *http.Request) {
+	if s.oidc == nil || s.oidc.provider == nil {
+		writeError(w, http.StatusNotFound, "login not enabled")
+		return
+	}
+	redirect := localRedirect(req.URL.Query().Get("redirect"))
+	state, err := randomID()
+	if err != nil {
+		s.logger(req.Context()).Errorf("%v", err)
+		writeError(w, http.StatusInternalServerError, "cannot create login state")
+		return
+	}
+	nonce, err := randomID()
+	if err != nil {
+		s.logger(req.Context()).Errorf("%v", err)
+		writeError(w, http.StatusInternalServerError, "cannot create login state")
+		return
+	}
+	data, _ := json.Marshal(oidcState{Nonce: nonce, Redirect: redirect})
+	if err := s.storeSetTTL(req.Context(), oidcStatePrefix+state, data, oidcStateTTL); err != nil {
+		s.logger(req.Context()).Errorf("cannot store login state: %v", err)
+		writeError(w, http.StatusInternalServerError, "cannot store login state")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     stateCookie,
+		Value:    stateHash(state),
+		Path:     s.cookiePath(),
+		MaxAge:   int(oidcStateTTL / time.Second),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(s.addrExt, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, req, s.oidc.provider.AuthCodeURL(s.oidc.conf.ClientID, s.addrExt+"/auth/callback", state, nonce, s.oidc.conf.Scopes), http.StatusFound)
+}
+
+// CallbackHandler finishes the authorization code flow and creates the session
+func (s *Server) CallbackHandler(w http.ResponseWriter, req *http.Request) {
+	if s.oidc == nil || s.oidc.provider == nil {
+		writeError(w, http.StatusNotFound, "login not enabled")
+		return
+	}
+	q := req.URL.Query()
+	if e := q.Get("error"); e != "" {
+		writeError(w, http.StatusUnauthorized, fmt.Sprintf("login failed: %s %s", e, q.Get("error_description")))
+		return
+	}
+	// the state must belong to a login, which was started in this browser
+	cookie, err := req.Cookie(stateCookie)
+	if err != nil || q.Get("state") == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(stateHash(q.Get("state")))) != 1 {
+		writeError(w, http.StatusBadRequest, "login state does not belong to this browser")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   stateCookie,
+		Path:   s.cookiePath(),
+		MaxAge: -1,
+	})
+	stateKey := oidcStatePrefix + q.Get("state")
+	data, err := s.storeGet(req.Context(), stateKey)
+	if err != nil || data == nil {
+		writeError(w, http.StatusBadRequest, "invalid or expired login state")
+		return
+	}
+	if err := s.storeDelete(stateKey); err != nil {
+		s.logger(req.Context()).Errorf("cannot remove login state: %v", err)
+	}
+	var state oidcState
+	if err := json.Unmarshal(data, &state); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid login state")
+		return
+	}
+	idToken, err := s.oidc.provider.Exchange(req.Context(), s.oidc.conf.ClientID, s.oidc.conf.ClientSecret, s.addrExt+"/auth/callback", q.Get("code"))
+	if err != nil {
+		s.logger(req.Context()).Errorf("cannot exchange code: %v", err)
+		writeError(w, http.StatusUnauthorized, fmt.Sprintf("login failed: %v", err))
+		return
+	}
+	verifier := *s.oidc.verifier
+	verifier.Audience = s.oidc.conf.ClientID
+	verifier.Nonce = state.Nonce
+	claims, err := verifier.Verify(idToken)
+	var user *User
+	if err == nil {
+		user, err = s.oidc.user(claims)
+	}
+	if err != nil {
+		s.logger(req.Context()).Errorf("invalid id token: %v", err)
+		writeError(w, http.StatusUnauthorized, fmt.Sprintf("login failed: %v", err))
+		return
+	}
+
+	id, err := randomID()
+	if err != nil {
+		s.logger(req.Context()).Errorf("%v", err)
+		writeError(w, http.StatusInternalServerError, "cannot create session")
+		return
+	}
+	expires := time.Now().Add(s.oidc.conf.SessionTTL)
+	data, _ = json.Marshal(session{User: user, Expires: expires})
+	if err := s.storeSetTTL(req.Context(), sessionPrefix+id, data, s.oidc.conf.SessionTTL); err != nil {
+		s.logger(req.Context()).Errorf("cannot store session: %v", err)
+		writeError(w, http.StatusInternalServerError, "cannot store session")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     s.cookiePath(),
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(s.addrExt, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	s.logger(req.Context()).Infof("user %s logged in", user.Name)
+	http.Redirect(w, req, state.Redirect, http.StatusFound)
+}
+
+// LogoutHandler removes the session
+func (s *Server) LogoutHandler(w http.ResponseWriter, req *http.Request) {
+	if cookie, err := req.Cookie(sessionCookie); err == nil {
+		if err := s.storeDelete(sessionPrefix + cookie.Value); err != nil {
+			s.logger(req.Context()).Errorf("cannot remove session: %v", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   sessionCookie,
+		Path:   s.cookiePath(),
+		MaxAge: -1,
+	})
+	http.Redirect(w, req, s.addrExt+"/", http.StatusFound)
+}
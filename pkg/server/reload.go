@@ -0,0 +1,247 @@
+package server
+
+import (
+	"github.com/Masterminds/sprig"
+	"github.com/pkg/errors"
+	"html/template"
+	"io/fs"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// reloadable is the part of the configuration, which is replaced by Reload.
+// it is never modified after it is stored in the server
+type reloadable struct {
+	buckets        map[string]string
+	name, password string
+	// fileUsers are the users of the user file, without the bucket and admin accounts
+	fileUsers     *UserStore
+	users         *UserStore
+	templateFiles map[string]string
+	templates     map[string]*template.Template
+	pdf           PDFConfig
+	cbz           CBZConfig
+}
+
+// reservedBuckets are the first path elements of the routes, which are not buckets.
+// names with a leading underscore are reserved for internal routes and cache keys (_shares, _session/...)
+var reservedBuckets = map[string]bool{
+	"s":            true,
+	"auth":         true,
+	"metrics":      true,
+	"healthz":      true,
+	"readyz":       true,
+	"openapi.yaml": true,
+}
+
+// checkBucket rejects bucket names, which collide with routes or cache keys
+func checkBucket(bucket string) error {
+	if bucket == "" || strings.ContainsAny(bucket, "/\\") || bucket == "." || bucket == ".." {
+		return errors.Errorf("invalid bucket name %q", bucket)
+	}
+	if reservedBuckets[bucket] || strings.HasPrefix(bucket, "_") {
+		return errors.Errorf("bucket name %s is reserved", bucket)
+	}
+	return nil
+}
+
+// current returns the configuration for the running request
+func (s *Server) current() *reloadable {
+	return s.state.Load().(*reloadable)
+}
+
+// newReloadable checks the configuration and creates the user accounts and templates
+func newReloadable(buckets, templateFiles map[string]string, users *UserStore, name, password string, pdf PDFConfig, cbz CBZConfig) (*reloadable, error) {
+	if users == nil {
+		users = NewUserStore()
+	}
+	r := &reloadable{
+		buckets:       buckets,
+		name:          name,
+		password:      password,
+		fileUsers:     users,
+		users:         users.clone(),
+		templateFiles: templateFiles,
+		pdf:           pdf,
+		cbz:           cbz,
+	}
+	// bucket passwords: the bucket name is the user with all permissions on the bucket
+	for bucket, pw := range buckets {
+		if err := checkBucket(bucket); err != nil {
+			return nil, err
+		}
+		if pw == "" {
+			continue
+		}
+		if err := r.users.AddPlain(bucket, pw, RoleNone, Grant{Bucket: bucket, Role: RoleAdmin}); err != nil {
+			return nil, errors.Wrapf(err, "cannot add user for bucket %s", bucket)
+		}
+	}
+	// global admin
+	if name != "" && password != "" {
+		if err := r.users.AddPlain(name, password, RoleAdmin); err != nil {
+			return nil, errors.Wrapf(err, "cannot add user %s", name)
+		}
+	}
+	if opts, ok := defaultProfiles[pdf.Profile]; pdf.Profile != "" && (!ok || opts.TargetFormat != "JPEG") {
+		return nil, errors.Errorf("pdf profile %s not available or no jpeg", pdf.Profile)
+	}
+	if _, ok := defaultProfiles[cbz.Profile]; cbz.Profile != "" && !ok {
+		return nil, errors.Errorf("cbz profile %s not available", cbz.Profile)
+	}
+	var err error
+	if r.templates, err = loadTemplates(templateFiles); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// loadTemplates parses the template files. templates without a file are taken from the embedded templates
+func loadTemplates(files map[string]string) (map[string]*template.Template, error) {
+	templates := map[string]*template.Template{}
+	for key, val := range files {
+		tpl, err := parseTemplate(key, val, os.ReadFile)
+		if err != nil {
+			return nil, err
+		}
+		templates[key] = tpl
+	}
+	for key, val := range templateFiles {
+		if _, ok := templates[key]; ok {
+			continue
+		}
+		tpl, err := parseTemplate(key, val, func(name string) ([]byte, error) { return fs.ReadFile(templateFS, name) })
+		if err != nil {
+			return nil, err
+		}
+		templates[key] = tpl
+	}
+	return templates, nil
+}
+
+func parseTemplate(key, filename string, readFile func(string) ([]byte, error)) (*template.Template, error) {
+	text, err := readFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read %s", filename)
+	}
+	tpl, err := template.New("index").Funcs(sprig.FuncMap()).Parse(string(text))
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse template %s: %s", key, filename)
+	}
+	return tpl, nil
+}
+
+// InitTemplates reads the templates again
+func (s *Server) InitTemplates() error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	templates, err := loadTemplates(s.current().templateFiles)
+	if err != nil {
+		return err
+	}
+	r := *s.current()
+	r.templates = templates
+	s.state.Store(&r)
+	return nil
+}
+
+// Reload replaces buckets, users, templates and the book profiles. running requests finish
+// with the old configuration. if the new configuration is invalid, nothing is changed
+func (s *Server) Reload(buckets, templateFiles map[string]string, users *UserStore, name, password string, pdf PDFConfig, cbz CBZConfig) error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	r, err := newReloadable(buckets, templateFiles, users, name, password, pdf, cbz)
+	if err != nil {
+		return errors.Wrap(err, "invalid configuration")
+	}
+	old := s.current()
+	s.state.Store(r)
+	changes := old.diff(r)
+	for _, change := range changes {
+		s.log.Infof("reload: %s", change)
+	}
+	s.log.Infof("configuration reloaded with %d changes", len(changes))
+	return nil
+}
+
+// diff describes the changes from r to n. passwords are not logged
+func (r *reloadable) diff(n *reloadable) []string {
+	var changes []string
+	for _, bucket := range sortedKeys(r.buckets, n.buckets) {
+		oldPw, oldOk := r.buckets[bucket]
+		newPw, newOk := n.buckets[bucket]
+		switch {
+		case !oldOk:
+			changes = append(changes, "bucket "+bucket+" added")
+		case !newOk:
+			changes = append(changes, "bucket "+bucket+" removed")
+		case oldPw != newPw:
+			changes = append(changes, "password of bucket "+bucket+" changed")
+		}
+	}
+	if r.name != n.name {
+		changes = append(changes, "admin "+r.name+" replaced by "+n.name)
+	} else if r.password != n.password {
+		changes = append(changes, "password of admin "+n.name+" changed")
+	}
+
+	oldUsers := r.fileUsers.all()
+	newUsers := n.fileUsers.all()
+	names := map[string]string{}
+	for name := range oldUsers {
+		names[name] = name
+	}
+	for name := range newUsers {
+		names[name] = name
+	}
+	for _, name := range sortedKeys(names, nil) {
+		oldUser, oldOk := oldUsers[name]
+		newUser, newOk := newUsers[name]
+		switch {
+		case !oldOk:
+			changes = append(changes, "user "+name+" added")
+		case !newOk:
+			changes = append(changes, "user "+name+" removed")
+		case !reflect.DeepEqual(oldUser, newUser):
+			changes = append(changes, "user "+name+" changed")
+		}
+	}
+
+	for _, key := range sortedKeys(r.templateFiles, n.templateFiles) {
+		oldFile, oldOk := r.templateFiles[key]
+		newFile, newOk := n.templateFiles[key]
+		switch {
+		case !oldOk:
+			changes = append(changes, "template "+key+" from "+newFile)
+		case !newOk:
+			changes = append(changes, "template "+key+" from "+oldFile+" removed")
+		case oldFile != newFile:
+			changes = append(changes, "template "+key+" from "+newFile+" instead of "+oldFile)
+		}
+	}
+
+	if r.pdf != n.pdf {
+		changes = append(changes, "pdf configuration changed")
+	}
+	if r.cbz != n.cbz {
+		changes = append(changes, "cbz configuration changed")
+	}
+	return changes
+}
+
+// sortedKeys returns the keys of both maps
+func sortedKeys(a, b map[string]string) []string {
+	var keys []string
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/je4/s3image/v2/pkg/structlog"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// requestIDHeader is taken from the client or proxy and returned in every response
+const requestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile("^[a-zA-Z0-9._:+=/-]{1,128}$")
+
+// LogConfig defines the access log
+type LogConfig struct {
+	// JSON writes the access log as json lines instead of the combined log format
+	JSON bool
+}
+
+// requestInfo collects the fields of a request for the log lines
+type requestInfo struct {
+	id    string
+	start time.Time
+
+	lock    sync.Mutex
+	route   string
+	bucket  string
+	key     string
+	profile string
+	cache   string
+	user    string
+}
+
+type requestInfoContextKey struct{}
+
+// requestInfoFromContext returns the info of the request or nil
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	ri, _ := ctx.Value(requestInfoContextKey{}).(*requestInfo)
+	return ri
+}
+
+func (ri *requestInfo) setRoute(route, path string) {
+	if ri == nil {
+		return
+	}
+	ri.lock.Lock()
+	defer ri.lock.Unlock()
+	ri.route = route
+	ri.bucket, ri.key = splitPath(path)
+}
+
+func (ri *requestInfo) setProfile(profile string) {
+	if ri == nil {
+		return
+	}
+	ri.lock.Lock()
+	defer ri.lock.Unlock()
+	ri.profile = profile
+}
+
+// setCache records a cache lookup. one miss makes the request a miss
+func (ri *requestInfo) setCache(hit bool) {
+	if ri == nil {
+		return
+	}
+	ri.lock.Lock()
+	defer ri.lock.Unlock()
+	switch {
+	case !hit:
+		ri.cache = "miss"
+	case ri.cache == "":
+		ri.cache = "hit"
+	}
+}
+
+func (ri *requestInfo) setUser(user string) {
+	if ri == nil {
+		return
+	}
+	ri.lock.Lock()
+	defer ri.lock.Unlock()
+	ri.user = user
+}
+
+func (ri *requestInfo) fields() structlog.Fields {
+	ri.lock.Lock()
+	defer ri.lock.Unlock()
+	return structlog.Fields{
+		"request_id": ri.id,
+		"route":      ri.route,
+		"bucket":     ri.bucket,
+		"key":        ri.key,
+		"profile":    ri.profile,
+		"cache":      ri.cache,
+		"user":       ri.user,
+	}
+}
+
+// logger returns the application log with the fields of the request and the trace in ctx
+func (s *Server) logger(ctx context.Context) *structlog.Logger {
+	fields := structlog.Fields{}
+	if ri := requestInfoFromContext(ctx); ri != nil {
+		fields = ri.fields()
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		fields["trace_id"] = sc.TraceID().String()
+	}
+	return s.flog.With(fields)
+}
+
+// accessWriter records status and size of a response for the access log
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (aw *accessWriter) WriteHeader(status int) {
+	if aw.status == 0 {
+		aw.status = status
+	}
+	aw.ResponseWriter.WriteHeader(status)
+}
+
+func (aw *accessWriter) Write(data []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	n, err := aw.ResponseWriter.Write(data)
+	aw.bytes += int64(n)
+	return n, err
+}
+
+func (aw *accessWriter) Flush() {
+	if f, ok := aw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// requestHandler takes or generates the request id and writes the json access log
+func (s *Server) requestHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			var err error
+			if id, err = randomID(); err != nil {
+				s.log.Errorf("%v", err)
+				id = "-"
+			}
+			req.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		ri := &requestInfo{id: id, start: time.Now()}
+		req = req.WithContext(context.WithValue(req.Context(), requestInfoContextKey{}, ri))
+		if !s.logConfig.JSON {
+			next.ServeHTTP(w, req)
+			return
+		}
+		aw := &accessWriter{ResponseWriter: w}
+		next.ServeHTTP(aw, req)
+		if aw.status == 0 {
+			aw.status = http.StatusOK
+		}
+		line := ri.fields()
+		for key, value := range line {
+			if value == "" {
+				delete(line, key)
+			}
+		}
+		line["time"] = ri.start.Format(time.RFC3339Nano)
+		line["remote"] = req.RemoteAddr
+		line["method"] = req.Method
+		line["uri"] = req.RequestURI
+		line["proto"] = req.Proto
+		line["status"] = aw.status
+		line["bytes"] = aw.bytes
+		line["duration"] = time.Since(ri.start).Seconds()
+		if referer := req.Referer(); referer != "" {
+			line["referer"] = referer
+		}
+		if agent := req.UserAgent(); agent != "" {
+			line["user_agent"] = agent
+		}
+		data, err := json.Marshal(line)
+		if err != nil {
+			s.log.Errorf("cannot marshal access log: %v", err)
+			return
+		}
+		s.accessLog.Write(append(data, '\n'))
+	})
+}
+
+// requestMiddleware records route, bucket and key of the request
+func (s *Server) requestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requestInfoFromContext(req.Context()).setRoute(metricsRoute(req), mux.Vars(req)["path"])
+		next.ServeHTTP(w, req)
+	})
+}
@@ -1,60 +1,66 @@
 package server
 
 import (
-	"bytes"
 	"context"
-	"crypto/subtle"
 	"crypto/tls"
 	"fmt"
-	"github.com/Masterminds/sprig"
 	"github.com/dgraph-io/badger/v3"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/je4/s3image/v2/pkg/filesystem"
-	"github.com/je4/s3image/v2/pkg/media"
+	"github.com/je4/s3image/v2/pkg/structlog"
+	"github.com/je4/s3image/v2/pkg/worker"
 	dcert "github.com/je4/utils/v2/pkg/cert"
 	"github.com/op/go-logging"
 	"github.com/pkg/errors"
-	"html/template"
 	"io"
-	"io/fs"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type Server struct {
-	service        string
-	addrExt        string
-	host, port     string
-	name, password string
-	srv            *http.Server
-	log            *logging.Logger
-	accessLog      io.Writer
-	templates      map[string]*template.Template
-	fs             filesystem.FileSystem
-	db             *badger.DB
-	buckets        map[string]string
-	templateFiles  map[string]string
+	service    string
+	addrExt    string
+	host, port string
+	srv        *http.Server
+	log        *logging.Logger
+	flog       *structlog.Logger
+	accessLog  io.Writer
+	logConfig  LogConfig
+	fs         filesystem.FileSystem
+	db         *badger.DB
+	// store keeps share links and login sessions. unlike db it is not cleared on startup
+	store  *badger.DB
+	upload UploadConfig
+	manage bool
+	zip    ZipConfig
+	sort   SortConfig
+	oidc   *oidcAuth
+	acl    *aclStore
+	// trustedProxies may set the client address with forwarded headers
+	trustedProxies []*net.IPNet
+	shares         *shareStore
+	router         *mux.Router
+	transforms     *transformPool
+	flights        *flightGroup
+	input          InputConfig
+	images         worker.Transformer
+	metrics        *metrics
+	metricsConfig  MetricsConfig
+	ready          readyGroup
+	exif           exifQueue
+	// state is the *reloadable configuration
+	state      atomic.Value
+	reloadLock sync.Mutex
 }
 
-func BasicAuth(w http.ResponseWriter, r *http.Request, username, password, realm string) bool {
-
-	user, pass, ok := r.BasicAuth()
-
-	if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 || subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
-		w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`"`)
-		w.WriteHeader(401)
-		w.Write([]byte("Unauthorised.\n"))
-		return false
-	}
-
-	return true
-}
-
-func NewServer(service, addr, addrExt, name, password string, log *logging.Logger, accessLog io.Writer, fs filesystem.FileSystem, db *badger.DB, buckets, templateFiles map[string]string) (*Server, error) {
+func NewServer(service, addr, addrExt, name, password string, log *logging.Logger, accessLog io.Writer, fs filesystem.FileSystem, db, store *badger.DB, buckets, templateFiles map[string]string, upload UploadConfig, manage bool, zip ZipConfig, pdf PDFConfig, cbz CBZConfig, sortConfig SortConfig, users *UserStore, oidcConfig OIDCConfig, aclConfig ACLConfig, shareConfig ShareConfig, transformConfig TransformConfig, inputConfig InputConfig, images worker.Transformer, metricsConfig MetricsConfig, logConfig LogConfig) (*Server, error) {
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		return nil, errors.Wrapf(err, "cannot split address %s", addr)
@@ -65,50 +71,71 @@ func NewServer(service, addr, addrExt, name, password string, log *logging.Logge
 		addrExt:       strings.TrimRight(addrExt, "/"),
 		host:          host,
 		port:          port,
-		name:          name,
-		password:      password,
 		log:           log,
+		flog:          structlog.New(log),
 		accessLog:     accessLog,
-		templates:     map[string]*template.Template{},
+		logConfig:     logConfig,
 		fs:            fs,
 		db:            db,
-		buckets:       buckets,
-		templateFiles: templateFiles,
+		store:         store,
+		upload:        upload,
+		manage:        manage,
+		zip:           zip,
+		sort:          sortConfig,
+		transforms:    newTransformPool(transformConfig),
+		flights:       newFlightGroup(),
+		input:         inputConfig,
+		images:        images,
+		metricsConfig: metricsConfig,
+	}
+	// without worker processes the images are transformed in the server process
+	if srv.images == nil {
+		srv.images = worker.Local{}
+	}
+	if upload.Enabled && upload.Verify && upload.limit(inputConfig) <= 0 {
+		return nil, errors.New("upload verification buffers the upload in memory and needs a size limit for uploads or masters")
+	}
+	if !metricsConfig.Role.valid() {
+		return nil, errors.Errorf("invalid metrics role %s", metricsConfig.Role)
+	}
+	srv.metrics = newMetrics(db, srv.transforms)
+	r, err := newReloadable(buckets, templateFiles, users, name, password, pdf, cbz)
+	if err != nil {
+		return nil, err
+	}
+	srv.state.Store(r)
+	if oidcConfig.Enabled {
+		if srv.oidc, err = newOIDCAuth(oidcConfig); err != nil {
+			return nil, errors.Wrap(err, "cannot initialize openid connect")
+		}
+	}
+	if srv.trustedProxies, err = parseNets(aclConfig.TrustedProxies); err != nil {
+		return nil, errors.Wrap(err, "invalid trusted proxies")
+	}
+	if len(aclConfig.Rules) > 0 || aclConfig.Sidecar {
+		if srv.acl, err = newACLStore(aclConfig); err != nil {
+			return nil, errors.Wrap(err, "invalid acl")
+		}
+	}
+	if shareConfig.Enabled {
+		srv.shares = newShareStore(shareConfig)
 	}
 
-	return srv, srv.InitTemplates()
+	return srv, nil
 }
 
-func (s *Server) InitTemplates() error {
-	if len(s.templateFiles) > 0 {
-		for key, val := range s.templateFiles {
-			text, err := os.ReadFile(val)
-			if err != nil {
-				return errors.Wrapf(err, "cannot read %s", val)
-			}
-			tpl, err := template.New("index").Funcs(sprig.FuncMap()).Parse(string(text))
-			//tpl, err := template.ParseFS(templateFS, val)
-			if err != nil {
-				return errors.Wrapf(err, "cannot parse template %s: %s", key, val)
-			}
-			s.templates[key] = tpl
-		}
-	} else {
-		for key, val := range templateFiles {
-			text, err := fs.ReadFile(templateFS, val)
-			if err != nil {
-				return errors.Wrapf(err, "cannot read %s", val)
-			}
-			tpl, err := template.New("index").Funcs(sprig.FuncMap()).Parse(string(text))
-			//tpl, err := template.ParseFS(templateFS, val)
-			if err != nil {
-				return errors.Wrapf(err, "cannot parse template %s: %s", key, val)
-			}
-			s.templates[key] = tpl
+// bucketEntries returns the buckets, which the user may read by role, by a grant below the bucket root or by an acl rule
+func (s *Server) bucketEntries(ctx context.Context) []os.DirEntry {
+	var de = []os.DirEntry{}
+	user := userFromContext(ctx)
+	for b := range s.current().buckets {
+		if s.allowed(ctx, b, "", true, ACLRead, RoleViewer) || user.grantsBelow(b, RoleViewer) {
+			de = append(de, filesystem.NewDummyDirEntry(b))
 		}
 	}
-	return nil
+	return de
 }
+
 func (s *Server) IndexHandler(w http.ResponseWriter, req *http.Request) {
 	var err error
 	vars := mux.Vars(req)
@@ -116,9 +143,8 @@ func (s *Server) IndexHandler(w http.ResponseWriter, req *http.Request) {
 
 	parts := strings.SplitN(path, "/", 2)
 	if parts == nil {
-		s.log.Infof("invalid path %s", path)
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("invalid path %s", path)))
+		s.logger(req.Context()).Infof("invalid path %s", path)
+		writeError(w, http.StatusNotFound, fmt.Sprintf("invalid path %s", path))
 		return
 	}
 	var name = parts[0]
@@ -128,37 +154,58 @@ func (s *Server) IndexHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	var de = []os.DirEntry{}
 	if name == "" {
-		for b, _ := range s.buckets {
-			de = append(de, filesystem.NewDummyDirEntry(b))
-		}
+		de = s.bucketEntries(req.Context())
 	} else {
-		pw, ok := s.buckets[name]
+		_, ok := s.current().buckets[name]
 		if !ok {
-			w.WriteHeader(http.StatusForbidden)
-			w.Write([]byte(fmt.Sprintf("Bucket %s not available", name)))
-			return
-		}
-		if !BasicAuth(w, req, name, pw, "s3image:"+name) {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("Bucket %s not available", name))
 			return
 		}
 
-		de, err = s.fs.FileList(name, folder)
+		de, err = s.files(req.Context()).FileList(name, folder)
 		if err != nil {
-			if parts == nil {
-				s.log.Infof("cannot read folder %s: %v", path, err)
-				w.WriteHeader(http.StatusNotFound)
-				w.Write([]byte(fmt.Sprintf("cannot read folder %s: %v", path, err)))
-				return
+			status := http.StatusNotFound
+			if filesystem.IsNotFoundError(err) || errors.Is(err, os.ErrNotExist) {
+				s.logger(req.Context()).Infof("cannot read folder %s: %v", path, err)
+			} else {
+				s.logger(req.Context()).Errorf("cannot read folder %s: %v", path, err)
+				status = http.StatusInternalServerError
 			}
+			writeError(w, status, fmt.Sprintf("cannot read folder %s: %v", path, err))
+			return
 		}
 	}
-	tpl := s.templates["index"]
+	mode := s.sortMode(req, name, folder)
+	if name != "" {
+		de = s.filterDirEntries(req.Context(), name, de, ACLRead, RoleViewer)
+	}
+	s.sortDirEntries(req.Context(), name, mode, de)
+	page := paginate(req, len(de))
+	de = page.slice(de)
+	if wantsJSON(req) {
+		s.writeListing(w, req, path, name, folder, mode, page, de)
+		return
+	}
+	tpl, ok := s.current().templates["index"]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no index template")
+		return
+	}
 	if err := tpl.Execute(w, struct {
-		BasePath string
-		Path     string
-		Entries  []os.DirEntry
-	}{s.addrExt, path, de}); err != nil {
-		s.log.Errorf("error executing index template: %v", err)
+		BasePath   string
+		Path       string
+		Entries    []os.DirEntry
+		Upload     bool
+		Manage     bool
+		Sort       string
+		SortModes  []string
+		Query      string
+		Pagination pagination
+		User       string
+		Login      bool
+		Share      bool
+	}{s.basePath(req), path, de, s.upload.Enabled && name != "" && s.permitted(req, name, folder, RoleUploader), s.manage && name != "" && s.permitted(req, name, folder, RoleAdmin), mode, SortModes, sortQuery(req), page, s.userName(req), s.oidc != nil && s.oidc.provider != nil && shareFromContext(req.Context()) == nil, s.shares != nil && name != "" && s.permitted(req, name, folder, routeRoles["share"])}); err != nil {
+		s.logger(req.Context()).Errorf("error executing index template: %v", err)
 	}
 }
 
@@ -169,9 +216,8 @@ func (s *Server) BookHandler(w http.ResponseWriter, req *http.Request) {
 
 	parts := strings.SplitN(path, "/", 2)
 	if parts == nil {
-		s.log.Infof("invalid path %s", path)
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("invalid path %s", path)))
+		s.logger(req.Context()).Infof("invalid path %s", path)
+		writeError(w, http.StatusNotFound, fmt.Sprintf("invalid path %s", path))
 		return
 	}
 	var name = parts[0]
@@ -181,37 +227,43 @@ func (s *Server) BookHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	var de = []os.DirEntry{}
 	if name == "" {
-		for b, _ := range s.buckets {
-			de = append(de, filesystem.NewDummyDirEntry(b))
-		}
+		de = s.bucketEntries(req.Context())
 	} else {
-		pw, ok := s.buckets[name]
+		_, ok := s.current().buckets[name]
 		if !ok {
-			w.WriteHeader(http.StatusForbidden)
-			w.Write([]byte(fmt.Sprintf("Bucket %s not available", name)))
-			return
-		}
-		if !BasicAuth(w, req, name, pw, "s3image:"+name) {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("Bucket %s not available", name))
 			return
 		}
 
-		de, err = s.fs.FileList(name, folder)
+		de, err = s.files(req.Context()).FileList(name, folder)
 		if err != nil {
-			if parts == nil {
-				s.log.Infof("cannot read folder %s: %v", path, err)
-				w.WriteHeader(http.StatusNotFound)
-				w.Write([]byte(fmt.Sprintf("cannot read folder %s: %v", path, err)))
-				return
+			status := http.StatusNotFound
+			if filesystem.IsNotFoundError(err) || errors.Is(err, os.ErrNotExist) {
+				s.logger(req.Context()).Infof("cannot read folder %s: %v", path, err)
+			} else {
+				s.logger(req.Context()).Errorf("cannot read folder %s: %v", path, err)
+				status = http.StatusInternalServerError
 			}
+			writeError(w, status, fmt.Sprintf("cannot read folder %s: %v", path, err))
+			return
 		}
 	}
-	tpl := s.templates["pamphlet"]
+	mode := s.sortMode(req, name, folder)
+	if name != "" {
+		de = s.filterDirEntries(req.Context(), name, de, ACLRead, RoleViewer)
+	}
+	s.sortDirEntries(req.Context(), name, mode, de)
+	tpl, ok := s.current().templates["pamphlet"]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no pamphlet template")
+		return
+	}
 	if err := tpl.Execute(w, struct {
 		BasePath string
 		Path     string
 		Entries  []os.DirEntry
-	}{s.addrExt, path, de}); err != nil {
-		s.log.Errorf("error executing index template: %v", err)
+	}{s.basePath(req), path, de}); err != nil {
+		s.logger(req.Context()).Errorf("error executing index template: %v", err)
 	}
 }
 
@@ -221,8 +273,7 @@ func (s *Server) MasterHandler(w http.ResponseWriter, req *http.Request) {
 
 	parts := strings.SplitN(path, "/", 2)
 	if parts == nil {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("cannot open file %s", path)))
+		writeError(w, http.StatusNotFound, fmt.Sprintf("cannot open file %s", path))
 		return
 	}
 	var name = parts[0]
@@ -231,26 +282,23 @@ func (s *Server) MasterHandler(w http.ResponseWriter, req *http.Request) {
 		folder = parts[1]
 	}
 
-	pw, ok := s.buckets[name]
+	_, ok := s.current().buckets[name]
 	if !ok {
-		w.WriteHeader(http.StatusForbidden)
-		w.Write([]byte(fmt.Sprintf("Bucket %s not available", name)))
-		return
-	}
-	if !BasicAuth(w, req, name, pw, "s3image:"+name) {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("Bucket %s not available", name))
 		return
 	}
 
-	r, contentType, err := s.fs.FileOpenRead(name, folder, filesystem.FileGetOptions{})
+	r, contentType, err := s.files(req.Context()).FileOpenRead(name, folder, filesystem.FileGetOptions{})
 	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("cannot open file %s", path)))
+		writeError(w, http.StatusNotFound, fmt.Sprintf("cannot open file %s", path))
 		return
 	}
 	w.Header().Add("Content-type", contentType)
+	if req.URL.Query().Get("download") == "true" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filepath.Base(folder)))
+	}
 	if _, err := io.Copy(w, r); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("cannot read file %s", path)))
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("cannot read file %s", path))
 		return
 	}
 }
@@ -261,8 +309,7 @@ func (s *Server) ThumbHandler(w http.ResponseWriter, req *http.Request) {
 
 	parts := strings.SplitN(path, "/", 2)
 	if parts == nil {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("cannot open file %s", path)))
+		writeError(w, http.StatusNotFound, fmt.Sprintf("cannot open file %s", path))
 		return
 	}
 	var name = parts[0]
@@ -271,99 +318,32 @@ func (s *Server) ThumbHandler(w http.ResponseWriter, req *http.Request) {
 		folder = parts[1]
 	}
 
-	pw, ok := s.buckets[name]
+	_, ok := s.current().buckets[name]
 	if !ok {
-		w.WriteHeader(http.StatusForbidden)
-		w.Write([]byte(fmt.Sprintf("Bucket %s not available", name)))
-		return
-	}
-	if !BasicAuth(w, req, name, pw, "s3image:"+name) {
-		return
-	}
-
-	done := false
-	if err := s.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(path + "/thumb"))
-		if err != nil {
-			if err != badger.ErrKeyNotFound {
-				return errors.Wrapf(err, "cannot get %s from cache", path+"/thumb")
-			}
-			return nil
-		}
-		if err := item.Value(func(val []byte) error {
-			w.Header().Set("Content-type", "image/jpeg")
-			w.Write(val)
-			done = true
-			return nil
-		}); err != nil {
-			return errors.Wrapf(err, "cannot get value for %s from cache", path+"/thumb")
-		}
-		return nil
-	}); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		s.log.Errorf("cannot read cache %v", err)
-		w.Write([]byte(fmt.Sprintf("cannot read cache %v", err)))
-		return
-	}
-	if done {
-		return
-	}
-
-	r, _, err := s.fs.FileOpenRead(name, folder, filesystem.FileGetOptions{})
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("cannot open file %s", path)))
-		return
-	}
-
-	var image media.ImageType
-	image, err = media.NewImageMagickV3(r)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("error reading image %s: %v", path, err)))
+		writeError(w, http.StatusForbidden, fmt.Sprintf("Bucket %s not available", name))
 		return
 	}
-	defer image.Close()
 
-	imageOptions := &media.ImageOptions{
-		Width:             359,
-		Height:            225,
-		ActionType:        media.ResizeActionTypeKeep,
-		TargetFormat:      "JPEG",
-		OverlayCollection: "",
-		OverlaySignature:  "",
-		BackgroundColor:   "",
-	}
-	if err := image.Resize(imageOptions); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("resize image %s", path)))
+	// folders have no master
+	if folder == "" || strings.HasSuffix(folder, "/") {
+		s.serveFolderThumb(w, req, name, folder)
 		return
 	}
-	reader, _, err := image.StoreImage("JPEG")
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("store image %s", path)))
+	// the cache is checked before the stat of the master, only a miss needs the stat.
+	// the miss is recorded by the lookup of the derivative
+	requestInfoFromContext(req.Context()).setProfile("thumb")
+	cacheKey := fmt.Sprintf("%s/%s/thumb", name, folder)
+	if data, err := s.cacheRead(req.Context(), cacheKey); err == nil && data != nil {
+		s.cacheResult(req.Context(), cacheKey, true)
+		w.Header().Set("Content-type", profileMimetype(defaultProfiles["thumb"]))
+		w.Write(data)
 		return
 	}
-	defer reader.Close()
-
-	buf := bytes.NewBuffer(nil)
-	if _, err := io.Copy(buf, reader); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("output image %s", path)))
+	if exists, err := s.files(req.Context()).FileExists(name, folder); err == nil && !exists {
+		s.serveFolderThumb(w, req, name, folder)
 		return
 	}
-	if err := s.db.Update(func(txn *badger.Txn) error {
-		return txn.Set([]byte(path+"/thumb"), buf.Bytes())
-	}); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("cannot output image to cache %s", err)))
-		return
-	}
-
-	w.Header().Add("Content-type", "image/jpg")
-	w.Write(buf.Bytes())
-
+	s.serveDerivative(w, req, name, folder, "thumb")
 }
 
 func (s *Server) BookPageHandler(w http.ResponseWriter, req *http.Request) {
@@ -372,8 +352,7 @@ func (s *Server) BookPageHandler(w http.ResponseWriter, req *http.Request) {
 
 	parts := strings.SplitN(path, "/", 2)
 	if parts == nil {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("cannot open file %s", path)))
+		writeError(w, http.StatusNotFound, fmt.Sprintf("cannot open file %s", path))
 		return
 	}
 	var name = parts[0]
@@ -382,110 +361,48 @@ func (s *Server) BookPageHandler(w http.ResponseWriter, req *http.Request) {
 		folder = parts[1]
 	}
 
-	pw, ok := s.buckets[name]
+	_, ok := s.current().buckets[name]
 	if !ok {
-		w.WriteHeader(http.StatusForbidden)
-		w.Write([]byte(fmt.Sprintf("Bucket %s not available", name)))
-		return
-	}
-	if !BasicAuth(w, req, name, pw, "s3image:"+name) {
-		return
-	}
-
-	done := false
-	if err := s.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(path + "/page"))
-		if err != nil {
-			if err != badger.ErrKeyNotFound {
-				return errors.Wrapf(err, "cannot get %s from cache", path+"/thumb")
-			}
-			return nil
-		}
-		if err := item.Value(func(val []byte) error {
-			w.Header().Set("Content-type", "image/jpeg")
-			w.Write(val)
-			done = true
-			return nil
-		}); err != nil {
-			return errors.Wrapf(err, "cannot get value for %s from cache", path+"/thumb")
-		}
-		return nil
-	}); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		s.log.Errorf("cannot read cache %v", err)
-		w.Write([]byte(fmt.Sprintf("cannot read cache %v", err)))
+		writeError(w, http.StatusForbidden, fmt.Sprintf("Bucket %s not available", name))
 		return
 	}
-	if done {
-		return
-	}
-
-	r, _, err := s.fs.FileOpenRead(name, folder, filesystem.FileGetOptions{})
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("cannot open file %s", path)))
-		return
-	}
-
-	var image media.ImageType
-	image, err = media.NewImageMagickV3(r)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("error reading image %s: %v", path, err)))
-		return
-	}
-	defer image.Close()
-
-	imageOptions := &media.ImageOptions{
-		Width:             600,
-		Height:            800,
-		ActionType:        media.ResizeActionTypeKeep,
-		TargetFormat:      "JPEG",
-		OverlayCollection: "",
-		OverlaySignature:  "",
-		BackgroundColor:   "",
-	}
-	if err := image.Resize(imageOptions); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("resize image %s", path)))
-		return
-	}
-	reader, _, err := image.StoreImage("JPEG")
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("store image %s", path)))
-		return
-	}
-	defer reader.Close()
-
-	buf := bytes.NewBuffer(nil)
-	if _, err := io.Copy(buf, reader); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("output image %s", path)))
-		return
-	}
-	if err := s.db.Update(func(txn *badger.Txn) error {
-		return txn.Set([]byte(path+"/page"), buf.Bytes())
-	}); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(fmt.Sprintf("cannot output image to cache %s", err)))
-		return
-	}
-
-	w.Header().Add("Content-type", "image/jpg")
-	w.Write(buf.Bytes())
 
+	s.serveDerivative(w, req, name, folder, "page")
 }
 
 var thumbPath = regexp.MustCompile("^(?P<path>.+)/thumb$")
 var pagePath = regexp.MustCompile("^(?P<path>.+)/page$")
 var masterPath = regexp.MustCompile("^(?P<path>.+)/master$")
 var bookPath = regexp.MustCompile("^(?P<path>.+)/book$")
+var bookPDFPath = regexp.MustCompile("^(?P<path>.+)/book\\.pdf$")
+var bookCBZPath = regexp.MustCompile("^(?P<path>.+)/book\\.cbz$")
+var contactSheetPath = regexp.MustCompile("^(?P<path>.+)/contactsheet$")
+var viewPath = regexp.MustCompile("^(?P<path>.+)/view$")
+var profilePath = regexp.MustCompile("^(?P<path>.+)/profile/(?P<profile>[a-zA-Z0-9_-]+)$")
+var dziPath = regexp.MustCompile("^(?P<path>.+)/dzi\\.xml$")
+var dziTilePath = regexp.MustCompile("^(?P<path>.+)/dzi_files/(?P<level>[0-9]+)/(?P<col>[0-9]+)_(?P<row>[0-9]+)\\.(?P<format>[a-z]+)$")
+var zoomPath = regexp.MustCompile("^(?P<path>.+)/zoom$")
+var zipPath = regexp.MustCompile("^(?P<path>.+)/zip$")
+var copyPath = regexp.MustCompile("^(?P<path>.+)/copy$")
+var movePath = regexp.MustCompile("^(?P<path>.+)/move$")
+var sharePath = regexp.MustCompile("^(?P<path>.+)/share$")
 var indexPath = regexp.MustCompile("^(?P<path>.+)$")
 
 func (s *Server) ListenAndServe(cert, key string) (err error) {
 	router := mux.NewRouter()
 
+	router.HandleFunc("/openapi.yaml", s.OpenAPIHandler).Methods("GET", "HEAD")
+	if s.metricsConfig.Enabled {
+		router.HandleFunc("/metrics", s.MetricsHandler).Methods("GET")
+	}
+	router.HandleFunc("/auth/login", s.LoginHandler).Methods("GET")
+	router.HandleFunc("/auth/callback", s.CallbackHandler).Methods("GET")
+	router.HandleFunc("/auth/logout", s.LogoutHandler).Methods("GET", "POST")
+	router.HandleFunc("/_shares", s.SharesHandler).Methods("GET", "HEAD")
+	router.HandleFunc("/_shares/{token}", s.ShareRevokeHandler).Methods("DELETE")
+	// the buckets s, auth, metrics and names with a leading underscore are rejected by checkBucket
+	router.PathPrefix("/s/").HandlerFunc(s.ShareHandler)
+
 	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
 		matches := indexPath.FindStringSubmatch(request.URL.Path)
 		if matches == nil {
@@ -508,10 +425,37 @@ func (s *Server) ListenAndServe(cert, key string) (err error) {
 			if strings.HasSuffix(matches[i], "/book") {
 				return false
 			}
+			if strings.HasSuffix(matches[i], "/zip") {
+				return false
+			}
+			if strings.HasSuffix(matches[i], "/book.pdf") {
+				return false
+			}
+			if strings.HasSuffix(matches[i], "/book.cbz") {
+				return false
+			}
+			if strings.HasSuffix(matches[i], "/contactsheet") {
+				return false
+			}
+			if strings.HasSuffix(matches[i], "/view") {
+				return false
+			}
+			if profilePath.MatchString(matches[i]) {
+				return false
+			}
+			if strings.HasSuffix(matches[i], "/dzi.xml") {
+				return false
+			}
+			if dziTilePath.MatchString(matches[i]) {
+				return false
+			}
+			if strings.HasSuffix(matches[i], "/zoom") {
+				return false
+			}
 			match.Vars[name] = matches[i]
 		}
 		return true
-	}).Methods("GET", "HEAD").HandlerFunc(s.IndexHandler)
+	}).Methods("GET", "HEAD").Name("index").HandlerFunc(s.IndexHandler)
 
 	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
 		matches := indexPath.FindStringSubmatch(request.URL.Path)
@@ -529,7 +473,97 @@ func (s *Server) ListenAndServe(cert, key string) (err error) {
 			match.Vars[name] = strings.TrimRight(matches[i], "/book")
 		}
 		return true
-	}).Methods("GET", "HEAD").HandlerFunc(s.BookHandler)
+	}).Methods("GET", "HEAD").Name("book").HandlerFunc(s.BookHandler)
+
+	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
+		matches := indexPath.FindStringSubmatch(request.URL.Path)
+		if matches == nil {
+			return false
+		}
+		match.Vars = map[string]string{}
+		for i, name := range indexPath.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			match.Vars[name] = matches[i]
+		}
+		return true
+	}).Methods("PUT").Name("upload").HandlerFunc(s.UploadHandler)
+
+	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
+		matches := indexPath.FindStringSubmatch(request.URL.Path)
+		if matches == nil {
+			return false
+		}
+		match.Vars = map[string]string{}
+		for i, name := range indexPath.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			match.Vars[name] = matches[i]
+		}
+		return true
+	}).Methods("DELETE").Name("delete").HandlerFunc(s.DeleteHandler)
+
+	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
+		matches := copyPath.FindStringSubmatch(request.URL.Path)
+		if matches == nil {
+			return false
+		}
+		match.Vars = map[string]string{}
+		for i, name := range copyPath.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			match.Vars[name] = matches[i]
+		}
+		return true
+	}).Methods("POST").Name("copy").HandlerFunc(s.CopyHandler)
+
+	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
+		matches := movePath.FindStringSubmatch(request.URL.Path)
+		if matches == nil {
+			return false
+		}
+		match.Vars = map[string]string{}
+		for i, name := range movePath.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			match.Vars[name] = matches[i]
+		}
+		return true
+	}).Methods("POST").Name("move").HandlerFunc(s.MoveHandler)
+
+	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
+		matches := sharePath.FindStringSubmatch(request.URL.Path)
+		if matches == nil {
+			return false
+		}
+		match.Vars = map[string]string{}
+		for i, name := range sharePath.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			match.Vars[name] = matches[i]
+		}
+		return true
+	}).Methods("POST").Name("share").HandlerFunc(s.ShareCreateHandler)
+
+	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
+		matches := indexPath.FindStringSubmatch(request.URL.Path)
+		if matches == nil {
+			return false
+		}
+		match.Vars = map[string]string{}
+		for i, name := range indexPath.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			match.Vars[name] = matches[i]
+		}
+		return true
+	}).Methods("POST").Name("uploadform").HandlerFunc(s.UploadFormHandler)
 
 	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
 		matches := thumbPath.FindStringSubmatch(request.URL.Path)
@@ -544,7 +578,7 @@ func (s *Server) ListenAndServe(cert, key string) (err error) {
 			match.Vars[name] = matches[i]
 		}
 		return true
-	}).Methods("GET", "HEAD").HandlerFunc(s.ThumbHandler)
+	}).Methods("GET", "HEAD").Name("thumb").HandlerFunc(s.ThumbHandler)
 
 	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
 		matches := pagePath.FindStringSubmatch(request.URL.Path)
@@ -559,7 +593,7 @@ func (s *Server) ListenAndServe(cert, key string) (err error) {
 			match.Vars[name] = matches[i]
 		}
 		return true
-	}).Methods("GET", "HEAD").HandlerFunc(s.BookPageHandler)
+	}).Methods("GET", "HEAD").Name("page").HandlerFunc(s.BookPageHandler)
 
 	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
 		matches := masterPath.FindStringSubmatch(request.URL.Path)
@@ -574,12 +608,154 @@ func (s *Server) ListenAndServe(cert, key string) (err error) {
 			match.Vars[name] = matches[i]
 		}
 		return true
-	}).Methods("GET", "HEAD").HandlerFunc(s.MasterHandler)
+	}).Methods("GET", "HEAD").Name("master").HandlerFunc(s.MasterHandler)
+
+	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
+		matches := zipPath.FindStringSubmatch(request.URL.Path)
+		if matches == nil {
+			return false
+		}
+		match.Vars = map[string]string{}
+		for i, name := range zipPath.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			match.Vars[name] = matches[i]
+		}
+		return true
+	}).Methods("GET", "HEAD").Name("zip").HandlerFunc(s.ZipHandler)
+
+	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
+		matches := bookPDFPath.FindStringSubmatch(request.URL.Path)
+		if matches == nil {
+			return false
+		}
+		match.Vars = map[string]string{}
+		for i, name := range bookPDFPath.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			match.Vars[name] = matches[i]
+		}
+		return true
+	}).Methods("GET", "HEAD").Name("bookpdf").HandlerFunc(s.BookPDFHandler)
+
+	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
+		matches := bookCBZPath.FindStringSubmatch(request.URL.Path)
+		if matches == nil {
+			return false
+		}
+		match.Vars = map[string]string{}
+		for i, name := range bookCBZPath.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			match.Vars[name] = matches[i]
+		}
+		return true
+	}).Methods("GET", "HEAD").Name("bookcbz").HandlerFunc(s.BookCBZHandler)
+
+	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
+		matches := contactSheetPath.FindStringSubmatch(request.URL.Path)
+		if matches == nil {
+			return false
+		}
+		match.Vars = map[string]string{}
+		for i, name := range contactSheetPath.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			match.Vars[name] = matches[i]
+		}
+		return true
+	}).Methods("GET", "HEAD").Name("contactsheet").HandlerFunc(s.ContactSheetHandler)
+
+	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
+		matches := viewPath.FindStringSubmatch(request.URL.Path)
+		if matches == nil {
+			return false
+		}
+		match.Vars = map[string]string{}
+		for i, name := range viewPath.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			match.Vars[name] = matches[i]
+		}
+		return true
+	}).Methods("GET", "HEAD").Name("view").HandlerFunc(s.ViewHandler)
+
+	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
+		matches := profilePath.FindStringSubmatch(request.URL.Path)
+		if matches == nil {
+			return false
+		}
+		match.Vars = map[string]string{}
+		for i, name := range profilePath.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			match.Vars[name] = matches[i]
+		}
+		return true
+	}).Methods("GET", "HEAD").Name("profile").HandlerFunc(s.ProfileHandler)
 
-	loggedRouter := handlers.CombinedLoggingHandler(s.accessLog, handlers.ProxyHeaders(router))
+	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
+		matches := dziPath.FindStringSubmatch(request.URL.Path)
+		if matches == nil {
+			return false
+		}
+		match.Vars = map[string]string{}
+		for i, name := range dziPath.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			match.Vars[name] = matches[i]
+		}
+		return true
+	}).Methods("GET", "HEAD").Name("dzi").HandlerFunc(s.DZIHandler)
+
+	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
+		matches := dziTilePath.FindStringSubmatch(request.URL.Path)
+		if matches == nil {
+			return false
+		}
+		match.Vars = map[string]string{}
+		for i, name := range dziTilePath.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			match.Vars[name] = matches[i]
+		}
+		return true
+	}).Methods("GET", "HEAD").Name("dzitile").HandlerFunc(s.DZITileHandler)
+
+	router.MatcherFunc(func(request *http.Request, match *mux.RouteMatch) bool {
+		matches := zoomPath.FindStringSubmatch(request.URL.Path)
+		if matches == nil {
+			return false
+		}
+		match.Vars = map[string]string{}
+		for i, name := range zoomPath.SubexpNames() {
+			if name == "" {
+				continue
+			}
+			match.Vars[name] = matches[i]
+		}
+		return true
+	}).Methods("GET", "HEAD").Name("zoom").HandlerFunc(s.ZoomHandler)
+
+	router.Use(s.requestMiddleware, s.metricsMiddleware, s.tracingMiddleware, s.authMiddleware)
+	s.router = router
+
+	var handler http.Handler = s.proxyHeaders(router)
+	if !s.logConfig.JSON {
+		handler = handlers.CombinedLoggingHandler(s.accessLog, handler)
+	}
 	addr := net.JoinHostPort(s.host, s.port)
 	s.srv = &http.Server{
-		Handler: loggedRouter,
+		// probes bypass the access log and the authentication
+		Handler: s.probeHandler(s.requestHandler(handler)),
 		Addr:    addr,
 	}
 
@@ -0,0 +1,597 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ShareAction is a permission of a share link
+type ShareAction string
+
+const (
+	ShareView     ShareAction = "view"
+	ShareDownload ShareAction = "download"
+	ShareZip      ShareAction = "zip"
+)
+
+// shareRouteActions is the share action needed for the named routes. all other routes are not available via share links
+var shareRouteActions = map[string]ShareAction{
+	"index":        ShareView,
+	"book":         ShareView,
+	"view":         ShareView,
+	"zoom":         ShareView,
+	"thumb":        ShareView,
+	"page":         ShareView,
+	"profile":      ShareView,
+	"dzi":          ShareView,
+	"dzitile":      ShareView,
+	"contactsheet": ShareView,
+	"master":       ShareDownload,
+	"bookpdf":      ShareDownload,
+	"bookcbz":      ShareDownload,
+	"zip":          ShareZip,
+}
+
+// sharePrefix is the store prefix of the share links
+const sharePrefix = "_share/"
+
+// ShareConfig defines the share links
+type ShareConfig struct {
+	Enabled bool
+	// DefaultExpiry is used if the creator gives no expiry
+	DefaultExpiry time.Duration
+	// MaxExpiry is the longest allowed lifetime of a share link
+	MaxExpiry time.Duration
+}
+
+// share gives access to a folder or a single object without an account
+type share struct {
+	Token        string        `json:"token"`
+	Bucket       string        `json:"bucket"`
+	Key          string        `json:"key"`
+	Folder       bool          `json:"folder"`
+	Creator      string        `json:"creator"`
+	Created      time.Time     `json:"created"`
+	Expires      time.Time     `json:"expires"`
+	Password     string        `json:"password,omitempty"`
+	Actions      []ShareAction `json:"actions"`
+	MaxDownloads int           `json:"maxDownloads,omitempty"`
+	Downloads    int           `json:"downloads"`
+}
+
+// covers checks whether key in bucket is part of the share
+func (sh *share) covers(bucket, key string) bool {
+	if !sh.Folder {
+		return sh.Bucket == bucket && sh.Key == strings.Trim(key, "/")
+	}
+	return Grant{Bucket: sh.Bucket, Prefix: sh.Key}.matches(bucket, key)
+}
+
+func (sh *share) allows(action ShareAction) bool {
+	for _, a := range sh.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// shareRequest is the json body for the creation of a share link
+type shareRequest struct {
+	// Expires is a duration (72h, 7d) or a rfc3339 timestamp
+	Expires      string        `json:"expires"`
+	Password     string        `json:"password"`
+	Actions      []ShareAction `json:"actions"`
+	MaxDownloads int           `json:"maxDownloads"`
+}
+
+// shareEntry is the json representation of a share link
+type shareEntry struct {
+	Token        string        `json:"token"`
+	URL          string        `json:"url"`
+	Bucket       string        `json:"bucket"`
+	Key          string        `json:"key"`
+	Folder       bool          `json:"folder"`
+	Creator      string        `json:"creator"`
+	Created      time.Time     `json:"created"`
+	Expires      time.Time     `json:"expires"`
+	Protected    bool          `json:"protected"`
+	Actions      []ShareAction `json:"actions"`
+	MaxDownloads int           `json:"maxDownloads,omitempty"`
+	Downloads    int           `json:"downloads"`
+}
+
+var errShareExhausted = errors.New("download limit reached")
+
+// shareStore holds the configuration and the verified share passwords
+type shareStore struct {
+	sync.Mutex
+	conf     ShareConfig
+	verified map[[sha256.Size]byte]time.Time
+}
+
+func newShareStore(conf ShareConfig) *shareStore {
+	if conf.DefaultExpiry <= 0 {
+		conf.DefaultExpiry = 7 * 24 * time.Hour
+	}
+	if conf.MaxExpiry > 0 && conf.DefaultExpiry > conf.MaxExpiry {
+		conf.DefaultExpiry = conf.MaxExpiry
+	}
+	return &shareStore{conf: conf, verified: map[[sha256.Size]byte]time.Time{}}
+}
+
+// expiry returns the expiry time of a share link
+func (ss *shareStore) expiry(expires string, now time.Time) (time.Time, error) {
+	var t time.Time
+	switch {
+	case expires == "":
+		t = now.Add(ss.conf.DefaultExpiry)
+	case strings.HasSuffix(expires, "d"):
+		days, err := strconv.Atoi(strings.TrimSuffix(expires, "d"))
+		if err != nil {
+			return t, errors.Wrapf(err, "invalid expiry %s", expires)
+		}
+		t = now.Add(time.Duration(days) * 24 * time.Hour)
+	default:
+		if d, err := time.ParseDuration(expires); err == nil {
+			t = now.Add(d)
+		} else if t, err = time.Parse(time.RFC3339, expires); err != nil {
+			return t, errors.Errorf("invalid expiry %s", expires)
+		}
+	}
+	if !t.After(now) {
+		return t, errors.Errorf("expiry %s is in the past", expires)
+	}
+	if ss.conf.MaxExpiry > 0 && t.Sub(now) > ss.conf.MaxExpiry {
+		return t, errors.Errorf("expiry %s exceeds the maximum of %v", expires, ss.conf.MaxExpiry)
+	}
+	return t, nil
+}
+
+// checkPassword verifies the password of a protected share, verified passwords are cached
+func (ss *shareStore) checkPassword(sh *share, password string) bool {
+	if sh.Password == "" {
+		return true
+	}
+	sum := sha256.Sum256([]byte(sh.Token + "\x00" + password + "\x00" + sh.Password))
+	ss.Lock()
+	verified, ok := ss.verified[sum]
+	ss.Unlock()
+	if ok && time.Since(verified) < authCacheTime {
+		return true
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(sh.Password), []byte(password)); err != nil {
+		return false
+	}
+	ss.Lock()
+	for k, t := range ss.verified {
+		if time.Since(t) >= authCacheTime {
+			delete(ss.verified, k)
+		}
+	}
+	ss.verified[sum] = time.Now()
+	ss.Unlock()
+	return true
+}
+
+type shareContextKey struct{}
+
+// shareFromContext returns the share link of the request or nil
+func shareFromContext(ctx context.Context) *share {
+	sh, _ := ctx.Value(shareContextKey{}).(*share)
+	return sh
+}
+
+// basePath is the external address for the links of a page. pages of share links stay below the share
+func (s *Server) basePath(req *http.Request) string {
+	if sh := shareFromContext(req.Context()); sh != nil {
+		return s.addrExt + "/s/" + sh.Token
+	}
+	return s.addrExt
+}
+
+// shareGet loads a share link, nil if it does not exist or is expired
+func (s *Server) shareGet(ctx context.Context, token string) (*share, error) {
+	data, err := s.storeGet(ctx, sharePrefix+token)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read share %s", token)
+	}
+	if data == nil {
+		return nil, nil
+	}
+	sh := &share{}
+	if err := json.Unmarshal(data, sh); err != nil {
+		return nil, errors.Wrapf(err, "cannot unmarshal share %s", token)
+	}
+	if !time.Now().Before(sh.Expires) {
+		return nil, nil
+	}
+	return sh, nil
+}
+
+func (s *Server) shareSave(ctx context.Context, sh *share) error {
+	data, err := json.Marshal(sh)
+	if err != nil {
+		return errors.Wrapf(err, "cannot marshal share %s", sh.Token)
+	}
+	return s.storeSetTTL(ctx, sharePrefix+sh.Token, data, time.Until(sh.Expires))
+}
+
+// shareList returns all share links, newest first
+func (s *Server) shareList() ([]*share, error) {
+	var shares = []*share{}
+	if err := s.store.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(sharePrefix)
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := it.Item().Value(func(val []byte) error {
+				sh := &share{}
+				if err := json.Unmarshal(val, sh); err != nil {
+					return errors.Wrapf(err, "cannot unmarshal %s", string(it.Item().Key()))
+				}
+				shares = append(shares, sh)
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "cannot list shares")
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].Created.After(shares[j].Created)
+	})
+	return shares, nil
+}
+
+// shareCountDownload increments the download counter and returns errShareExhausted if the limit is reached
+func (s *Server) shareCountDownload(token string) error {
+	var err error
+	for i := 0; i < 5; i++ {
+		err = s.store.Update(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte(sharePrefix + token))
+			if err != nil {
+				return err
+			}
+			sh := &share{}
+			if err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, sh)
+			}); err != nil {
+				return err
+			}
+			if sh.MaxDownloads > 0 && sh.Downloads >= sh.MaxDownloads {
+				return errShareExhausted
+			}
+			sh.Downloads++
+			data, err := json.Marshal(sh)
+			if err != nil {
+				return err
+			}
+			return txn.SetEntry(badger.NewEntry(item.KeyCopy(nil), data).WithTTL(time.Until(sh.Expires)))
+		})
+		if err != badger.ErrConflict {
+			break
+		}
+	}
+	if err == errShareExhausted {
+		return err
+	}
+	return errors.Wrapf(err, "cannot count download of share %s", token)
+}
+
+func (s *Server) shareEntry(sh *share) shareEntry {
+	return shareEntry{
+		Token:        sh.Token,
+		URL:          fmt.Sprintf("%s/s/%s", s.addrExt, sh.Token),
+		Bucket:       sh.Bucket,
+		Key:          sh.Key,
+		Folder:       sh.Folder,
+		Creator:      sh.Creator,
+		Created:      sh.Created,
+		Expires:      sh.Expires,
+		Protected:    sh.Password != "",
+		Actions:      sh.Actions,
+		MaxDownloads: sh.MaxDownloads,
+		Downloads:    sh.Downloads,
+	}
+}
+
+// shareTarget is the page of a share link
+func shareTarget(sh *share) string {
+	target := strings.TrimRight(sh.Bucket+"/"+sh.Key, "/")
+	if !sh.Folder {
+		target += "/view"
+	}
+	return target
+}
+
+// ShareHandler serves /s/{token}/{bucket}/{path} with the routes of the server and the permissions of the share link
+func (s *Server) ShareHandler(w http.ResponseWriter, req *http.Request) {
+	if s.shares == nil {
+		writeError(w, http.StatusNotFound, "share links not enabled")
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/s/"), "/", 2)
+	token := parts[0]
+	sh, err := s.shareGet(req.Context(), token)
+	if err != nil {
+		s.logger(req.Context()).Errorf("%v", err)
+		writeError(w, http.StatusInternalServerError, "cannot read share")
+		return
+	}
+	if sh == nil {
+		writeError(w, http.StatusNotFound, "share not found or expired")
+		return
+	}
+	if sh.Password != "" {
+		_, password, _ := req.BasicAuth()
+		if !s.shares.checkPassword(sh, password) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="s3image share"`)
+			writeError(w, http.StatusUnauthorized, "Unauthorised.")
+			return
+		}
+	}
+	if len(parts) < 2 || strings.Trim(parts[1], "/") == "" {
+		http.Redirect(w, req, fmt.Sprintf("%s/s/%s/%s", s.addrExt, sh.Token, shareTarget(sh)), http.StatusFound)
+		return
+	}
+	r := req.WithContext(context.WithValue(req.Context(), shareContextKey{}, sh))
+	u := *req.URL
+	u.Path = "/" + parts[1]
+	u.RawPath = ""
+	r.URL = &u
+	s.router.ServeHTTP(w, r)
+}
+
+// serveShared checks the permissions of the share link for the route and counts the downloads
+func (s *Server) serveShared(w http.ResponseWriter, req *http.Request, next http.Handler, sh *share, routeName, bucket, key string, folder bool) {
+	action, ok := shareRouteActions[routeName]
+	if !ok || !sh.allows(action) || !sh.covers(bucket, key) {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("%s/%s is not part of the share", bucket, key))
+		return
+	}
+	ctx := context.WithValue(req.Context(), clientIPContextKey{}, clientIP(req))
+	decision, err := s.aclDecide(ctx, bucket, key, folder, routeActions[routeName])
+	if err != nil {
+		s.aclError(w, req, bucket, key, err)
+		return
+	}
+	if decision == aclDeny {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("access to %s/%s denied", bucket, key))
+		return
+	}
+	if action != ShareView && req.Method == http.MethodGet {
+		if err := s.shareCountDownload(sh.Token); err != nil {
+			if err == errShareExhausted {
+				writeError(w, http.StatusGone, "download limit of the share reached")
+				return
+			}
+			s.logger(req.Context()).Errorf("%v", err)
+			writeError(w, http.StatusInternalServerError, "cannot count download")
+			return
+		}
+	}
+	next.ServeHTTP(w, req.WithContext(ctx))
+}
+
+// ShareCreateHandler creates a share link for /{bucket}/{path} with the options of the json body
+func (s *Server) ShareCreateHandler(w http.ResponseWriter, req *http.Request) {
+	if s.shares == nil {
+		writeJSON(w, http.StatusNotFound, manageResult{Status: "error", Message: "share links not enabled"})
+		return
+	}
+	path := strings.Trim(mux.Vars(req)["path"], "/")
+	name, key := splitPath(path)
+	if _, ok := s.current().buckets[name]; !ok {
+		writeJSON(w, http.StatusForbidden, manageResult{Status: "error", Message: fmt.Sprintf("Bucket %s not available", name)})
+		return
+	}
+	if key != "" && !validKey(key) {
+		writeJSON(w, http.StatusBadRequest, manageResult{Status: "error", Message: fmt.Sprintf("invalid path %s", path)})
+		return
+	}
+	if !jsonBody(w, req) {
+		return
+	}
+	var sr shareRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, 1<<16)).Decode(&sr); err != nil && err != io.EOF {
+		writeJSON(w, http.StatusBadRequest, manageResult{Status: "error", Message: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+	now := time.Now()
+	expires, err := s.shares.expiry(sr.Expires, now)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, manageResult{Status: "error", Message: err.Error()})
+		return
+	}
+	if len(sr.Actions) == 0 {
+		sr.Actions = []ShareAction{ShareView}
+	}
+	for _, a := range sr.Actions {
+		if a != ShareView && a != ShareDownload && a != ShareZip {
+			writeJSON(w, http.StatusBadRequest, manageResult{Status: "error", Message: fmt.Sprintf("invalid action %s", a)})
+			return
+		}
+	}
+	if sr.MaxDownloads < 0 {
+		writeJSON(w, http.StatusBadRequest, manageResult{Status: "error", Message: "invalid download limit"})
+		return
+	}
+
+	folder := key == "" || strings.HasSuffix(key, "/")
+	key = strings.Trim(key, "/")
+	if !folder {
+		exists, err := s.files(req.Context()).FileExists(name, key)
+		if err != nil {
+			s.logger(req.Context()).Errorf("cannot check %s/%s: %v", name, key, err)
+			writeJSON(w, http.StatusInternalServerError, manageResult{Status: "error", Message: fmt.Sprintf("cannot check %s", path)})
+			return
+		}
+		folder = !exists
+	}
+	if folder && key != "" {
+		de, err := s.files(req.Context()).FileList(name, key)
+		if err != nil || len(de) == 0 {
+			writeJSON(w, http.StatusNotFound, manageResult{Status: "error", Message: fmt.Sprintf("%s not found", path)})
+			return
+		}
+	}
+
+	if grant, ok := restrictedBelow(userFromContext(req.Context()), name, key, routeRoles["share"]); ok {
+		writeJSON(w, http.StatusForbidden, manageResult{Status: "error", Message: fmt.Sprintf("no permission for %s/%s", name, grant.Prefix)})
+		return
+	}
+
+	token, err := randomID()
+	if err != nil {
+		s.logger(req.Context()).Errorf("%v", err)
+		writeJSON(w, http.StatusInternalServerError, manageResult{Status: "error", Message: "cannot create token"})
+		return
+	}
+	sh := &share{
+		Token:        token,
+		Bucket:       name,
+		Key:          key,
+		Folder:       folder,
+		Creator:      s.userName(req),
+		Created:      now,
+		Expires:      expires,
+		Actions:      sr.Actions,
+		MaxDownloads: sr.MaxDownloads,
+	}
+	if sr.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(sr.Password), bcrypt.DefaultCost)
+		if err != nil {
+			s.logger(req.Context()).Errorf("cannot hash share password: %v", err)
+			writeJSON(w, http.StatusInternalServerError, manageResult{Status: "error", Message: "cannot hash password"})
+			return
+		}
+		sh.Password = string(hash)
+	}
+	if err := s.shareSave(req.Context(), sh); err != nil {
+		s.logger(req.Context()).Errorf("%v", err)
+		writeJSON(w, http.StatusInternalServerError, manageResult{Status: "error", Message: "cannot store share"})
+		return
+	}
+	s.logger(req.Context()).Infof("user %s shared %s/%s until %s", sh.Creator, name, key, expires.Format(time.RFC3339))
+	writeJSON(w, http.StatusCreated, s.shareEntry(sh))
+}
+
+// shareManager returns the authenticated user for the share list, nil if the response is already written
+func (s *Server) shareManager(w http.ResponseWriter, req *http.Request) *User {
+	if s.shares == nil {
+		writeError(w, http.StatusNotFound, "share links not enabled")
+		return nil
+	}
+	user, ok := s.authenticate(req)
+	if !ok {
+		if !s.loginRedirect(w, req) {
+			s.unauthorized(w)
+		}
+		return nil
+	}
+	return user
+}
+
+// restrictedBelow returns a grant below key, which gives user less than role.
+// a share link of key would open the content of this grant
+func restrictedBelow(user *User, bucket, key string, role Role) (Grant, bool) {
+	if user == nil {
+		return Grant{}, false
+	}
+	shared := Grant{Bucket: bucket, Prefix: key}
+	for _, g := range user.Grants {
+		if !g.Role.Includes(role) && shared.matches(g.Bucket, g.Prefix) {
+			return g, true
+		}
+	}
+	return Grant{}, false
+}
+
+// canManageShare checks whether user created the share or is admin of its target
+func canManageShare(user *User, sh *share) bool {
+	return sh.Creator == user.Name || user.RoleFor(sh.Bucket, sh.Key).Includes(RoleAdmin)
+}
+
+// SharesHandler lists the share links the user may revoke
+func (s *Server) SharesHandler(w http.ResponseWriter, req *http.Request) {
+	user := s.shareManager(w, req)
+	if user == nil {
+		return
+	}
+	shares, err := s.shareList()
+	if err != nil {
+		s.logger(req.Context()).Errorf("%v", err)
+		writeError(w, http.StatusInternalServerError, "cannot list shares")
+		return
+	}
+	var entries = []shareEntry{}
+	now := time.Now()
+	for _, sh := range shares {
+		if now.Before(sh.Expires) && canManageShare(user, sh) {
+			entries = append(entries, s.shareEntry(sh))
+		}
+	}
+	if wantsJSON(req) {
+		writeJSON(w, http.StatusOK, entries)
+		return
+	}
+	tpl, ok := s.current().templates["shares"]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no shares template")
+		return
+	}
+	if err := tpl.Execute(w, struct {
+		BasePath string
+		User     string
+		Shares   []shareEntry
+	}{s.addrExt, user.Name, entries}); err != nil {
+		s.logger(req.Context()).Errorf("error executing shares template: %v", err)
+	}
+}
+
+// ShareRevokeHandler removes the share link /_shares/{token}
+func (s *Server) ShareRevokeHandler(w http.ResponseWriter, req *http.Request) {
+	user := s.shareManager(w, req)
+	if user == nil {
+		return
+	}
+	token := mux.Vars(req)["token"]
+	sh, err := s.shareGet(req.Context(), token)
+	if err != nil {
+		s.logger(req.Context()).Errorf("%v", err)
+		writeJSON(w, http.StatusInternalServerError, manageResult{Status: "error", Message: "cannot read share"})
+		return
+	}
+	if sh == nil {
+		writeJSON(w, http.StatusNotFound, manageResult{Status: "error", Message: "share not found or expired"})
+		return
+	}
+	if !canManageShare(user, sh) {
+		writeJSON(w, http.StatusForbidden, manageResult{Status: "error", Message: fmt.Sprintf("user %s cannot revoke share %s", user.Name, token)})
+		return
+	}
+	if err := s.storeDelete(sharePrefix + token); err != nil {
+		s.logger(req.Context()).Errorf("%v", err)
+		writeJSON(w, http.StatusInternalServerError, manageResult{Status: "error", Message: "cannot revoke share"})
+		return
+	}
+	s.logger(req.Context()).Infof("user %s revoked share %s of %s/%s", user.Name, token, sh.Bucket, sh.Key)
+	writeJSON(w, http.StatusOK, manageResult{Status: "ok", Source: token})
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SortConfig defines the default order of listings
+type SortConfig struct {
+	// Default sort mode for all folders
+	Default string
+	// Folders maps bucket/folder to a sort mode, which is used for the folder and its subfolders
+	Folders map[string]string
+}
+
+const (
+	SortNatural = "natural"
+	SortLexical = "lexical"
+	SortMTime   = "mtime"
+	SortSize    = "size"
+	SortExif    = "exif"
+)
+
+// SortModes are all valid sort modes. a leading "-" reverses the order
+var SortModes = []string{SortNatural, SortLexical, SortMTime, SortSize, SortExif}
+
+// sortQuery keeps an explicit sort mode of req for links
+func sortQuery(req *http.Request) string {
+	if mode := req.URL.Query().Get("sort"); validSortMode(mode) {
+		return "?sort=" + url.QueryEscape(mode)
+	}
+	return ""
+}
+
+func validSortMode(mode string) bool {
+	mode = strings.TrimPrefix(mode, "-")
+	for _, m := range SortModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// sortMode returns the sort mode from the query parameter sort, the folder default or the global default
+func (s *Server) sortMode(req *http.Request, bucket, folder string) string {
+	if req != nil {
+		if mode := req.URL.Query().Get("sort"); validSortMode(mode) {
+			return mode
+		}
+	}
+	path := strings.Trim(bucket+"/"+strings.Trim(folder, "/"), "/")
+	var mode string
+	var match int = -1
+	for prefix, m := range s.sort.Folders {
+		prefix = strings.Trim(prefix, "/")
+		if (path == prefix || strings.HasPrefix(path, prefix+"/")) && len(prefix) > match && validSortMode(m) {
+			mode, match = m, len(prefix)
+		}
+	}
+	if mode != "" {
+		return mode
+	}
+	if validSortMode(s.sort.Default) {
+		return s.sort.Default
+	}
+	return SortNatural
+}
+
+// fileLess returns the comparison for mode. folders are always listed first
+func (s *Server) fileLess(ctx context.Context, bucket, mode string) func(a, b folderFile) bool {
+	reverse := strings.HasPrefix(mode, "-")
+	mode = strings.TrimPrefix(mode, "-")
+	var cmp func(a, b folderFile) bool
+	switch mode {
+	case SortLexical:
+		cmp = func(a, b folderFile) bool { return a.Key < b.Key }
+	case SortMTime:
+		cmp = func(a, b folderFile) bool { return a.ModTime.Before(b.ModTime) }
+	case SortSize:
+		cmp = func(a, b folderFile) bool { return a.Size < b.Size }
+	case SortExif:
+		// capture dates are cached with the image metadata. images without cached metadata
+		// are sorted by mtime until the metadata is read in the background
+		var dates = map[string]int64{}
+		captureDate := func(f folderFile) int64 {
+			if d, ok := dates[f.Key]; ok {
+				return d
+			}
+			d := f.ModTime.UnixNano()
+			if !f.IsDir {
+				meta, err := s.cachedImageMeta(ctx, bucket, f.Key)
+				switch {
+				case err == nil && meta == nil:
+					s.exif.add(s, bucket, f.Key)
+				case err == nil && !meta.CaptureDate.IsZero():
+					d = meta.CaptureDate.UnixNano()
+				}
+			}
+			dates[f.Key] = d
+			return d
+		}
+		cmp = func(a, b folderFile) bool { return captureDate(a) < captureDate(b) }
+	default:
+		cmp = func(a, b folderFile) bool { return naturalLess(a.Key, b.Key) }
+	}
+	return func(a, b folderFile) bool {
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		if reverse {
+			return cmp(b, a)
+		}
+		return cmp(a, b)
+	}
+}
+
+// sortFiles orders files by mode
+func (s *Server) sortFiles(ctx context.Context, bucket, mode string, files []folderFile) {
+	less := s.fileLess(ctx, bucket, mode)
+	sort.SliceStable(files, func(i, j int) bool {
+		return less(files[i], files[j])
+	})
+}
+
+// sortDirEntries orders the entries of a FileList by mode
+func (s *Server) sortDirEntries(ctx context.Context, bucket, mode string, de []os.DirEntry) {
+	var files = make([]folderFile, len(de))
+	for i, e := range de {
+		files[i] = dirEntryFile(bucket, e)
+	}
+	var perm = make([]int, len(de))
+	for i := range perm {
+		perm[i] = i
+	}
+	less := s.fileLess(ctx, bucket, mode)
+	sort.SliceStable(perm, func(i, j int) bool {
+		return less(files[perm[i]], files[perm[j]])
+	})
+	var sorted = make([]os.DirEntry, len(de))
+	for i, p := range perm {
+		sorted[i] = de[p]
+	}
+	copy(de, sorted)
+}
+
+// exifQueueSize is the number of images, which wait for their metadata
+const exifQueueSize = 10000
+
+// exifQueue reads the metadata for exif sorted listings in the background, one image at a time
+type exifQueue struct {
+	sync.Mutex
+	once    sync.Once
+	pending map[string]bool
+	// failed are the images without metadata, they are not read again for every listing
+	failed map[string]bool
+	jobs   chan [2]string
+}
+
+// add queues bucket/key, if it is not queued yet. if the queue is full, the image is left out
+func (eq *exifQueue) add(s *Server, bucket, key string) {
+	eq.once.Do(func() {
+		eq.pending = map[string]bool{}
+		eq.failed = map[string]bool{}
+		eq.jobs = make(chan [2]string, exifQueueSize)
+		go eq.run(s)
+	})
+	path := bucket + "/" + key
+	eq.Lock()
+	defer eq.Unlock()
+	if eq.pending[path] || eq.failed[path] {
+		return
+	}
+	select {
+	case eq.jobs <- [2]string{bucket, key}:
+		eq.pending[path] = true
+	default:
+	}
+}
+
+func (eq *exifQueue) run(s *Server) {
+	for job := range eq.jobs {
+		path := job[0] + "/" + job[1]
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		_, err := s.imageMeta(ctx, job[0], job[1])
+		cancel()
+		if err != nil {
+			s.log.Infof("cannot read capture date of %s: %v", path, err)
+		}
+		eq.Lock()
+		delete(eq.pending, path)
+		if err != nil {
+			if len(eq.failed) >= exifQueueSize {
+				eq.failed = map[string]bool{}
+			}
+			eq.failed[path] = true
+		}
+		eq.Unlock()
+	}
+}
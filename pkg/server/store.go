@@ -0,0 +1,56 @@
+package server
+
+import (
+	"context"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/je4/s3image/v2/pkg/tracing"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+// storeGet returns the stored value of key or nil
+func (s *Server) storeGet(ctx context.Context, key string) (data []byte, err error) {
+	_, span := tracer.Start(ctx, "store.get", trace.WithAttributes(attribute.String("store.key", key)))
+	defer func() { tracing.End(span, err) }()
+	if err := s.store.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(key))
+		if err != nil {
+			if err != badger.ErrKeyNotFound {
+				return errors.Wrapf(err, "cannot get %s from store", key)
+			}
+			return nil
+		}
+		data, err = item.ValueCopy(nil)
+		if err != nil {
+			return errors.Wrapf(err, "cannot get value for %s from store", key)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// storeSetTTL writes an entry, which expires after ttl
+func (s *Server) storeSetTTL(ctx context.Context, key string, data []byte, ttl time.Duration) (err error) {
+	_, span := tracer.Start(ctx, "store.set", trace.WithAttributes(attribute.String("store.key", key)))
+	defer func() { tracing.End(span, err) }()
+	if err := s.store.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry([]byte(key), data).WithTTL(ttl))
+	}); err != nil {
+		return errors.Wrapf(err, "cannot write %s to store", key)
+	}
+	return nil
+}
+
+// storeDelete removes one entry
+func (s *Server) storeDelete(key string) error {
+	if err := s.store.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(key))
+	}); err != nil {
+		return errors.Wrapf(err, "cannot delete %s from store", key)
+	}
+	return nil
+}
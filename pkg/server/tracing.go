@@ -0,0 +1,41 @@
+package server
+
+import (
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+)
+
+var tracer = otel.Tracer("github.com/je4/s3image/v2/pkg/server")
+
+// tracingMiddleware starts the span of the route. the w3c trace context of the request is the parent
+func (s *Server) tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		// shared requests are dispatched a second time, they are children of the outer span
+		if !trace.SpanContextFromContext(ctx).IsValid() {
+			ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(req.Header))
+		}
+		route := metricsRoute(req)
+		ctx, span := tracer.Start(ctx, route, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest(s.service, route, req)...))
+		defer span.End()
+		if ri := requestInfoFromContext(ctx); ri != nil {
+			span.SetAttributes(attribute.String("http.request_id", ri.id))
+		}
+		if path, ok := mux.Vars(req)["path"]; ok {
+			span.SetAttributes(attribute.String("s3image.path", path))
+		}
+		next.ServeHTTP(w, req.WithContext(ctx))
+		status := http.StatusOK
+		if mw, ok := w.(*metricsWriter); ok && mw.status != 0 {
+			status = mw.status
+		}
+		span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(status)...)
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(status, trace.SpanKindServer))
+	})
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TransformPriority orders waiting image transformations, lower values are served first
+type TransformPriority int
+
+const (
+	PriorityThumb TransformPriority = iota
+	PriorityPage
+	PriorityAdhoc
+	// PriorityExport is used for the images of zip, pdf, cbz and contact sheets. exports wait and are never rejected
+	PriorityExport
+	numPriorities
+)
+
+// profilePriority returns the priority for the derivative of profile
+func profilePriority(profile string) TransformPriority {
+	switch profile {
+	case "thumb":
+		return PriorityThumb
+	case "page":
+		return PriorityPage
+	}
+	return PriorityAdhoc
+}
+
+// TransformConfig limits the concurrent image transformations
+type TransformConfig struct {
+	// Workers is the number of parallel transformations, default is the number of cpus
+	Workers int
+	// QueueLength is the number of waiting transformations, further requests get 503
+	QueueLength int
+	// MagickThreads is the number of threads imagemagick uses for one transformation
+	MagickThreads int
+	// RetryAfter is sent to rejected clients
+	RetryAfter time.Duration
+}
+
+var errTransformBusy = errors.New("too many image transformations")
+
+type transformTicket struct {
+	bucket   string
+	priority TransformPriority
+	ready    chan struct{}
+}
+
+// transformPool hands out the worker slots. waiting tickets are served by priority,
+// tickets of the same priority round robin by bucket
+type transformPool struct {
+	sync.Mutex
+	conf    TransformConfig
+	running int
+	waiting int
+	queues  [numPriorities]map[string][]*transformTicket
+	buckets [numPriorities][]string
+}
+
+func newTransformPool(conf TransformConfig) *transformPool {
+	if conf.Workers <= 0 {
+		conf.Workers = runtime.NumCPU()
+	}
+	if conf.QueueLength < 0 {
+		conf.QueueLength = 0
+	}
+	if conf.RetryAfter <= 0 {
+		conf.RetryAfter = 5 * time.Second
+	}
+	tp := &transformPool{conf: conf}
+	for i := range tp.queues {
+		tp.queues[i] = map[string][]*transformTicket{}
+	}
+	return tp
+}
+
+// acquire waits for a worker slot. the returned function releases the slot
+func (tp *transformPool) acquire(ctx context.Context, bucket string, priority TransformPriority) (func(), error) {
+	tp.Lock()
+	if tp.running < tp.conf.Workers && tp.waiting == 0 {
+		tp.running++
+		tp.Unlock()
+		return tp.release, nil
+	}
+	if priority != PriorityExport && tp.waiting >= tp.conf.QueueLength {
+		tp.Unlock()
+		return nil, errTransformBusy
+	}
+	t := &transformTicket{bucket: bucket, priority: priority, ready: make(chan struct{})}
+	if len(tp.queues[priority][bucket]) == 0 {
+		tp.buckets[priority] = append(tp.buckets[priority], bucket)
+	}
+	tp.queues[priority][bucket] = append(tp.queues[priority][bucket], t)
+	tp.waiting++
+	tp.Unlock()
+
+	select {
+	case <-t.ready:
+		return tp.release, nil
+	case <-ctx.Done():
+		tp.Lock()
+		removed := tp.remove(t)
+		tp.Unlock()
+		if !removed {
+			// the slot was handed over in the meantime
+			tp.release()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// release passes the slot to the next waiting ticket
+func (tp *transformPool) release() {
+	tp.Lock()
+	defer tp.Unlock()
+	for p := range tp.buckets {
+		if len(tp.buckets[p]) == 0 {
+			continue
+		}
+		bucket := tp.buckets[p][0]
+		queue := tp.queues[p][bucket]
+		t := queue[0]
+		tp.buckets[p] = tp.buckets[p][1:]
+		if len(queue) > 1 {
+			tp.queues[p][bucket] = queue[1:]
+			tp.buckets[p] = append(tp.buckets[p], bucket)
+		} else {
+			delete(tp.queues[p], bucket)
+		}
+		tp.waiting--
+		close(t.ready)
+		return
+	}
+	tp.running--
+}
+
+// remove takes a waiting ticket out of its queue, false if it is not waiting anymore
+func (tp *transformPool) remove(t *transformTicket) bool {
+	queue := tp.queues[t.priority][t.bucket]
+	for i, qt := range queue {
+		if qt != t {
+			continue
+		}
+		queue = append(queue[:i], queue[i+1:]...)
+		if len(queue) > 0 {
+			tp.queues[t.priority][t.bucket] = queue
+		} else {
+			delete(tp.queues[t.priority], t.bucket)
+			buckets := tp.buckets[t.priority]
+			for j, b := range buckets {
+				if b == t.bucket {
+					tp.buckets[t.priority] = append(buckets[:j], buckets[j+1:]...)
+					break
+				}
+			}
+		}
+		tp.waiting--
+		return true
+	}
+	return false
+}
+
+// transformBusy writes 503 with Retry-After, if err is caused by a full transformation queue
+func (s *Server) transformBusy(w http.ResponseWriter, err error) bool {
+	if errors.Cause(err) != errTransformBusy {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int((s.transforms.conf.RetryAfter+time.Second-1)/time.Second)))
+	writeError(w, http.StatusServiceUnavailable, fmt.Sprintf("%v, please retry later", err))
+	return true
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waiting starts acquire in the background and returns the channel of its result
+func waiting(t *testing.T, tp *transformPool, ctx context.Context, bucket string, priority TransformPriority) chan error {
+	result := make(chan error, 1)
+	tp.Lock()
+	before := tp.waiting
+	tp.Unlock()
+	go func() {
+		_, err := tp.acquire(ctx, bucket, priority)
+		result <- err
+	}()
+	waitFor(t, func() bool {
+		tp.Lock()
+		defer tp.Unlock()
+		return tp.waiting == before+1
+	})
+	return result
+}
+
+// counts returns running and waiting tickets of tp
+func counts(tp *transformPool) (int, int) {
+	tp.Lock()
+	defer tp.Unlock()
+	return tp.running, tp.waiting
+}
+
+func TestTransformPoolAcquire(t *testing.T) {
+	tp := newTransformPool(TransformConfig{Workers: 2, QueueLength: 1})
+	ctx := context.Background()
+	release1, err := tp.acquire(ctx, "a", PriorityAdhoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tp.acquire(ctx, "a", PriorityAdhoc); err != nil {
+		t.Fatal(err)
+	}
+	if running, _ := counts(tp); running != 2 {
+		t.Errorf("%d running, expected 2", running)
+	}
+	queued := waiting(t, tp, ctx, "a", PriorityAdhoc)
+	// the queue is full
+	if _, err := tp.acquire(ctx, "a", PriorityThumb); err != errTransformBusy {
+		t.Errorf("got %v instead of errTransformBusy", err)
+	}
+	// exports are never rejected
+	export := waiting(t, tp, ctx, "a", PriorityExport)
+
+	release1()
+	if err := <-queued; err != nil {
+		t.Errorf("queued ticket got %v", err)
+	}
+	select {
+	case err := <-export:
+		t.Fatalf("export got a slot before a free worker: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if running, waiting := counts(tp); running != 2 || waiting != 1 {
+		t.Errorf("%d running and %d waiting, expected 2 and 1", running, waiting)
+	}
+}
+
+func TestTransformPoolOrder(t *testing.T) {
+	tp := newTransformPool(TransformConfig{Workers: 1, QueueLength: 10})
+	ctx := context.Background()
+	release, err := tp.acquire(ctx, "a", PriorityAdhoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// priorities first, round robin by bucket within a priority
+	a1 := waiting(t, tp, ctx, "a", PriorityAdhoc)
+	a2 := waiting(t, tp, ctx, "a", PriorityAdhoc)
+	b1 := waiting(t, tp, ctx, "b", PriorityAdhoc)
+	thumb := waiting(t, tp, ctx, "c", PriorityThumb)
+	for i, next := range []chan error{thumb, a1, b1, a2} {
+		release()
+		select {
+		case err := <-next:
+			if err != nil {
+				t.Fatalf("ticket %d: %v", i, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("ticket %d did not get the slot", i)
+		}
+	}
+	release()
+	if running, waiting := counts(tp); running != 0 || waiting != 0 {
+		t.Errorf("%d running and %d waiting after the last release", running, waiting)
+	}
+	if len(tp.buckets[PriorityAdhoc]) != 0 || len(tp.queues[PriorityAdhoc]) != 0 {
+		t.Errorf("queues not empty: %v %v", tp.buckets[PriorityAdhoc], tp.queues[PriorityAdhoc])
+	}
+}
+
+func TestTransformPoolRemove(t *testing.T) {
+	tp := newTransformPool(TransformConfig{Workers: 1, QueueLength: 10})
+	release, err := tp.acquire(context.Background(), "a", PriorityAdhoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := waiting(t, tp, ctx, "a", PriorityAdhoc)
+	other := waiting(t, tp, context.Background(), "b", PriorityAdhoc)
+	cancel()
+	if err := <-canceled; err != context.Canceled {
+		t.Errorf("canceled ticket got %v", err)
+	}
+	tp.Lock()
+	if tp.waiting != 1 || len(tp.queues[PriorityAdhoc]["a"]) != 0 || len(tp.buckets[PriorityAdhoc]) != 1 {
+		t.Errorf("canceled ticket not removed: %d waiting, buckets %v", tp.waiting, tp.buckets[PriorityAdhoc])
+	}
+	// a ticket, which is not queued anymore, is not removed
+	if tp.remove(&transformTicket{bucket: "a", priority: PriorityAdhoc}) {
+		t.Errorf("unknown ticket removed")
+	}
+	tp.Unlock()
+
+	release()
+	if err := <-other; err != nil {
+		t.Errorf("remaining ticket got %v", err)
+	}
+	if running, waiting := counts(tp); running != 1 || waiting != 0 {
+		t.Errorf("%d running and %d waiting, expected 1 and 0", running, waiting)
+	}
+}
+
+// waitFor polls cond until it is true or a second has passed
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not reached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
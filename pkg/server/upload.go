@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/je4/s3image/v2/pkg/filesystem"
+	"github.com/je4/s3image/v2/pkg/media"
+	"github.com/pkg/errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// UploadConfig controls the upload endpoints
+type UploadConfig struct {
+	Enabled bool
+	// Verify decodes the payload before it is written. Needs to buffer the whole upload in memory
+	// and therefore MaxSize or the size limit of masters
+	Verify bool
+	// MaxSize limits the size of one upload in bytes (0: unlimited)
+	MaxSize int64
+}
+
+// limit returns the size limit of a verified upload, the smaller of MaxSize and the size limit of masters (0: unlimited)
+func (uc UploadConfig) limit(input InputConfig) int64 {
+	if uc.MaxSize > 0 && (input.MaxSize <= 0 || uc.MaxSize < input.MaxSize) {
+		return uc.MaxSize
+	}
+	return input.MaxSize
+}
+
+// detectContentType sniffs the content type from the first bytes of r and falls back to the extension of name
+func detectContentType(name string, r *bufio.Reader) string {
+	head, _ := r.Peek(512)
+	contentType := http.DetectContentType(head)
+	if contentType == "application/octet-stream" {
+		if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+			contentType = ct
+		}
+	}
+	return contentType
+}
+
+// writeUpload streams r into the filesystem and removes outdated derivatives from the cache
+func (s *Server) writeUpload(ctx context.Context, bucket, key string, r io.Reader, size int64) error {
+	if key == "" || strings.Contains("/"+key+"/", "/../") || filepath.Base(key) == aclSidecar {
+		return &invalidUploadError{err: errors.Errorf("invalid key %s", key)}
+	}
+	br := bufio.NewReaderSize(r, 4096)
+	contentType := detectContentType(key, br)
+	var reader io.Reader = br
+	if s.upload.Verify {
+		// the buffer does not grow beyond the limit
+		limit := s.upload.limit(s.input)
+		buf := bytes.NewBuffer(nil)
+		if _, err := io.Copy(buf, io.LimitReader(br, limit+1)); err != nil {
+			return errors.Wrapf(err, "cannot read upload %s/%s", bucket, key)
+		}
+		if int64(buf.Len()) > limit {
+			return &invalidUploadError{err: errors.Errorf("%s/%s is larger than %d bytes", bucket, key, limit)}
+		}
+		if err := s.checkInput(buf.Bytes()); err != nil {
+			return &invalidUploadError{err: errors.Wrapf(err, "%s/%s is not a valid image", bucket, key)}
+		}
+		release, err := s.acquireTransform(ctx, bucket, PriorityExport, "verify", strings.ToLower(media.DetectFormat(buf.Bytes())))
+		if err != nil {
+			return errors.Wrapf(err, "cannot verify upload %s/%s", bucket, key)
+		}
+		err = s.images.Verify(ctx, buf.Bytes())
+		release()
+		if err != nil {
+			return &invalidUploadError{err: errors.Wrapf(err, "%s/%s is not a valid image", bucket, key)}
+		}
+		size = int64(buf.Len())
+		reader = buf
+	}
+	s.logger(ctx).Infof("uploading %s/%s [%s]", bucket, key, contentType)
+	if err := s.files(ctx).FileWrite(bucket, key, reader, size, filesystem.FilePutOptions{ContentType: contentType}); err != nil {
+		return errors.Wrapf(err, "cannot write %s/%s", bucket, key)
+	}
+	if err := s.cacheInvalidate(fmt.Sprintf("%s/%s", bucket, key)); err != nil {
+		s.logger(ctx).Errorf("cannot invalidate cache: %v", err)
+	}
+	return nil
+}
+
+type invalidUploadError struct {
+	err error
+}
+
+func (iu *invalidUploadError) Error() string {
+	return iu.err.Error()
+}
+
+func uploadErrorStatus(err error) int {
+	if _, ok := errors.Cause(err).(*invalidUploadError); ok {
+		return http.StatusBadRequest
+	}
+	// http.MaxBytesReader does not return a typed error in go 1.17
+	if strings.Contains(err.Error(), "request body too large") {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// UploadHandler stores the request body as /{bucket}/{path}
+func (s *Server) UploadHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	path := strings.Trim(vars["path"], "/")
+
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) < 2 || parts[1] == "" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid path %s", path))
+		return
+	}
+	var name = parts[0]
+	var key = parts[1]
+
+	if !s.upload.Enabled {
+		writeError(w, http.StatusMethodNotAllowed, "upload not enabled")
+		return
+	}
+	_, ok := s.current().buckets[name]
+	if !ok {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("Bucket %s not available", name))
+		return
+	}
+
+	var body io.Reader = req.Body
+	if s.upload.MaxSize > 0 {
+		body = http.MaxBytesReader(w, req.Body, s.upload.MaxSize)
+	}
+	size := req.ContentLength
+	if size < 0 {
+		size = -1
+	}
+	if err := s.writeUpload(req.Context(), name, key, body, size); err != nil {
+		s.logger(req.Context()).Errorf("cannot upload %s: %v", path, err)
+		writeError(w, uploadErrorStatus(err), fmt.Sprintf("cannot upload %s: %v", path, err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(fmt.Sprintf("%s/%s", s.addrExt, path)))
+}
+
+// UploadFormHandler stores all files of a multipart form in the folder /{bucket}/{folder}
+func (s *Server) UploadFormHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	path := strings.Trim(vars["path"], "/")
+
+	parts := strings.SplitN(path, "/", 2)
+	if parts[0] == "" {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid path %s", path))
+		return
+	}
+	var name = parts[0]
+	var folder string
+	if len(parts) >= 2 {
+		folder = parts[1]
+	}
+
+	if !s.upload.Enabled {
+		writeError(w, http.StatusMethodNotAllowed, "upload not enabled")
+		return
+	}
+	_, ok := s.current().buckets[name]
+	if !ok {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("Bucket %s not available", name))
+		return
+	}
+
+	if s.upload.MaxSize > 0 {
+		req.Body = http.MaxBytesReader(w, req.Body, s.upload.MaxSize)
+	}
+	mr, err := req.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("no multipart form: %v", err))
+		return
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, uploadErrorStatus(err), fmt.Sprintf("cannot read multipart form: %v", err))
+			return
+		}
+		filename := filepath.Base(strings.ReplaceAll(part.FileName(), "\\", "/"))
+		if part.FormName() != "file" || filename == "." || filename == "/" {
+			part.Close()
+			continue
+		}
+		key := strings.TrimLeft(fmt.Sprintf("%s/%s", folder, filename), "/")
+		if err := s.writeUpload(req.Context(), name, key, part, -1); err != nil {
+			part.Close()
+			s.logger(req.Context()).Errorf("cannot upload %s/%s: %v", name, key, err)
+			writeError(w, uploadErrorStatus(err), fmt.Sprintf("cannot upload %s/%s: %v", name, key, err))
+			return
+		}
+		part.Close()
+	}
+	http.Redirect(w, req, fmt.Sprintf("%s/%s", s.addrExt, path), http.StatusSeeOther)
+}
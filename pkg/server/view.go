@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/je4/s3image/v2/pkg/filesystem"
+	"github.com/je4/s3image/v2/pkg/media"
+	"github.com/pkg/errors"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type contentTyper interface {
+	ContentType() string
+}
+
+// cachedImageMeta returns the technical metadata of bucket/key, if it is in the cache, or nil
+func (s *Server) cachedImageMeta(ctx context.Context, bucket, key string) (*media.CoreMeta, error) {
+	data, err := s.cacheGet(ctx, fmt.Sprintf("%s/%s/meta", bucket, key))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var cm = &media.CoreMeta{}
+	if err := json.Unmarshal(data, cm); err != nil {
+		return nil, nil
+	}
+	return cm, nil
+}
+
+// imageMeta returns the technical metadata of bucket/key from cache or identifies the master
+func (s *Server) imageMeta(ctx context.Context, bucket, key string) (*media.CoreMeta, error) {
+	cm, err := s.cachedImageMeta(ctx, bucket, key)
+	if err != nil || cm != nil {
+		return cm, err
+	}
+	cacheKey := fmt.Sprintf("%s/%s/meta", bucket, key)
+	master, contentType, err := s.readImage(ctx, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	if cm, err = s.images.Identify(ctx, master); err != nil {
+		return nil, errors.Wrapf(err, "cannot identify %s/%s", bucket, key)
+	}
+	if contentType != "" {
+		cm.Mimetype = contentType
+	}
+	data, err := json.Marshal(cm)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot marshal metadata of %s/%s", bucket, key)
+	}
+	if err := s.cacheSet(ctx, cacheKey, data); err != nil {
+		s.logger(ctx).Errorf("cannot write metadata to cache: %v", err)
+	}
+	return cm, nil
+}
+
+// ViewHandler shows a large derivative of /{bucket}/{path} with metadata and navigation to the siblings
+func (s *Server) ViewHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	path := strings.Trim(vars["path"], "/")
+
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) < 2 || parts[1] == "" {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("invalid path %s", path))
+		return
+	}
+	var name = parts[0]
+	var key = parts[1]
+
+	_, ok := s.current().buckets[name]
+	if !ok {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("Bucket %s not available", name))
+		return
+	}
+
+	tpl, ok := s.current().templates["image"]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no image template")
+		return
+	}
+
+	info, err := s.files(req.Context()).FileStat(name, key, filesystem.FileStatOptions{})
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("cannot open file %s", path))
+		return
+	}
+	var contentType string
+	if ct, ok := info.(contentTyper); ok {
+		contentType = ct.ContentType()
+	}
+	meta, err := s.imageMeta(req.Context(), name, key)
+	if err != nil {
+		s.logger(req.Context()).Infof("no metadata for %s: %v", path, err)
+	}
+
+	// siblings in listing order
+	dir := filepath.Dir("/" + key)
+	folder := strings.Trim(dir, "/")
+	var prev, next string
+	files, err := s.listSorted(req.Context(), name, folder, false, s.sortMode(req, name, folder))
+	if err != nil {
+		s.logger(req.Context()).Infof("cannot read folder %s/%s: %v", name, folder, err)
+	}
+	for i, f := range files {
+		if f.Key != key {
+			continue
+		}
+		if i > 0 {
+			prev = fmt.Sprintf("%s/%s", name, files[i-1].Key)
+		}
+		if i < len(files)-1 {
+			next = fmt.Sprintf("%s/%s", name, files[i+1].Key)
+		}
+		break
+	}
+
+	var profiles = []string{}
+	for p := range defaultProfiles {
+		profiles = append(profiles, p)
+	}
+	sort.Strings(profiles)
+
+	buf := bytes.NewBuffer(nil)
+	if err := tpl.Execute(buf, struct {
+		BasePath    string
+		Path        string
+		Name        string
+		Folder      string
+		Size        int64
+		ModTime     time.Time
+		ContentType string
+		Meta        *media.CoreMeta
+		Profiles    []string
+		Prev, Next  string
+		Query       string
+	}{
+		BasePath:    s.basePath(req),
+		Path:        path,
+		Name:        filepath.Base(key),
+		Folder:      strings.TrimRight(fmt.Sprintf("%s/%s", name, folder), "/"),
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+		ContentType: contentType,
+		Meta:        meta,
+		Profiles:    profiles,
+		Prev:        prev,
+		Next:        next,
+		Query:       sortQuery(req),
+	}); err != nil {
+		s.logger(req.Context()).Errorf("error executing image template: %v", err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("error executing image template: %v", err))
+		return
+	}
+	w.Header().Set("Content-type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// ProfileHandler returns the derivative /{bucket}/{path}/profile/{profile}
+func (s *Server) ProfileHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	path := strings.Trim(vars["path"], "/")
+	profile := vars["profile"]
+
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) < 2 || parts[1] == "" {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("invalid path %s", path))
+		return
+	}
+	var name = parts[0]
+	var key = parts[1]
+
+	_, ok := s.current().buckets[name]
+	if !ok {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("Bucket %s not available", name))
+		return
+	}
+	opts, ok := defaultProfiles[profile]
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unknown profile %s", profile))
+		return
+	}
+	if req.URL.Query().Get("download") == "true" {
+		base := filepath.Base(key)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s_%s.%s\"", strings.TrimSuffix(base, filepath.Ext(base)), profile, strings.ToLower(opts.TargetFormat)))
+	}
+	s.serveDerivative(w, req, name, key, profile)
+}
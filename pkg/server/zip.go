@@ -0,0 +1,184 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/je4/s3image/v2/pkg/filesystem"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ZipConfig limits the folder downloads
+type ZipConfig struct {
+	// MaxSize is the maximum sum of master sizes in bytes (0: unlimited). derivatives are counted,
+	// while they are written. the files after the limit are listed as SKIPPED in the manifest
+	MaxSize int64
+	// MaxFiles is the maximum number of files (0: unlimited)
+	MaxFiles int
+}
+
+// ZipHandler streams the content of /{bucket}/{folder} as zip archive.
+// query parameters: recursive=true includes subfolders, profile=<name> zips derivatives instead of masters
+func (s *Server) ZipHandler(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	path := strings.Trim(vars["path"], "/")
+
+	parts := strings.SplitN(path, "/", 2)
+	if parts[0] == "" {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("invalid path %s", path))
+		return
+	}
+	var name = parts[0]
+	var folder string
+	if len(parts) >= 2 {
+		folder = parts[1]
+	}
+
+	_, ok := s.current().buckets[name]
+	if !ok {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("Bucket %s not available", name))
+		return
+	}
+
+	recursive := req.URL.Query().Get("recursive") == "true"
+	profile := req.URL.Query().Get("profile")
+	if _, ok := defaultProfiles[profile]; profile != "" && !ok {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown profile %s", profile))
+		return
+	}
+
+	ctx := req.Context()
+	files, err := s.listSorted(ctx, name, folder, recursive, s.sortMode(req, name, folder))
+	if err != nil {
+		s.logger(req.Context()).Infof("cannot read folder %s: %v", path, err)
+		writeError(w, http.StatusNotFound, fmt.Sprintf("cannot read folder %s: %v", path, err))
+		return
+	}
+	// masters or derivatives of the allowed files only
+	if profile == "" {
+		files = s.filterFiles(ctx, name, files, ACLMaster, RoleDownloader)
+	} else {
+		files = s.filterFiles(ctx, name, files, ACLDerivative, RoleDownloader)
+	}
+	if s.zip.MaxFiles > 0 && len(files) > s.zip.MaxFiles {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("%s has %d files, maximum is %d", path, len(files), s.zip.MaxFiles))
+		return
+	}
+	if s.zip.MaxSize > 0 && profile == "" {
+		var size int64
+		for _, f := range files {
+			size += f.Size
+		}
+		if size > s.zip.MaxSize {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("%s has %d bytes, maximum is %d", path, size, s.zip.MaxSize))
+			return
+		}
+	}
+
+	zipName := filepath.Base("/" + path)
+	if profile != "" {
+		zipName += "_" + profile
+	}
+	w.Header().Set("Content-type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.zip\"", zipName))
+
+	zw := zip.NewWriter(w)
+	manifest := bytes.NewBuffer(nil)
+	prefix := strings.Trim(folder, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	// a.tif and a.png are both a.jpg with a profile. manifest.txt is reserved for the manifest
+	used := map[string]bool{"manifest.txt": true}
+	var size int64
+	for i, f := range files {
+		if err := ctx.Err(); err != nil {
+			s.logger(req.Context()).Infof("zip download of %s canceled: %v", path, err)
+			return
+		}
+		entryName := strings.TrimPrefix(f.Key, prefix)
+		var src io.Reader
+		modTime := f.ModTime
+		if profile == "" {
+			r, _, err := s.files(req.Context()).FileOpenRead(name, f.Key, filesystem.FileGetOptions{})
+			if err != nil {
+				s.logger(req.Context()).Errorf("cannot open %s/%s: %v", name, f.Key, err)
+				fmt.Fprintf(manifest, "ERROR  %s\n", entryName)
+				continue
+			}
+			src = r
+		} else {
+			data, _, err := s.derivative(ctx, name, f.Key, profile, PriorityExport)
+			if err != nil {
+				s.logger(req.Context()).Errorf("cannot create %s of %s/%s: %v", profile, name, f.Key, err)
+				fmt.Fprintf(manifest, "ERROR  %s\n", entryName)
+				continue
+			}
+			if s.zip.MaxSize > 0 && size+int64(len(data)) > s.zip.MaxSize {
+				for _, skipped := range files[i:] {
+					fmt.Fprintf(manifest, "SKIPPED  %s\n", strings.TrimPrefix(skipped.Key, prefix))
+				}
+				s.logger(req.Context()).Infof("zip of %s reached the maximum size %d", path, s.zip.MaxSize)
+				break
+			}
+			size += int64(len(data))
+			entryName = strings.TrimSuffix(entryName, filepath.Ext(entryName)) + "." + strings.ToLower(defaultProfiles[profile].TargetFormat)
+			src = bytes.NewReader(data)
+		}
+		entryName = uniqueEntryName(used, entryName)
+		if modTime.IsZero() {
+			modTime = time.Now()
+		}
+		// images are already compressed
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     entryName,
+			Method:   zip.Store,
+			Modified: modTime,
+		})
+		if err != nil {
+			closeReader(src)
+			s.logger(req.Context()).Errorf("cannot create zip entry %s: %v", entryName, err)
+			return
+		}
+		h := sha256.New()
+		_, err = io.Copy(io.MultiWriter(fw, h), ctxReader{ctx: ctx, r: src})
+		closeReader(src)
+		if err != nil {
+			s.logger(req.Context()).Errorf("cannot write %s/%s to zip: %v", name, f.Key, err)
+			return
+		}
+		fmt.Fprintf(manifest, "%s  %s\n", hex.EncodeToString(h.Sum(nil)), entryName)
+	}
+	fw, err := zw.Create("manifest.txt")
+	if err != nil {
+		s.logger(req.Context()).Errorf("cannot create manifest.txt: %v", err)
+		return
+	}
+	if _, err := io.Copy(fw, manifest); err != nil {
+		s.logger(req.Context()).Errorf("cannot write manifest.txt: %v", err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		s.logger(req.Context()).Errorf("cannot finish zip of %s: %v", path, err)
+	}
+}
+
+// uniqueEntryName returns name or name_2, name_3... before the extension, if name is used already.
+// names are compared case insensitive because of the file systems of the clients
+func uniqueEntryName(used map[string]bool, name string) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	unique := name
+	for i := 2; used[strings.ToLower(unique)]; i++ {
+		unique = fmt.Sprintf("%s_%d%s", base, i, ext)
+	}
+	used[strings.ToLower(unique)] = true
+	return unique
+}
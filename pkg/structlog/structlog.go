@@ -0,0 +1,133 @@
+package structlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/op/go-logging"
+	"io"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Fields are the structured values of a log line
+type Fields map[string]interface{}
+
+// entry is the message of a log line with its fields. it is formatted lazily,
+// the string formatters of go-logging print the fields after the message
+type entry struct {
+	format string
+	args   []interface{}
+	fields Fields
+}
+
+func (e *entry) message() string {
+	return fmt.Sprintf(e.format, e.args...)
+}
+
+func (e *entry) String() string {
+	if len(e.fields) == 0 {
+		return e.message()
+	}
+	keys := make([]string, 0, len(e.fields))
+	for key := range e.fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	sb.WriteString(e.message())
+	sb.WriteString(" [")
+	for i, key := range keys {
+		if i > 0 {
+			sb.WriteString(" ")
+		}
+		fmt.Fprintf(&sb, "%s=%v", key, e.fields[key])
+	}
+	sb.WriteString("]")
+	return sb.String()
+}
+
+// Logger adds fields to the lines of a go-logging logger
+type Logger struct {
+	log    *logging.Logger
+	fields Fields
+}
+
+func New(log *logging.Logger) *Logger {
+	// the methods of Logger are one more frame between the caller and go-logging
+	wrapped := *log
+	wrapped.ExtraCalldepth++
+	return &Logger{log: &wrapped, fields: Fields{}}
+}
+
+// With returns a logger with additional fields. empty values are left out
+func (l *Logger) With(fields Fields) *Logger {
+	result := &Logger{log: l.log, fields: make(Fields, len(l.fields)+len(fields))}
+	for key, value := range l.fields {
+		result.fields[key] = value
+	}
+	for key, value := range fields {
+		if value == nil || value == "" {
+			continue
+		}
+		result.fields[key] = value
+	}
+	return result
+}
+
+func (l *Logger) entry(format string, args []interface{}) *entry {
+	return &entry{format: format, args: args, fields: l.fields}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log.Debugf("%v", l.entry(format, args))
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log.Infof("%v", l.entry(format, args))
+}
+
+func (l *Logger) Warningf(format string, args ...interface{}) {
+	l.log.Warningf("%v", l.entry(format, args))
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log.Errorf("%v", l.entry(format, args))
+}
+
+// JSONFormatter writes every record as one json object per line
+type JSONFormatter struct{}
+
+func (JSONFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	line := map[string]interface{}{}
+	message := ""
+	if e, ok := recordEntry(r); ok {
+		for key, value := range e.fields {
+			line[key] = value
+		}
+		message = e.message()
+	} else {
+		message = r.Message()
+	}
+	line["time"] = r.Time.Format(time.RFC3339Nano)
+	line["level"] = strings.ToLower(r.Level.String())
+	line["module"] = r.Module
+	line["msg"] = message
+	if pc, file, lineNo, ok := runtime.Caller(calldepth + 1); ok {
+		line["caller"] = fmt.Sprintf("%s:%d", filepath.Base(file), lineNo)
+		if f := runtime.FuncForPC(pc); f != nil {
+			line["func"] = f.Name()
+		}
+	}
+	return json.NewEncoder(w).Encode(line)
+}
+
+func recordEntry(r *logging.Record) (*entry, bool) {
+	if len(r.Args) != 1 {
+		return nil, false
+	}
+	e, ok := r.Args[0].(*entry)
+	return e, ok
+}
@@ -0,0 +1,85 @@
+package tracing
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+)
+
+// Config defines the export of the spans
+type Config struct {
+	Enabled bool
+	// Exporter is "otlp" (http) or "stdout" for local testing
+	Exporter string
+	// Endpoint is host:port of the otlp collector, default from OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4318
+	Endpoint string
+	Insecure bool
+	// SampleRatio is the part of the traces without sampled parent, which are recorded. default is 1
+	SampleRatio float64
+}
+
+// Init installs the global tracer provider and the w3c trace context propagator.
+// the returned function flushes the remaining spans
+func Init(conf Config, service string) (func(ctx context.Context) error, error) {
+	if !conf.Enabled {
+		return func(ctx context.Context) error { return nil }, nil
+	}
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch conf.Exporter {
+	case "", "otlp":
+		var opts []otlptracehttp.Option
+		if conf.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(conf.Endpoint))
+		}
+		if conf.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, errors.Errorf("unknown trace exporter %s", conf.Exporter)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot create %s trace exporter", conf.Exporter)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceNameKey.String(service),
+		semconv.ProcessPIDKey.Int(os.Getpid()),
+	))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create trace resource")
+	}
+	ratio := conf.SampleRatio
+	if ratio <= 0 {
+		ratio = 1
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+// End records err in span and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,256 @@
+package worker
+
+import (
+	"context"
+	"encoding/gob"
+	"github.com/je4/s3image/v2/pkg/media"
+	"github.com/je4/s3image/v2/pkg/tracing"
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// PoolConfig defines the worker processes
+type PoolConfig struct {
+	// Executable and Args start one worker process, which has to call Run
+	Executable string
+	Args       []string
+	// Processes is the number of worker processes, default is the number of cpus
+	Processes int
+	// Timeout of one job, the worker process is killed and restarted after it
+	Timeout time.Duration
+}
+
+// process is one running worker
+type process struct {
+	cmd       *exec.Cmd
+	requests  *os.File
+	responses *os.File
+	enc       *gob.Encoder
+	dec       *gob.Decoder
+	exited    chan struct{}
+}
+
+// kill stops the process immediately
+func (proc *process) kill() {
+	proc.cmd.Process.Kill()
+	proc.requests.Close()
+	proc.responses.Close()
+	<-proc.exited
+}
+
+// stop closes the requests of the process and kills it, if it does not end
+func (proc *process) stop() {
+	proc.requests.Close()
+	select {
+	case <-proc.exited:
+	case <-time.After(5 * time.Second):
+		proc.cmd.Process.Kill()
+		<-proc.exited
+	}
+	proc.responses.Close()
+}
+
+// Pool runs the operations in child processes. a crashed or timed out process is replaced on the next job
+type Pool struct {
+	conf PoolConfig
+	log  *logging.Logger
+	// slots holds the idle processes, nil for a process, which is not (re)started yet
+	slots chan *process
+}
+
+func NewPool(conf PoolConfig, log *logging.Logger) *Pool {
+	if conf.Processes <= 0 {
+		conf.Processes = runtime.NumCPU()
+	}
+	p := &Pool{conf: conf, log: log, slots: make(chan *process, conf.Processes)}
+	for i := 0; i < conf.Processes; i++ {
+		p.slots <- nil
+	}
+	return p
+}
+
+func (p *Pool) start() (*process, error) {
+	reqR, reqW, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create request pipe")
+	}
+	respR, respW, err := os.Pipe()
+	if err != nil {
+		reqR.Close()
+		reqW.Close()
+		return nil, errors.Wrap(err, "cannot create response pipe")
+	}
+	cmd := exec.Command(p.conf.Executable, p.conf.Args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{reqR, respW}
+	err = cmd.Start()
+	// the child ends of the pipes belong to the worker now
+	reqR.Close()
+	respW.Close()
+	if err != nil {
+		reqW.Close()
+		respR.Close()
+		return nil, errors.Wrapf(err, "cannot start %s", p.conf.Executable)
+	}
+	proc := &process{
+		cmd:       cmd,
+		requests:  reqW,
+		responses: respR,
+		enc:       gob.NewEncoder(reqW),
+		dec:       gob.NewDecoder(respR),
+		exited:    make(chan struct{}),
+	}
+	go func() {
+		cmd.Wait()
+		close(proc.exited)
+	}()
+	p.log.Infof("worker process %d started", cmd.Process.Pid)
+	return proc, nil
+}
+
+// do sends req to an idle worker process and waits for the response
+func (p *Pool) do(ctx context.Context, req *Request) (resp *Response, err error) {
+	ctx, span := tracer.Start(ctx, "worker."+string(req.Op), trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	req.Trace = carrier
+
+	var proc *process
+	select {
+	case proc = <-p.slots:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if proc != nil {
+		select {
+		case <-proc.exited:
+			p.log.Errorf("worker process %d died while idle: %v", proc.cmd.Process.Pid, proc.cmd.ProcessState)
+			proc.kill()
+			proc = nil
+		default:
+		}
+	}
+	if proc == nil {
+		if proc, err = p.start(); err != nil {
+			p.slots <- nil
+			return nil, errors.Wrap(err, "cannot start worker process")
+		}
+	}
+	pid := proc.cmd.Process.Pid
+	span.SetAttributes(attribute.Int("worker.pid", pid))
+
+	resp = &Response{}
+	result := make(chan error, 1)
+	go func() {
+		if err := proc.enc.Encode(req); err != nil {
+			result <- errors.Wrap(err, "cannot send request")
+			return
+		}
+		if err := proc.dec.Decode(resp); err != nil {
+			result <- errors.Wrap(err, "cannot read response")
+			return
+		}
+		result <- nil
+	}()
+	// a canceled caller does not wait for the job, but the process is only killed on the timeout.
+	// otherwise it finishes the job and goes back to the pool
+	done := make(chan error, 1)
+	go func() { done <- p.wait(proc, req.Op, result) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+		return resp, nil
+	case <-ctx.Done():
+		return nil, errors.Wrapf(ctx.Err(), "%s canceled, worker process %d finishes it", req.Op, pid)
+	}
+}
+
+// wait waits for the result of the job of proc or the timeout and puts the process or a free slot back into the pool
+func (p *Pool) wait(proc *process, op Op, result chan error) error {
+	pid := proc.cmd.Process.Pid
+	var timeout <-chan time.Time
+	if p.conf.Timeout > 0 {
+		timer := time.NewTimer(p.conf.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			// the process crashed, e.g. because of the memory limit
+			proc.kill()
+			p.slots <- nil
+			p.log.Errorf("worker process %d failed on %s: %v (%v)", pid, op, err, proc.cmd.ProcessState)
+			return errors.Wrapf(err, "worker process %d failed on %s", pid, op)
+		}
+		p.slots <- proc
+		return nil
+	case <-timeout:
+		proc.kill()
+		<-result
+		p.slots <- nil
+		p.log.Errorf("worker process %d killed on %s after %v", pid, op, p.conf.Timeout)
+		return errors.Wrapf(context.DeadlineExceeded, "worker process %d killed on %s", pid, op)
+	}
+}
+
+// Close stops all worker processes. running jobs are finished first
+func (p *Pool) Close() {
+	for i := 0; i < p.conf.Processes; i++ {
+		if proc := <-p.slots; proc != nil {
+			proc.stop()
+		}
+	}
+}
+
+func (p *Pool) Derivative(ctx context.Context, master []byte, opts media.ImageOptions) ([]byte, error) {
+	resp, err := p.do(ctx, &Request{Op: OpDerivative, Master: master, Options: opts})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, resp.err()
+}
+
+func (p *Pool) Identify(ctx context.Context, master []byte) (*media.CoreMeta, error) {
+	resp, err := p.do(ctx, &Request{Op: OpIdentify, Master: master})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Meta, resp.err()
+}
+
+func (p *Pool) Verify(ctx context.Context, master []byte) error {
+	resp, err := p.do(ctx, &Request{Op: OpVerify, Master: master})
+	if err != nil {
+		return err
+	}
+	return resp.err()
+}
+
+func (p *Pool) Tiles(ctx context.Context, master []byte, level, tileSize, overlap int, format string, region media.DZIRegion) ([]Tile, error) {
+	resp, err := p.do(ctx, &Request{Op: OpTiles, Master: master, Level: level, TileSize: tileSize, Overlap: overlap, Format: format, Region: region})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Tiles, resp.err()
+}
+
+func (p *Pool) ContactSheet(ctx context.Context, cells []media.ContactSheetCell, opts media.ContactSheetOptions) ([]byte, error) {
+	resp, err := p.do(ctx, &Request{Op: OpContactSheet, Cells: cells, Sheet: opts})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, resp.err()
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package worker
+
+import "syscall"
+
+// setMemoryLimit restricts the address space of the current process
+func setMemoryLimit(limit uint64) error {
+	return syscall.Setrlimit(syscall.RLIMIT_AS, &syscall.Rlimit{Cur: limit, Max: limit})
+}
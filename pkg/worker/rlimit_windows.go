@@ -0,0 +1,7 @@
+package worker
+
+import "github.com/pkg/errors"
+
+func setMemoryLimit(limit uint64) error {
+	return errors.New("memory limit not supported on windows")
+}
@@ -0,0 +1,271 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"github.com/je4/s3image/v2/pkg/media"
+	"github.com/je4/s3image/v2/pkg/tracing"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"io"
+	"os"
+)
+
+var tracer = otel.Tracer("github.com/je4/s3image/v2/pkg/worker")
+
+// Transformer runs the image operations of the media package
+type Transformer interface {
+	// Derivative resizes master and encodes it in opts.TargetFormat
+	Derivative(ctx context.Context, master []byte, opts media.ImageOptions) ([]byte, error)
+	// Identify returns the technical metadata of master
+	Identify(ctx context.Context, master []byte) (*media.CoreMeta, error)
+	// Verify checks, whether master can be decoded
+	Verify(ctx context.Context, master []byte) error
+	// Tiles cuts the tiles of region at one deep zoom level
+	Tiles(ctx context.Context, master []byte, level, tileSize, overlap int, format string, region media.DZIRegion) ([]Tile, error)
+	// ContactSheet renders the cells as grid into one image
+	ContactSheet(ctx context.Context, cells []media.ContactSheetCell, opts media.ContactSheetOptions) ([]byte, error)
+}
+
+type Op string
+
+const (
+	OpDerivative   Op = "derivative"
+	OpIdentify     Op = "identify"
+	OpVerify       Op = "verify"
+	OpTiles        Op = "tiles"
+	OpContactSheet Op = "contactsheet"
+)
+
+// Tile is one deep zoom tile
+type Tile struct {
+	Col, Row int
+	Data     []byte
+}
+
+// Request is sent from the pool to a worker process
+type Request struct {
+	Op       Op
+	Master   []byte
+	Options  media.ImageOptions
+	Level    int
+	TileSize int
+	Overlap  int
+	Region   media.DZIRegion
+	Format   string
+	Cells    []media.ContactSheetCell
+	Sheet    media.ContactSheetOptions
+	// Trace is the w3c trace context of the caller
+	Trace map[string]string
+}
+
+// Response is the result of a request
+type Response struct {
+	Data  []byte
+	Meta  *media.CoreMeta
+	Tiles []Tile
+	Err   string
+	// TooLarge restores media.ErrImageTooLarge as cause of the error
+	TooLarge bool
+}
+
+// remoteError is an error of a worker process with a known cause
+type remoteError struct {
+	msg   string
+	cause error
+}
+
+func (re *remoteError) Error() string {
+	return re.msg
+}
+
+func (re *remoteError) Cause() error {
+	return re.cause
+}
+
+func (resp *Response) err() error {
+	if resp.Err == "" {
+		return nil
+	}
+	if resp.TooLarge {
+		return &remoteError{msg: resp.Err, cause: media.ErrImageTooLarge}
+	}
+	return errors.New(resp.Err)
+}
+
+// Local runs the operations in the current process
+type Local struct{}
+
+func (l Local) Derivative(ctx context.Context, master []byte, opts media.ImageOptions) (data []byte, err error) {
+	ctx, span := tracer.Start(ctx, "image.derivative")
+	span.SetAttributes(
+		attribute.Int64("image.width", opts.Width),
+		attribute.Int64("image.height", opts.Height),
+		attribute.String("image.action", string(opts.ActionType)),
+		attribute.String("image.format", opts.TargetFormat),
+	)
+	defer func() { tracing.End(span, err) }()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	image, err := l.load(ctx, master)
+	if err != nil {
+		return nil, err
+	}
+	defer image.Close()
+
+	_, resize := tracer.Start(ctx, "image.resize")
+	err = image.Resize(&opts)
+	tracing.End(resize, err)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot resize image")
+	}
+
+	_, store := tracer.Start(ctx, "image.store")
+	defer func() { tracing.End(store, err) }()
+	reader, _, err := image.StoreImage(opts.TargetFormat)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot store image")
+	}
+	defer reader.Close()
+	data, err = io.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot output image")
+	}
+	return data, nil
+}
+
+// load decodes master
+func (Local) load(ctx context.Context, master []byte) (media.ImageType, error) {
+	_, span := tracer.Start(ctx, "image.load")
+	span.SetAttributes(attribute.Int("image.size", len(master)))
+	image, err := media.NewImageMagickV3(bytes.NewReader(master))
+	if err != nil {
+		err = errors.Wrap(err, "cannot read image")
+	}
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+func (Local) Identify(ctx context.Context, master []byte) (meta *media.CoreMeta, err error) {
+	_, span := tracer.Start(ctx, "image.identify")
+	defer func() { tracing.End(span, err) }()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return media.IdentifyV3(bytes.NewReader(master))
+}
+
+func (l Local) Verify(ctx context.Context, master []byte) (err error) {
+	ctx, span := tracer.Start(ctx, "image.verify")
+	defer func() { tracing.End(span, err) }()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	image, err := l.load(ctx, master)
+	if err != nil {
+		return err
+	}
+	image.Close()
+	return nil
+}
+
+func (Local) Tiles(ctx context.Context, master []byte, level, tileSize, overlap int, format string, region media.DZIRegion) (tiles []Tile, err error) {
+	ctx, span := tracer.Start(ctx, "image.tiles")
+	span.SetAttributes(attribute.Int("dzi.level", level), attribute.String("image.format", format))
+	defer func() { tracing.End(span, err) }()
+	if err := media.DZITilesV3(bytes.NewReader(master), level, tileSize, overlap, format, region, func(col, row int, data []byte) error {
+		tiles = append(tiles, Tile{Col: col, Row: row, Data: data})
+		return ctx.Err()
+	}); err != nil {
+		return nil, err
+	}
+	return tiles, nil
+}
+
+func (Local) ContactSheet(ctx context.Context, cells []media.ContactSheetCell, opts media.ContactSheetOptions) (data []byte, err error) {
+	_, span := tracer.Start(ctx, "image.contactsheet")
+	span.SetAttributes(attribute.Int("image.cells", len(cells)), attribute.String("image.format", opts.TargetFormat))
+	defer func() { tracing.End(span, err) }()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	data, _, err = media.ContactSheetV3(cells, opts)
+	return data, err
+}
+
+// run executes one request of the pool
+func (l Local) run(req *Request) (resp *Response) {
+	defer func() {
+		if r := recover(); r != nil {
+			resp = &Response{Err: fmt.Sprintf("panic in %s: %v", req.Op, r)}
+		}
+	}()
+	// the spans of the worker process are children of the caller
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(req.Trace))
+	resp = &Response{}
+	var err error
+	switch req.Op {
+	case OpDerivative:
+		resp.Data, err = l.Derivative(ctx, req.Master, req.Options)
+	case OpIdentify:
+		resp.Meta, err = l.Identify(ctx, req.Master)
+	case OpVerify:
+		err = l.Verify(ctx, req.Master)
+	case OpTiles:
+		resp.Tiles, err = l.Tiles(ctx, req.Master, req.Level, req.TileSize, req.Overlap, req.Format, req.Region)
+	case OpContactSheet:
+		resp.Data, err = l.ContactSheet(ctx, req.Cells, req.Sheet)
+	default:
+		err = errors.Errorf("unknown operation %s", req.Op)
+	}
+	if err != nil {
+		resp.Err = err.Error()
+		resp.TooLarge = errors.Cause(err) == media.ErrImageTooLarge
+	}
+	return resp
+}
+
+// Serve reads requests from r and writes the responses to w until r is closed
+func Serve(r io.Reader, w io.Writer) error {
+	dec := gob.NewDecoder(r)
+	enc := gob.NewEncoder(w)
+	var local Local
+	for {
+		var req Request
+		if err := dec.Decode(&req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Wrap(err, "cannot decode request")
+		}
+		if err := enc.Encode(local.run(&req)); err != nil {
+			return errors.Wrap(err, "cannot encode response")
+		}
+	}
+}
+
+// Run serves the requests of the parent process. requests are read from file descriptor 3,
+// responses are written to 4, so that stray output on stdout does not break the protocol
+func Run(memoryLimit int64) error {
+	if memoryLimit > 0 {
+		if err := setMemoryLimit(uint64(memoryLimit)); err != nil {
+			return errors.Wrapf(err, "cannot set memory limit %d", memoryLimit)
+		}
+	}
+	requests := os.NewFile(3, "requests")
+	responses := os.NewFile(4, "responses")
+	if requests == nil || responses == nil {
+		return errors.New("no pipes from parent process")
+	}
+	defer requests.Close()
+	defer responses.Close()
+	return Serve(requests, responses)
+}